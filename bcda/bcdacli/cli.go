@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/CMSgov/bcda-app/bcda/auth"
@@ -19,6 +21,7 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/suppression"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/CMSgov/bcda-app/bcda/web"
@@ -44,7 +47,8 @@ func setUpApp() *cli.App {
 	app.Name = Name
 	app.Usage = Usage
 	app.Version = constants.Version
-	var acoName, acoCMSID, acoID, accessToken, ttl, threshold, acoSize, filePath, dirToDelete, environment, groupID, groupName string
+	var acoName, acoCMSID, acoID, accessToken, ttl, threshold, acoSize, filePath, dirToDelete, environment, groupID, groupName, stuckAfter, format string
+	var validateOnly bool
 	app.Commands = []cli.Command{
 		{
 			Name:  "start-api",
@@ -144,6 +148,41 @@ func setUpApp() *cli.App {
 				return nil
 			},
 		},
+		{
+			Name:     "create-beneficiary-group",
+			Category: "Data import",
+			Usage:    "Create a named group of beneficiaries that an ACO can export with Group/{groupId}/$export",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of group, as used in the export URL",
+					Destination: &groupID,
+				},
+				cli.StringFlag{
+					Name:        "name",
+					Usage:       "Name of group",
+					Destination: &groupName,
+				},
+				cli.StringFlag{
+					Name:        "mbi-file",
+					Usage:       "Location of a file listing one MBI per line",
+					Destination: &filePath,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				count, err := createBeneficiaryGroup(acoCMSID, groupID, groupName, filePath)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(app.Writer, "Group %s created for ACO %s with %d beneficiaries\n", groupID, acoCMSID, count)
+				return nil
+			},
+		},
 		{
 			Name:     "create-aco",
 			Category: "Authentication tools",
@@ -358,6 +397,37 @@ func setUpApp() *cli.App {
 				return cleanupArchive(th)
 			},
 		},
+		{
+			Name:     "reap-stuck-jobs",
+			Category: "Cleanup",
+			Usage:    "Restart or fail Pending and In Progress jobs whose chunks are no longer in the work queue",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "stuck-after",
+					Usage:       "Minutes a job can go without progress before it is considered stuck (defaults to STUCK_JOB_THRESHOLD_MIN, or 60)",
+					Destination: &stuckAfter,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				minutes := utils.GetEnvInt("STUCK_JOB_THRESHOLD_MIN", 60)
+				if stuckAfter != "" {
+					var err error
+					if minutes, err = strconv.Atoi(stuckAfter); err != nil {
+						return err
+					}
+				}
+
+				qc, pgxpool, err := newQueClient()
+				if err != nil {
+					return err
+				}
+				defer pgxpool.Close()
+
+				completed, restarted, failed, err := reapStuckJobs(qc, time.Duration(minutes)*time.Minute)
+				fmt.Fprintf(app.Writer, "Stuck jobs completed: %d, restarted: %d, failed: %d\n", completed, restarted, failed)
+				return err
+			},
+		},
 		{
 			Name:     "import-cclf-directory",
 			Category: "Data import",
@@ -368,8 +438,29 @@ func setUpApp() *cli.App {
 					Usage:       "Directory where CCLF files are located",
 					Destination: &filePath,
 				},
+				cli.BoolFlag{
+					Name:        "validate-only",
+					Usage:       "Check the CCLF files and report any problems, without importing or moving them",
+					Destination: &validateOnly,
+				},
+				cli.StringFlag{
+					Name:        "format",
+					Usage:       "Format of the validate-only report: text or json",
+					Value:       "text",
+					Destination: &format,
+				},
 			},
 			Action: func(c *cli.Context) error {
+				if validateOnly {
+					if err := checkReportFormat(format); err != nil {
+						return err
+					}
+					checked, problems, err := cclf.ValidateCCLFDirectory(progressWriter(format), filePath)
+					if err != nil {
+						return err
+					}
+					return writeValidationReport(app.Writer, "CCLF", format, checked, problems)
+				}
 				success, failure, skipped, err := cclf.ImportCCLFDirectory(filePath)
 				fmt.Fprintf(app.Writer, "Completed CCLF import.  Successfully imported %v files.  Failed to import %v files.  Skipped %v files.  See logs for more details.", success, failure, skipped)
 				return err
@@ -385,13 +476,58 @@ func setUpApp() *cli.App {
 					Usage:       "Directory where suppression files are located",
 					Destination: &filePath,
 				},
+				cli.BoolFlag{
+					Name:        "validate-only",
+					Usage:       "Check the suppression files and report any problems, without importing or moving them",
+					Destination: &validateOnly,
+				},
+				cli.StringFlag{
+					Name:        "format",
+					Usage:       "Format of the validate-only report: text or json",
+					Value:       "text",
+					Destination: &format,
+				},
 			},
 			Action: func(c *cli.Context) error {
+				if validateOnly {
+					if err := checkReportFormat(format); err != nil {
+						return err
+					}
+					checked, problems, err := suppression.ValidateSuppressionDirectory(progressWriter(format), filePath)
+					if err != nil {
+						return err
+					}
+					return writeValidationReport(app.Writer, "suppression", format, checked, problems)
+				}
 				s, f, sk, err := suppression.ImportSuppressionDirectory(filePath)
 				fmt.Fprintf(app.Writer, "Completed 1-800-MEDICARE suppression data import.\nFiles imported: %v\nFiles failed: %v\nFiles skipped: %v\n", s, f, sk)
 				return err
 			},
 		},
+		{
+			Name:     "attribution-changes",
+			Category: "Data import",
+			Usage:    "Show the beneficiaries added to and dropped from an ACO by its latest CCLF8 file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.StringFlag{
+					Name:        "format",
+					Usage:       "Format of the report: text or json",
+					Value:       "text",
+					Destination: &format,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := checkReportFormat(format); err != nil {
+					return err
+				}
+				return showAttributionChanges(app.Writer, acoCMSID, format)
+			},
+		},
 		{
 			Name:     "delete-dir-contents",
 			Category: "Cleanup",
@@ -514,6 +650,46 @@ func createGroup(id, name, acoID string) (string, error) {
 	return ssasID, nil
 }
 
+func createBeneficiaryGroup(cmsID, groupID, name, mbiFile string) (int, error) {
+	if cmsID == "" || groupID == "" || mbiFile == "" {
+		return 0, errors.New("ACO CMS ID (--cms-id), ID (--id), and MBI file (--mbi-file) are required")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(filepath.Clean(mbiFile))
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to open file %s", mbiFile)
+	}
+	defer f.Close()
+
+	var mbis []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		mbi := strings.TrimSpace(sc.Text())
+		if mbi == "" {
+			continue
+		}
+		if len(mbi) != 11 {
+			return 0, fmt.Errorf("invalid MBI '%s' in file %s", mbi, mbiFile)
+		}
+		mbis = append(mbis, mbi)
+	}
+	if err = sc.Err(); err != nil {
+		return 0, errors.Wrapf(err, "unable to read file %s", mbiFile)
+	}
+
+	group, err := models.CreateBeneficiaryGroup(aco.UUID, groupID, name, mbis)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(group.Members), nil
+}
+
 func createACO(name, cmsID string) (string, error) {
 	if name == "" {
 		return "", errors.New("ACO name (--name) must be provided")
@@ -591,17 +767,18 @@ func archiveExpiring(hrThreshold int) error {
 		return err
 	}
 
+	store, err := storage.Get()
+	if err != nil {
+		return err
+	}
+
 	var lastJobError error
 	for _, j := range jobs {
 		t := j.UpdatedAt
 		elapsed := time.Since(t).Hours()
 		if int(elapsed) >= hrThreshold {
 
-			id := int(j.ID)
-			jobDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), id)
-			expDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_ARCHIVE_DIR"), id)
-
-			err = os.Rename(jobDir, expDir)
+			err = store.MoveDir(storage.Payload, storage.Archive, strconv.Itoa(int(j.ID)))
 			if err != nil {
 				log.Error(err)
 				lastJobError = err
@@ -620,6 +797,108 @@ func archiveExpiring(hrThreshold int) error {
 	return lastJobError
 }
 
+// stuckJobReason is shown to clients of jobs the reaper could not restart.
+const stuckJobReason = "The export stopped before all of its data was written and could not be restarted. Please start a new export."
+
+// reapStuckJobs looks for Pending and In Progress jobs that have not been updated for stuckAfter and have no chunks
+// left in the work queue, so nothing will move them on.  A job whose chunks all wrote their files is completed.
+// Otherwise its missing chunks are enqueued again, or, if they can't be regenerated, the job is marked Failed.
+func reapStuckJobs(qc *que.Client, stuckAfter time.Duration) (completed, restarted, failed int, err error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var jobs []models.Job
+	err = db.Find(&jobs, "status in (?) and updated_at <= ?", []string{"Pending", "In Progress"}, time.Now().Add(-stuckAfter)).Error
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var lastJobError error
+	for _, job := range jobs {
+		// chunks still queued are being worked or will be retried
+		queued, err := job.CountQueuedChunks()
+		if err != nil {
+			log.Error(err)
+			lastJobError = err
+			continue
+		}
+		if queued > 0 {
+			continue
+		}
+
+		if job.JobCount > 0 {
+			done, err := job.CheckCompletedAndCleanup(db)
+			if err != nil {
+				log.Error(err)
+				lastJobError = err
+				continue
+			}
+			if done {
+				log.Infof("Completed stuck job %d; all of its chunks had written their files", job.ID)
+				completed++
+				continue
+			}
+		}
+
+		var missing []*que.Job
+		if job.JobCount > 0 {
+			missing, err = job.GetMissingChunks(db)
+		} else {
+			err = errors.New("job was never enqueued")
+		}
+		if err != nil {
+			log.Warnf("Failing stuck job %d: %s", job.ID, err)
+			err = db.Model(&job).Where("status in (?)", []string{"Pending", "In Progress"}).
+				Updates(map[string]interface{}{"status": "Failed", "failure_reason": stuckJobReason}).Error
+			if err != nil {
+				log.Error(err)
+				lastJobError = err
+				continue
+			}
+			failed++
+			continue
+		}
+
+		for _, chunk := range missing {
+			if err = qc.Enqueue(chunk); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Error(err)
+			lastJobError = err
+			continue
+		}
+		// touch the job so it isn't reaped again before its chunks are picked up
+		if err = db.Model(&job).Update("updated_at", time.Now()).Error; err != nil {
+			log.Error(err)
+			lastJobError = err
+		}
+		log.Infof("Restarted stuck job %d; enqueued %d of its %d chunks again", job.ID, len(missing), job.JobCount)
+		restarted++
+	}
+
+	return completed, restarted, failed, lastJobError
+}
+
+// newQueClient connects to the work queue.
+func newQueClient() (*que.Client, *pgx.ConnPool, error) {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig:   pgxcfg,
+		AfterConnect: que.PrepareStatements,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return que.NewClient(pgxpool), pgxpool, nil
+}
+
 func cleanupArchive(hrThreshold int) error {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
@@ -637,17 +916,20 @@ func cleanupArchive(hrThreshold int) error {
 		return nil
 	}
 
+	store, err := storage.Get()
+	if err != nil {
+		return err
+	}
+
 	for _, job := range jobs {
 		t := job.UpdatedAt
 		elapsed := time.Since(t).Hours()
 		if int(elapsed) >= hrThreshold {
 
-			id := int(job.ID)
-			jobArchiveDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_ARCHIVE_DIR"), id)
-
-			err = os.RemoveAll(jobArchiveDir)
+			jobArchiveDir := strconv.Itoa(int(job.ID))
+			err = store.RemoveAll(storage.Archive, jobArchiveDir)
 			if err != nil {
-				e := fmt.Sprintf("Unable to remove %s because %s", jobArchiveDir, err)
+				e := fmt.Sprintf("Unable to remove archive of job %s because %s", jobArchiveDir, err)
 				log.Error(e)
 				continue
 			}
@@ -668,3 +950,88 @@ func cleanupArchive(hrThreshold int) error {
 
 	return nil
 }
+
+func checkReportFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q; expected text or json", format)
+	}
+	return nil
+}
+
+// progressWriter returns where a validate-only import writes its progress messages: standard output, unless the report
+// is to be JSON, in which case they go to standard error so that the report is the only thing on standard output.
+func progressWriter(format string) io.Writer {
+	if format == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeValidationReport reports the files checked by a validate-only import and the problems found, returning an
+// error if there were any.
+func writeValidationReport(w io.Writer, kind, format string, checked int, problems []utils.FileProblem) error {
+	if format == "json" {
+		report := struct {
+			FilesChecked int                 `json:"filesChecked"`
+			Problems     []utils.FileProblem `json:"problems"`
+		}{checked, problems}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(w, "Completed %s validation.  Checked %d files.  Found %d problems.\n", kind, checked, len(problems))
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s: %s\n", p.File, p.Problem)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in %s files", len(problems), kind)
+	}
+	return nil
+}
+
+func showAttributionChanges(w io.Writer, cmsID, format string) error {
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return err
+	}
+	changes, err := aco.GetAttributionChanges()
+	if err != nil {
+		return err
+	}
+
+	var prevName string
+	if changes.PreviousFile != nil {
+		prevName = changes.PreviousFile.Name
+	}
+
+	if format == "json" {
+		report := struct {
+			File         string   `json:"file"`
+			PreviousFile string   `json:"previousFile,omitempty"`
+			Added        []string `json:"added"`
+			Dropped      []string `json:"dropped"`
+		}{changes.File.Name, prevName, append([]string{}, changes.Added...), append([]string{}, changes.Dropped...)}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	if changes.PreviousFile == nil {
+		fmt.Fprintf(w, "CCLF8 file %s is the first for ACO %s in performance year %d; there are no attribution changes.\n", changes.File.Name, cmsID, changes.File.PerformanceYear)
+		return nil
+	}
+	fmt.Fprintf(w, "Attribution changes for ACO %s from CCLF8 file %s to %s.\n", cmsID, prevName, changes.File.Name)
+	fmt.Fprintf(w, "Added: %d\n", len(changes.Added))
+	for _, mbi := range changes.Added {
+		fmt.Fprintf(w, "  %s\n", mbi)
+	}
+	fmt.Fprintf(w, "Dropped: %d\n", len(changes.Dropped))
+	for _, mbi := range changes.Dropped {
+		fmt.Fprintf(w, "  %s\n", mbi)
+	}
+	return nil
+}
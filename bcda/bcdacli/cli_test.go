@@ -2,6 +2,7 @@ package bcdacli
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -516,6 +517,60 @@ func (s *CLITestSuite) TestCleanArchive() {
 	os.RemoveAll(os.Getenv("FHIR_ARCHIVE_DIR"))
 }
 
+func (s *CLITestSuite) TestReapStuckJobs() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+	assert := assert.New(s.T())
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	acoID := uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	// every chunk wrote its file, but the job was never marked Completed
+	finished := models.Job{ACOID: acoID, RequestURL: "/api/v1/Patient/$export", Status: "In Progress", JobCount: 1, ResourceTypes: "Patient"}
+	db.Save(&finished)
+	defer db.Unscoped().Delete(&finished)
+	jobKey := models.JobKey{JobID: finished.ID, FileName: "patient.ndjson", ResourceType: "Patient", Chunk: 1}
+	db.Save(&jobKey)
+	defer db.Unscoped().Delete(&jobKey)
+	// the API stopped before the job's chunks were enqueued
+	neverEnqueued := models.Job{ACOID: acoID, RequestURL: "/api/v1/Patient/$export", Status: "Pending"}
+	db.Save(&neverEnqueued)
+	defer db.Unscoped().Delete(&neverEnqueued)
+	// the ACO's beneficiaries changed after the job's chunks were enqueued, so its lost chunk can't be regenerated
+	changed := models.Job{ACOID: acoID, RequestURL: "/api/v1/Patient/$export", Status: "In Progress", JobCount: 1, ResourceTypes: "Patient", BeneficiaryDigest: "stale"}
+	db.Save(&changed)
+	defer db.Unscoped().Delete(&changed)
+	// recently updated, so not yet considered stuck
+	recent := models.Job{ACOID: acoID, RequestURL: "/api/v1/Patient/$export", Status: "Pending"}
+	db.Save(&recent)
+	defer db.Unscoped().Delete(&recent)
+
+	old := time.Now().Add(-2 * time.Hour)
+	db.Model(&finished).UpdateColumn("updated_at", old)
+	db.Model(&neverEnqueued).UpdateColumn("updated_at", old)
+	db.Model(&changed).UpdateColumn("updated_at", old)
+
+	args := []string{"bcda", "reap-stuck-jobs", "--stuck-after", "60"}
+	err := s.testApp.Run(args)
+	assert.Nil(err)
+	// other tests may leave stuck jobs behind, so only these jobs are checked
+	assert.Contains(buf.String(), "Stuck jobs completed: ")
+
+	db.First(&finished, finished.ID)
+	assert.Equal("Completed", finished.Status)
+	db.First(&neverEnqueued, neverEnqueued.ID)
+	assert.Equal("Failed", neverEnqueued.Status)
+	assert.Equal(stuckJobReason, neverEnqueued.FailureReason)
+	db.First(&changed, changed.ID)
+	assert.Equal("Failed", changed.Status)
+	db.First(&recent, recent.ID)
+	assert.Equal("Pending", recent.Status)
+
+	args = []string{"bcda", "reap-stuck-jobs", "--stuck-after", "abc"}
+	err = s.testApp.Run(args)
+	assert.NotNil(err)
+}
+
 func (s *CLITestSuite) TestRevokeToken() {
 	originalAuthProvider := auth.GetProviderName()
 	defer auth.SetProvider(originalAuthProvider)
@@ -704,7 +759,7 @@ func (s *CLITestSuite) TestImportCCLFDirectory() {
 	err := s.testApp.Run(args)
 	assert.Nil(err)
 	assert.Contains(buf.String(), "Completed CCLF import.")
-	assert.Contains(buf.String(), "Successfully imported 6 files.")
+	assert.Contains(buf.String(), "Successfully imported 7 files.")
 	assert.Contains(buf.String(), "Failed to import 0 files.")
 	assert.Contains(buf.String(), "Skipped 1 files.")
 
@@ -791,6 +846,97 @@ func (s *CLITestSuite) TestImportSuppressionDirectory() {
 	}
 }
 
+func (s *CLITestSuite) TestImportSuppressionDirectory_ValidateOnly() {
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	path := "../../shared_files/synthetic1800MedicareFiles/test/"
+
+	args := []string{"bcda", "import-suppression-directory", "--directory", path, "--validate-only"}
+	err := s.testApp.Run(args)
+	assert.Nil(err)
+	assert.Contains(buf.String(), "Completed suppression validation.  Checked 2 files.  Found 0 problems.")
+
+	// nothing was imported
+	var count int
+	db.Model(&models.SuppressionFile{}).Where("name in (?)", []string{"T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000009", "T#EFT.ON.ACO.NGD1800.DPRF.D190816.T0241390"}).Count(&count)
+	assert.Zero(count)
+
+	buf.Reset()
+
+	path = "../../shared_files/suppressionfile_BadHeader/"
+	args = []string{"bcda", "import-suppression-directory", "--directory", path, "--validate-only", "--format", "json"}
+	err = s.testApp.Run(args)
+	assert.EqualError(err, "1 problems found in suppression files")
+	var report struct {
+		FilesChecked int
+		Problems     []utils.FileProblem
+	}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(1, report.FilesChecked)
+	assert.Equal([]utils.FileProblem{{
+		File:    path + "T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000009",
+		Problem: "invalid file header for file: " + path + "T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000009",
+	}}, report.Problems)
+
+	args = []string{"bcda", "import-suppression-directory", "--directory", path, "--validate-only", "--format", "xml"}
+	err = s.testApp.Run(args)
+	assert.EqualError(err, `unknown format "xml"; expected text or json`)
+}
+
+func (s *CLITestSuite) TestImportCCLFDirectory_ValidateOnly() {
+	assert := assert.New(s.T())
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	path := "../../shared_files/cclf/archives/valid/"
+
+	args := []string{"bcda", "import-cclf-directory", "--directory", path, "--validate-only"}
+	err := s.testApp.Run(args)
+	assert.EqualError(err, "1 problems found in CCLF files")
+	assert.Contains(buf.String(), "Completed CCLF validation.  Checked 7 files.  Found 1 problems.")
+	assert.Contains(buf.String(), path+"T.BCD.ACOB.ZC0Y18.D181120.T0001000: invalid foldername for CCLF archive: T.BCD.ACOB.ZC0Y18.D181120.T0001000")
+
+	// nothing was moved
+	_, err = os.Stat(path + "T.BCD.A0001.ZCY18.D181120.T1000000")
+	assert.Nil(err)
+}
+
+func (s *CLITestSuite) TestImportCCLFDirectory_ValidateOnlyJSON() {
+	assert := assert.New(s.T())
+
+	// the report goes to standard output along with anything else printed there
+	out, err := ioutil.TempFile("", "validate")
+	assert.Nil(err)
+	defer os.Remove(out.Name())
+	stdout := os.Stdout
+	os.Stdout = out
+	s.testApp.Writer = out
+
+	path := "../../shared_files/cclf/archives/valid/"
+	args := []string{"bcda", "import-cclf-directory", "--directory", path, "--validate-only", "--format", "json"}
+	err = s.testApp.Run(args)
+	os.Stdout = stdout
+	assert.EqualError(err, "1 problems found in CCLF files")
+	assert.Nil(out.Close())
+
+	data, err := ioutil.ReadFile(out.Name())
+	assert.Nil(err)
+	var report struct {
+		FilesChecked int
+		Problems     []utils.FileProblem
+	}
+	assert.Nil(json.Unmarshal(data, &report), string(data))
+	assert.Equal(7, report.FilesChecked)
+	assert.Len(report.Problems, 1)
+}
+
 func (s *CLITestSuite) TestImportSuppressionDirectory_Skipped() {
 	assert := assert.New(s.T())
 
@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
@@ -40,20 +42,20 @@ type cclfFileValidator struct {
 	maxRecordLength  int
 }
 
-func importCCLF0(fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator, error) {
+func importCCLF0(w io.Writer, fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator, error) {
 	if fileMetadata == nil {
-		fmt.Println("File CCLF0 not found.")
+		fmt.Fprintln(w, "File CCLF0 not found.")
 		err := errors.New("file CCLF0 not found")
 		log.Error(err)
 		return nil, err
 	}
 
-	fmt.Printf("Importing CCLF0 file %s...\n", fileMetadata)
+	fmt.Fprintf(w, "Importing CCLF0 file %s...\n", fileMetadata)
 	log.Infof("Importing CCLF0 file %s...", fileMetadata)
 
 	r, err := zip.OpenReader(filepath.Clean(fileMetadata.filePath))
 	if err != nil {
-		fmt.Printf("Could not read CCLF0 archive %s.\n", fileMetadata)
+		fmt.Fprintf(w, "Could not read CCLF0 archive %s.\n", fileMetadata)
 		err := errors.Wrapf(err, "could not read CCLF0 archive %s", fileMetadata)
 		log.Error(err)
 		return nil, err
@@ -73,13 +75,13 @@ func importCCLF0(fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator,
 		// iterate in this zipped folder until we find our cclf0 file
 		if f.Name == fileMetadata.name {
 			rawFile = f
-			fmt.Printf("Reading file %s from archive %s.\n", fileMetadata.name, fileMetadata.filePath)
+			fmt.Fprintf(w, "Reading file %s from archive %s.\n", fileMetadata.name, fileMetadata.filePath)
 			log.Infof("Reading file %s from archive %s", fileMetadata.name, fileMetadata.filePath)
 		}
 	}
 
 	if rawFile == nil {
-		fmt.Printf("File %s not found in archive %s.\n", fileMetadata.name, fileMetadata.filePath)
+		fmt.Fprintf(w, "File %s not found in archive %s.\n", fileMetadata.name, fileMetadata.filePath)
 		err = errors.Wrapf(err, "file %s not found in archive %s", fileMetadata.name, fileMetadata.filePath)
 		log.Error(err)
 		return nil, err
@@ -87,7 +89,7 @@ func importCCLF0(fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator,
 
 	rc, err := rawFile.Open()
 	if err != nil {
-		fmt.Printf("Could not read file %s in CCLF0 archive %s.\n", fileMetadata.name, fileMetadata.filePath)
+		fmt.Fprintf(w, "Could not read file %s in CCLF0 archive %s.\n", fileMetadata.name, fileMetadata.filePath)
 		err = errors.Wrapf(err, "could not read file %s in CCLF0 archive %s", fileMetadata.name, fileMetadata.filePath)
 		log.Error(err)
 		return nil, err
@@ -99,13 +101,14 @@ func importCCLF0(fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator,
 		if len(bytes.TrimSpace(b)) > 0 {
 			filetype := string(bytes.TrimSpace(b[fileNumStart:fileNumEnd]))
 
-			if filetype == "CCLF8" {
+			// every file type in the package is recorded, so that each file imported can be validated
+			if strings.HasPrefix(filetype, "CCLF") {
 				if validator == nil {
 					validator = make(map[string]cclfFileValidator)
 				}
 
 				if _, ok := validator[filetype]; ok {
-					fmt.Printf("Duplicate %v file type found from CCLF0 file.\n", filetype)
+					fmt.Fprintf(w, "Duplicate %v file type found from CCLF0 file.\n", filetype)
 					err := fmt.Errorf("duplicate %v file type found from CCLF0 file", filetype)
 					log.Error(err)
 					return nil, err
@@ -113,14 +116,14 @@ func importCCLF0(fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator,
 
 				count, err := strconv.Atoi(string(bytes.TrimSpace(b[totalRecordStart:totalRecordEnd])))
 				if err != nil {
-					fmt.Printf("Failed to parse %s record count from CCLF0 file.\n", filetype)
+					fmt.Fprintf(w, "Failed to parse %s record count from CCLF0 file.\n", filetype)
 					err = errors.Wrapf(err, "failed to parse %s record count from CCLF0 file", filetype)
 					log.Error(err)
 					return nil, err
 				}
 				length, err := strconv.Atoi(string(bytes.TrimSpace(b[recordLengthStart:recordLengthEnd])))
 				if err != nil {
-					fmt.Printf("Failed to parse %s record length from CCLF0 file.\n", filetype)
+					fmt.Fprintf(w, "Failed to parse %s record length from CCLF0 file.\n", filetype)
 					err = errors.Wrapf(err, "failed to parse %s record length from CCLF0 file", filetype)
 					log.Error(err)
 					return nil, err
@@ -131,47 +134,75 @@ func importCCLF0(fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator,
 	}
 
 	if _, ok := validator["CCLF8"]; !ok {
-		fmt.Printf("Failed to parse CCLF8 from CCLF0 file %s.\n", fileMetadata)
+		fmt.Fprintf(w, "Failed to parse CCLF8 from CCLF0 file %s.\n", fileMetadata)
 		err := fmt.Errorf("failed to parse CCLF8 from CCLF0 file %s", fileMetadata)
 		log.Error(err)
 		return nil, err
 	}
-	fmt.Printf("Successfully imported CCLF0 file %s.\n", fileMetadata)
+	fmt.Fprintf(w, "Successfully imported CCLF0 file %s.\n", fileMetadata)
 	log.Infof("Successfully imported CCLF0 file %s.", fileMetadata)
 
 	return validator, nil
 }
 
 func importCCLF8(fileMetadata *cclfFileMetadata) error {
-	err := importCCLF(fileMetadata, func(fileID uint, b []byte, db *gorm.DB) error {
-		const (
-			mbiStart, mbiEnd   = 0, 11
-			hicnStart, hicnEnd = 11, 22
-		)
-		cclfBeneficiary := &models.CCLFBeneficiary{
-			FileID: fileID,
-			MBI:    string(bytes.TrimSpace(b[mbiStart:mbiEnd])),
-			HICN:   string(bytes.TrimSpace(b[hicnStart:hicnEnd])),
-		}
-		err := db.Create(cclfBeneficiary).Error
-		if err != nil {
-			fmt.Println("Could not create CCLF8 beneficiary record.")
-			err = errors.Wrap(err, "could not create CCLF8 beneficiary record")
-			log.Error(err)
-			return err
-		}
-		return nil
-	})
+	return importCCLF(fileMetadata, "cclf_beneficiaries", []string{"mbi", "hicn", "blue_button_id"}, parseCCLF8)
+}
 
-	if err != nil {
-		updateImportStatus(fileMetadata, constants.ImportFail)
-		return err
-	}
-	updateImportStatus(fileMetadata, constants.ImportComplete)
-	return nil
+// parseCCLF8 parses a beneficiary record of a CCLF8 file into its MBI and HICN.  The beneficiary's Blue Button ID is
+// left empty until it is looked up for an export.
+func parseCCLF8(b []byte) ([]interface{}, error) {
+	const (
+		mbiStart, mbiEnd   = 0, 11
+		hicnStart, hicnEnd = 11, 22
+	)
+	if len(b) < hicnEnd {
+		return nil, fmt.Errorf("record too short (expected at least: %d, actual: %d)", hicnEnd, len(b))
+	}
+	return []interface{}{
+		string(bytes.TrimSpace(b[mbiStart:mbiEnd])),
+		string(bytes.TrimSpace(b[hicnStart:hicnEnd])),
+		"",
+	}, nil
+}
+
+// importCCLF9 imports the beneficiary XREF file, which links beneficiaries' current MBIs or HICNs to those they had
+// before.
+func importCCLF9(fileMetadata *cclfFileMetadata) error {
+	columns := []string{"xref_indicator", "current_num", "prev_num", "prevs_efct_dt", "prevs_obslt_dt"}
+	return importCCLF(fileMetadata, "cclf_beneficiary_xrefs", columns, parseCCLF9)
 }
 
-func importCCLF(fileMetadata *cclfFileMetadata, importFunc func(uint, []byte, *gorm.DB) error) error {
+// parseCCLF9 parses a record of a CCLF9 file into its XREF indicator, current and previous IDs, and the dates the
+// previous ID was in effect.
+func parseCCLF9(b []byte) ([]interface{}, error) {
+	const (
+		xrefIndicatorStart, xrefIndicatorEnd = 0, 1
+		currentNumStart, currentNumEnd       = 1, 12
+		prevNumStart, prevNumEnd             = 12, 23
+		prevsEfctDtStart, prevsEfctDtEnd     = 23, 33
+		prevsObsltDtStart, prevsObsltDtEnd   = 33, 43
+	)
+	// records without a previous ID's obsolete date may have its trailing spaces trimmed
+	if len(b) < prevsObsltDtEnd {
+		padded := bytes.Repeat([]byte(" "), prevsObsltDtEnd)
+		copy(padded, b)
+		b = padded
+	}
+	return []interface{}{
+		string(bytes.TrimSpace(b[xrefIndicatorStart:xrefIndicatorEnd])),
+		string(bytes.TrimSpace(b[currentNumStart:currentNumEnd])),
+		string(bytes.TrimSpace(b[prevNumStart:prevNumEnd])),
+		string(bytes.TrimSpace(b[prevsEfctDtStart:prevsEfctDtEnd])),
+		string(bytes.TrimSpace(b[prevsObsltDtStart:prevsObsltDtEnd])),
+	}, nil
+}
+
+// importCCLF imports a CCLF file, parsing each of its records into the values of columns of a row of table.  The rows
+// are streamed into the database with COPY, in one transaction with the file's record, so a file that fails to import
+// leaves none of its rows behind.  The file is then recorded as failed.  A CCLF8 file's changes to the ACO's
+// attribution are recorded in the same transaction.
+func importCCLF(fileMetadata *cclfFileMetadata, table string, columns []string, parseFunc func([]byte) ([]interface{}, error)) error {
 	if fileMetadata == nil {
 		fmt.Println("CCLF file not found.")
 		err := errors.New("CCLF file not found")
@@ -198,30 +229,6 @@ func importCCLF(fileMetadata *cclfFileMetadata, importFunc func(uint, []byte, *g
 		return err
 	}
 
-	cclfFile := models.CCLFFile{
-		CCLFNum:         fileMetadata.cclfNum,
-		Name:            fileMetadata.name,
-		ACOCMSID:        fileMetadata.acoID,
-		Timestamp:       fileMetadata.timestamp,
-		PerformanceYear: fileMetadata.perfYear,
-		ImportStatus:    constants.ImportInprog,
-	}
-
-	db := database.GetGORMDbConnection()
-	defer database.Close(db)
-
-	err = db.Create(&cclfFile).Error
-	if err != nil {
-		fmt.Printf("Could not create CCLF%d file record.\n", fileMetadata.cclfNum)
-		err = errors.Wrapf(err, "could not create CCLF%d file record", fileMetadata.cclfNum)
-		log.Error(err)
-		return err
-	}
-
-	fileMetadata.fileID = cclfFile.ID
-
-	importStatusInterval := utils.GetEnvInt("CCLF_IMPORT_STATUS_RECORDS_INTERVAL", 1000)
-	importedCount := 0
 	var rawFile *zip.File
 
 	for _, f := range r.File {
@@ -241,43 +248,120 @@ func importCCLF(fileMetadata *cclfFileMetadata, importFunc func(uint, []byte, *g
 
 	rc, err := rawFile.Open()
 	if err != nil {
-		fmt.Printf("Could not read file %s for CCLF%d in archive %s.\n", cclfFile.Name, fileMetadata.cclfNum, fileMetadata.filePath)
-		err = errors.Wrapf(err, "could not read file %s for CCLF%d in archive %s", cclfFile.Name, fileMetadata.cclfNum, fileMetadata.filePath)
+		fmt.Printf("Could not read file %s for CCLF%d in archive %s.\n", fileMetadata.name, fileMetadata.cclfNum, fileMetadata.filePath)
+		err = errors.Wrapf(err, "could not read file %s for CCLF%d in archive %s", fileMetadata.name, fileMetadata.cclfNum, fileMetadata.filePath)
 		log.Error(err)
 		return err
 	}
 	defer rc.Close()
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cclfFile := models.CCLFFile{
+		CCLFNum:         fileMetadata.cclfNum,
+		Name:            fileMetadata.name,
+		ACOCMSID:        fileMetadata.acoID,
+		Timestamp:       fileMetadata.timestamp,
+		PerformanceYear: fileMetadata.perfYear,
+		ImportStatus:    constants.ImportComplete,
+	}
+
+	tx := db.Begin()
+	importedCount, err := copyCCLFRecords(tx, &cclfFile, rc, table, columns, parseFunc)
+	if err == nil && fileMetadata.cclfNum == 8 {
+		if err = cclfFile.RecordAttributionChanges(tx); err != nil {
+			fmt.Printf("Could not record attribution changes for CCLF8 file %s.\n", fileMetadata)
+			err = errors.Wrapf(err, "could not record attribution changes for CCLF8 file %s", fileMetadata)
+		}
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		log.Error(err)
+		cclfFile.Model, cclfFile.ImportStatus, cclfFile.PreviousFileID = gorm.Model{}, constants.ImportFail, 0
+		if failErr := db.Create(&cclfFile).Error; failErr != nil {
+			log.Error(errors.Wrapf(failErr, "could not record failed import of CCLF%d file %s", fileMetadata.cclfNum, fileMetadata))
+		}
+		fileMetadata.fileID = cclfFile.ID
+		return err
+	}
+	fileMetadata.fileID = cclfFile.ID
+
+	successMsg := fmt.Sprintf("Successfully imported %d records from CCLF%d file %s.", importedCount, fileMetadata.cclfNum, fileMetadata)
+	fmt.Println(successMsg)
+	log.Infof(successMsg)
+
+	return nil
+}
+
+// copyCCLFRecords creates the file's record in tx and copies a row for each of the file's records into table,
+// returning the number of records copied.
+func copyCCLFRecords(tx *gorm.DB, cclfFile *models.CCLFFile, rc io.Reader, table string, columns []string, parseFunc func([]byte) ([]interface{}, error)) (int, error) {
+	err := tx.Create(cclfFile).Error
+	if err != nil {
+		fmt.Printf("Could not create CCLF%d file record.\n", cclfFile.CCLFNum)
+		return 0, errors.Wrapf(err, "could not create CCLF%d file record", cclfFile.CCLFNum)
+	}
+
+	copyColumns := append([]string{"file_id"}, columns...)
+	copyColumns = append(copyColumns, "created_at", "updated_at")
+	stmt, err := tx.CommonDB().Prepare(pq.CopyIn(table, copyColumns...))
+	if err != nil {
+		fmt.Printf("Could not start copying CCLF%d records.\n", cclfFile.CCLFNum)
+		return 0, errors.Wrapf(err, "could not start copying CCLF%d records", cclfFile.CCLFNum)
+	}
+	defer stmt.Close()
+
+	importStatusInterval := utils.GetEnvInt("CCLF_IMPORT_STATUS_RECORDS_INTERVAL", 1000)
+	importedCount := 0
+	now := time.Now()
+
 	sc := bufio.NewScanner(rc)
 	for sc.Scan() {
 		b := sc.Bytes()
 		if len(bytes.TrimSpace(b)) > 0 {
-			err = importFunc(cclfFile.ID, b, db)
+			fields, err := parseFunc(b)
 			if err != nil {
-				log.Error(err)
-				return err
+				fmt.Printf("Could not parse CCLF%d record %d.\n", cclfFile.CCLFNum, importedCount+1)
+				return importedCount, errors.Wrapf(err, "could not parse CCLF%d record %d", cclfFile.CCLFNum, importedCount+1)
+			}
+			values := append([]interface{}{cclfFile.ID}, fields...)
+			values = append(values, now, now)
+			if _, err = stmt.Exec(values...); err != nil {
+				fmt.Printf("Could not copy CCLF%d record.\n", cclfFile.CCLFNum)
+				return importedCount, errors.Wrapf(err, "could not copy CCLF%d record", cclfFile.CCLFNum)
 			}
 			importedCount++
 			if importedCount%importStatusInterval == 0 {
-				fmt.Printf("CCLF%d records imported: %d\n", fileMetadata.cclfNum, importedCount)
+				fmt.Printf("CCLF%d records imported: %d\n", cclfFile.CCLFNum, importedCount)
 			}
 		}
 	}
+	if err = sc.Err(); err != nil {
+		fmt.Printf("Could not read CCLF%d file %s.\n", cclfFile.CCLFNum, cclfFile.Name)
+		return importedCount, errors.Wrapf(err, "could not read CCLF%d file %s", cclfFile.CCLFNum, cclfFile.Name)
+	}
 
-	successMsg := fmt.Sprintf("Successfully imported %d records from CCLF%d file %s.", importedCount, fileMetadata.cclfNum, fileMetadata)
-	fmt.Println(successMsg)
-	log.Infof(successMsg)
-
-	return nil
+	// the rows are sent as they are copied; this waits for the database to accept them all
+	if _, err = stmt.Exec(); err != nil {
+		fmt.Printf("Could not copy CCLF%d records.\n", cclfFile.CCLFNum)
+		return importedCount, errors.Wrapf(err, "could not copy CCLF%d records", cclfFile.CCLFNum)
+	}
+	return importedCount, nil
 }
 
-func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
+func getCCLFFileMetadata(w io.Writer, fileName string) (cclfFileMetadata, error) {
 	var metadata cclfFileMetadata
-	// CCLF filename convention for SSP with BCD identifier: P.BCD.A****.ZC[0|8][Y]**.Dyymmdd.Thhmmsst
-	filenameRegexp := regexp.MustCompile(`(T|P)\.BCD\.((?:A|T)\d{4})\.ZC(0|8)Y(\d{2})\.(D\d{6}\.T\d{6})\d`)
+	// CCLF filename convention for SSP with BCD identifier: P.BCD.A****.ZC[0|8|9][Y]**.Dyymmdd.Thhmmsst
+	filenameRegexp := regexp.MustCompile(`(T|P)\.BCD\.((?:A|T)\d{4})\.ZC(0|8|9)Y(\d{2})\.(D\d{6}\.T\d{6})\d`)
 	filenameMatches := filenameRegexp.FindStringSubmatch(fileName)
 
 	if len(filenameMatches) < 5 {
-		fmt.Printf("Invalid filename for file: %s.\n", fileName)
+		fmt.Fprintf(w, "Invalid filename for file: %s.\n", fileName)
 		err := fmt.Errorf("invalid filename for file: %s", fileName)
 		log.Error(err)
 		return metadata, err
@@ -285,7 +369,7 @@ func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
 
 	cclfNum, err := strconv.Atoi(filenameMatches[3])
 	if err != nil {
-		fmt.Printf("Failed to parse CCLF number from file: %s.\n", fileName)
+		fmt.Fprintf(w, "Failed to parse CCLF number from file: %s.\n", fileName)
 		err = errors.Wrapf(err, "failed to parse CCLF number from file: %s", fileName)
 		log.Error(err)
 		return metadata, err
@@ -293,7 +377,7 @@ func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
 
 	perfYear, err := strconv.Atoi(filenameMatches[4])
 	if err != nil {
-		fmt.Printf("Failed to parse performance year from file: %s.\n", fileName)
+		fmt.Fprintf(w, "Failed to parse performance year from file: %s.\n", fileName)
 		err = errors.Wrapf(err, "failed to parse performance year from file: %s", fileName)
 		log.Error(err)
 		return metadata, err
@@ -302,7 +386,7 @@ func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
 	filenameDate := filenameMatches[5]
 	t, err := time.Parse("D060102.T150405", filenameDate)
 	if err != nil || t.IsZero() {
-		fmt.Printf("Failed to parse date '%s' from file: %s.\n", filenameDate, fileName)
+		fmt.Fprintf(w, "Failed to parse date '%s' from file: %s.\n", filenameDate, fileName)
 		err = errors.Wrapf(err, "failed to parse date '%s' from file: %s", filenameDate, fileName)
 		log.Error(err)
 		return metadata, err
@@ -319,7 +403,7 @@ func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
 	filesNotBefore := refDate.Add(-1 * time.Duration(int64(maxFileDays*24)*int64(time.Hour)))
 	filesNotAfter := refDate
 	if t.Before(filesNotBefore) || t.After(filesNotAfter) {
-		fmt.Printf("Date '%s' from file %s is out of range; comparison date %s\n", filenameDate, fileName, refDate.Format("060102"))
+		fmt.Fprintf(w, "Date '%s' from file %s is out of range; comparison date %s\n", filenameDate, fileName, refDate.Format("060102"))
 		err = errors.New(fmt.Sprintf("date '%s' from file %s out of range; comparison date %s", filenameDate, fileName, refDate.Format("060102")))
 		log.Error(err)
 		return metadata, err
@@ -327,7 +411,7 @@ func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
 
 	acoID := filenameMatches[2]
 	if len(acoID) < 5 {
-		fmt.Printf("Failed to parse aco id '%s' from file: %s.\n", acoID, fileName)
+		fmt.Fprintf(w, "Failed to parse aco id '%s' from file: %s.\n", acoID, fileName)
 		err = errors.Wrapf(err, "failed to parse aco id '%s' from file: %s", acoID, fileName)
 		log.Error(err)
 		return metadata, err
@@ -365,40 +449,43 @@ func ImportCCLFDirectory(filePath string) (success, failure, skipped int, err er
 
 	for _, acoID := range acoOrder {
 		for _, cclfFiles := range cclfMap[acoID] {
-			var cclf0, cclf8 *cclfFileMetadata
+			var cclf0, cclf8, cclf9 *cclfFileMetadata
 			for _, cclf := range cclfFiles {
 				if cclf.cclfNum == 0 {
 					cclf0 = cclf
 				} else if cclf.cclfNum == 8 {
 					cclf8 = cclf
+				} else if cclf.cclfNum == 9 {
+					cclf9 = cclf
 				}
 			}
-			cclfvalidator, err := importCCLF0(cclf0)
+			cclfvalidator, err := importCCLF0(os.Stdout, cclf0)
 			if err != nil {
 				fmt.Printf("Failed to import CCLF0 file: %s, Skipping CCLF8 file: %s.\n ", cclf0, cclf8)
 				log.Errorf("Failed to import CCLF0 file: %s, Skipping CCLF8 file: %s ", cclf0, cclf8)
 				failure++
 				skipped += 2
+				if cclf9 != nil {
+					skipped++
+				}
 				continue
 			} else {
 				success++
 			}
-			err = validate(cclf8, cclfvalidator)
-			if err != nil {
-				fmt.Printf("Failed to validate CCLF8 file: %s.\n", cclf8)
-				log.Errorf("Failed to validate CCLF8 file: %s", cclf8)
-				failure++
+			if importValidated(cclf8, cclfvalidator, importCCLF8) {
+				success++
 			} else {
-				if err = importCCLF8(cclf8); err != nil {
-					fmt.Printf("Failed to import CCLF8 file: %s.\n", cclf8)
-					log.Errorf("Failed to import CCLF8 file: %s ", cclf8)
-					failure++
-				} else {
-					cclf8.imported = true
+				failure++
+			}
+			// the XREF file is optional; a package without one is still complete
+			if cclf9 != nil {
+				if importValidated(cclf9, cclfvalidator, importCCLF9) {
 					success++
+				} else {
+					failure++
 				}
 			}
-			cclf0.imported = cclf8 != nil && cclf8.imported
+			cclf0.imported = cclf8 != nil && cclf8.imported && (cclf9 == nil || cclf9.imported)
 		}
 	}
 
@@ -416,14 +503,143 @@ func ImportCCLFDirectory(filePath string) (success, failure, skipped int, err er
 	return success, failure, skipped, err
 }
 
+// ValidateCCLFDirectory checks the CCLF files in a directory as ImportCCLFDirectory would before importing them, and
+// parses each of their records, without writing to the database or moving any files.  Progress messages are written to
+// w.  It returns the number of CCLF files checked and every problem found.
+func ValidateCCLFDirectory(w io.Writer, filePath string) (checked int, problems []utils.FileProblem, err error) {
+	var cclfMap = make(map[string]map[int][]*cclfFileMetadata)
+	var skipped int
+	problems = []utils.FileProblem{}
+
+	err = filepath.Walk(filePath, walkCCLFArchives(w, &cclfMap, &skipped, &problems))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, acoID := range orderACOs(&cclfMap) {
+		for perfYear, cclfFiles := range cclfMap[acoID] {
+			var cclf0 *cclfFileMetadata
+			hasCCLF8 := false
+			for _, cclf := range cclfFiles {
+				if cclf.cclfNum == 0 {
+					cclf0 = cclf
+				} else if cclf.cclfNum == 8 {
+					hasCCLF8 = true
+				}
+			}
+			if cclf0 == nil {
+				problems = append(problems, utils.FileProblem{File: cclfFiles[0].filePath, Problem: fmt.Sprintf("no CCLF0 file found for ACO %s performance year %d", acoID, perfYear)})
+				continue
+			}
+
+			checked++
+			cclfvalidator, err := importCCLF0(w, cclf0)
+			if err != nil {
+				problems = append(problems, utils.FileProblem{File: filepath.Join(cclf0.filePath, cclf0.name), Problem: err.Error()})
+				continue
+			}
+			if !hasCCLF8 {
+				problems = append(problems, utils.FileProblem{File: cclf0.filePath, Problem: fmt.Sprintf("no CCLF8 file found for ACO %s performance year %d", acoID, perfYear)})
+			}
+
+			for _, cclf := range cclfFiles {
+				var parseFunc func([]byte) ([]interface{}, error)
+				if cclf.cclfNum == 8 {
+					parseFunc = parseCCLF8
+				} else if cclf.cclfNum == 9 {
+					parseFunc = parseCCLF9
+				} else {
+					continue
+				}
+				checked++
+				if err := validate(w, cclf, cclfvalidator); err != nil {
+					problems = append(problems, utils.FileProblem{File: filepath.Join(cclf.filePath, cclf.name), Problem: err.Error()})
+					continue
+				}
+				recordProblems, err := parseCCLFRecords(cclf, parseFunc)
+				if err != nil {
+					problems = append(problems, utils.FileProblem{File: filepath.Join(cclf.filePath, cclf.name), Problem: err.Error()})
+				}
+				problems = append(problems, recordProblems...)
+			}
+		}
+	}
+
+	return checked, problems, nil
+}
+
+// parseCCLFRecords parses each record of a CCLF file, returning a problem for each that can't be.
+func parseCCLFRecords(fileMetadata *cclfFileMetadata, parseFunc func([]byte) ([]interface{}, error)) ([]utils.FileProblem, error) {
+	r, err := zip.OpenReader(filepath.Clean(fileMetadata.filePath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read archive %s", fileMetadata.filePath)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != fileMetadata.name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read file %s in archive %s", fileMetadata.name, fileMetadata.filePath)
+		}
+		defer rc.Close()
+
+		var problems []utils.FileProblem
+		record := 0
+		sc := bufio.NewScanner(rc)
+		for sc.Scan() {
+			b := sc.Bytes()
+			if len(bytes.TrimSpace(b)) > 0 {
+				record++
+				if _, err := parseFunc(b); err != nil {
+					problems = append(problems, utils.FileProblem{File: filepath.Join(fileMetadata.filePath, fileMetadata.name), Problem: fmt.Sprintf("record %d: %s", record, err)})
+				}
+			}
+		}
+		return problems, sc.Err()
+	}
+	return nil, fmt.Errorf("file %s not found in archive %s", fileMetadata.name, fileMetadata.filePath)
+}
+
+// importValidated validates a CCLF file against the counts and lengths from its package's CCLF0 file, and imports it
+// if it is valid.  It reports whether the file was imported.
+func importValidated(fileMetadata *cclfFileMetadata, cclfvalidator map[string]cclfFileValidator, importFunc func(*cclfFileMetadata) error) bool {
+	if fileMetadata == nil {
+		fmt.Println("File not found.")
+		log.Error("File not found")
+		return false
+	}
+	if err := validate(os.Stdout, fileMetadata, cclfvalidator); err != nil {
+		fmt.Printf("Failed to validate CCLF%d file: %s.\n", fileMetadata.cclfNum, fileMetadata)
+		log.Errorf("Failed to validate CCLF%d file: %s", fileMetadata.cclfNum, fileMetadata)
+		return false
+	}
+	if err := importFunc(fileMetadata); err != nil {
+		fmt.Printf("Failed to import CCLF%d file: %s.\n", fileMetadata.cclfNum, fileMetadata)
+		log.Errorf("Failed to import CCLF%d file: %s ", fileMetadata.cclfNum, fileMetadata)
+		return false
+	}
+	fileMetadata.imported = true
+	return true
+}
+
 func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *int) filepath.WalkFunc {
+	return walkCCLFArchives(os.Stdout, cclfMap, skipped, nil)
+}
+
+// walkCCLFArchives sorts the CCLF files in archives by ACO and performance year.  If problems is set, archives and
+// files that can't be imported are added to it, and old ones are left in place rather than moved to the pending
+// deletion directory.
+func walkCCLFArchives(w io.Writer, cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *int, problems *[]utils.FileProblem) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			var fileName = "nil"
 			if info != nil {
 				fileName = info.Name()
 			}
-			fmt.Printf("Error in sorting CCLF file %s: %s.\n", fileName, err)
+			fmt.Fprintf(w, "Error in sorting CCLF file %s: %s.\n", fileName, err)
 			err = errors.Wrapf(err, "error in sorting cclf file: %v,", fileName)
 			log.Error(err)
 			return err
@@ -431,7 +647,7 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 
 		if info.IsDir() {
 			msg := fmt.Sprintf("Unable to sort %s: directory, not a CCLF archive.", path)
-			fmt.Println(msg)
+			fmt.Fprintln(w, msg)
 			log.Warn(msg)
 			return nil
 		}
@@ -440,21 +656,28 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 		if err != nil {
 			*skipped = *skipped + 1
 			msg := fmt.Sprintf("Skipping %s: file is not a CCLF archive.", path)
-			fmt.Println(msg)
+			fmt.Fprintln(w, msg)
 			log.Warn(msg)
+			if problems != nil {
+				*problems = append(*problems, utils.FileProblem{File: path, Problem: "file is not a CCLF archive"})
+			}
 			return nil
 		}
 		_ = zipReader.Close()
 
 		// validate the top level zipped folder
-		err = validateCCLFFolderName(info.Name()); if err != nil {
+		err = validateCCLFFolderName(w, info.Name()); if err != nil {
 			*skipped = *skipped + 1
 			msg := fmt.Sprintf("Skipping CCLF archive: %s.", info.Name())
-			fmt.Println(msg)
+			fmt.Fprintln(w, msg)
 			log.Warn(msg)
+			if problems != nil {
+				*problems = append(*problems, utils.FileProblem{File: path, Problem: err.Error()})
+				return nil
+			}
 			err = checkDeliveryDate(path, info.ModTime())
 			if err != nil {
-				fmt.Printf("Error moving unknown file %s to pending deletion dir.\n", path)
+				fmt.Fprintf(w, "Error moving unknown file %s to pending deletion dir.\n", path)
 				err = fmt.Errorf("error moving unknown file %s to pending deletion dir", path)
 				log.Error(err)
 				return err
@@ -463,14 +686,17 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 		}
 
 		for _, f := range zipReader.File {
-			metadata, err := getCCLFFileMetadata(f.Name)
+			metadata, err := getCCLFFileMetadata(w, f.Name)
 			metadata.filePath = path
 			metadata.deliveryDate = info.ModTime()
 
 			if err != nil {
 				// skipping files with a bad name.  An unknown file in this dir isn't a blocker
-				fmt.Printf("Unknown file found: %s.\n", f.Name)
+				fmt.Fprintf(w, "Unknown file found: %s.\n", f.Name)
 				log.Errorf("Unknown file found: %s", f.Name)
+				if problems != nil {
+					*problems = append(*problems, utils.FileProblem{File: filepath.Join(path, f.Name), Problem: err.Error()})
+				}
 				continue
 			}
 
@@ -523,30 +749,38 @@ func orderACOs(cclfMap *map[string]map[int][]*cclfFileMetadata) []string {
 	return acoOrder
 }
 
-func validate(fileMetadata *cclfFileMetadata, cclfFileValidator map[string]cclfFileValidator) error {
+func validate(w io.Writer, fileMetadata *cclfFileMetadata, cclfFileValidator map[string]cclfFileValidator) error {
 	if fileMetadata == nil {
-		fmt.Printf("File not found.\n")
+		fmt.Fprintf(w, "File not found.\n")
 		err := errors.New("file not found")
 		log.Error(err)
 		return err
 	}
 
-	fmt.Printf("Validating CCLF%d file %s...\n", fileMetadata.cclfNum, fileMetadata)
+	fmt.Fprintf(w, "Validating CCLF%d file %s...\n", fileMetadata.cclfNum, fileMetadata)
 	log.Infof("Validating CCLF%d file %s...", fileMetadata.cclfNum, fileMetadata)
 
 	var key string
-	if fileMetadata.cclfNum == 8 {
-		key = "CCLF8"
+	if fileMetadata.cclfNum == 8 || fileMetadata.cclfNum == 9 {
+		key = fmt.Sprintf("CCLF%d", fileMetadata.cclfNum)
 	} else {
-		fmt.Printf("Unknown file type when validating file: %s.\n", fileMetadata)
+		fmt.Fprintf(w, "Unknown file type when validating file: %s.\n", fileMetadata)
 		err := fmt.Errorf("unknown file type when validating file: %s", fileMetadata)
 		log.Error(err)
 		return err
 	}
 
+	validator, ok := cclfFileValidator[key]
+	if !ok {
+		fmt.Fprintf(w, "No %s record count or length found in CCLF0 file for file: %s.\n", key, fileMetadata)
+		err := fmt.Errorf("no %s record count or length found in CCLF0 file for file: %s", key, fileMetadata)
+		log.Error(err)
+		return err
+	}
+
 	r, err := zip.OpenReader(filepath.Clean(fileMetadata.filePath))
 	if err != nil {
-		fmt.Printf("Could not read archive %s.\n", fileMetadata.filePath)
+		fmt.Fprintf(w, "Could not read archive %s.\n", fileMetadata.filePath)
 		err := errors.Wrapf(err, "could not read archive %s", fileMetadata.filePath)
 		log.Error(err)
 		return err
@@ -554,19 +788,18 @@ func validate(fileMetadata *cclfFileMetadata, cclfFileValidator map[string]cclfF
 	defer r.Close()
 
 	count := 0
-	validator := cclfFileValidator[key]
 	var rawFile *zip.File
 
 	for _, f := range r.File {
 		if f.Name == fileMetadata.name {
 			rawFile = f
-			fmt.Printf("Reading file %s from archive %s.\n", fileMetadata.name, fileMetadata.filePath)
+			fmt.Fprintf(w, "Reading file %s from archive %s.\n", fileMetadata.name, fileMetadata.filePath)
 			log.Infof("Reading file %s from archive %s", fileMetadata.name, fileMetadata.filePath)
 		}
 	}
 
 	if rawFile == nil {
-		fmt.Printf("File %s not found in archive %s.\n", fileMetadata.name, fileMetadata.filePath)
+		fmt.Fprintf(w, "File %s not found in archive %s.\n", fileMetadata.name, fileMetadata.filePath)
 		err = errors.Wrapf(err, "file %s not found in archive %s", fileMetadata.name, fileMetadata.filePath)
 		log.Error(err)
 		return err
@@ -574,7 +807,7 @@ func validate(fileMetadata *cclfFileMetadata, cclfFileValidator map[string]cclfF
 
 	rc, err := rawFile.Open()
 	if err != nil {
-		fmt.Printf("Could not read file %s in archive %s.\n", fileMetadata.name, fileMetadata.filePath)
+		fmt.Fprintf(w, "Could not read file %s in archive %s.\n", fileMetadata.name, fileMetadata.filePath)
 		err = errors.Wrapf(err, "could not read file %s in archive %s", fileMetadata.name, fileMetadata.filePath)
 		log.Error(err)
 		return err
@@ -589,29 +822,29 @@ func validate(fileMetadata *cclfFileMetadata, cclfFileValidator map[string]cclfF
 
 			// currently only errors if there are more records than we expect.
 			if count > validator.totalRecordCount {
-				fmt.Printf("Maximum record count reached for file %s, Expected record count: %d, Actual record count: %d.\n", key, validator.totalRecordCount, count)
+				fmt.Fprintf(w, "Maximum record count reached for file %s, Expected record count: %d, Actual record count: %d.\n", key, validator.totalRecordCount, count)
 				err := fmt.Errorf("maximum record count reached for file %s (expected: %d, actual: %d)", key, validator.totalRecordCount, count)
 				log.Error(err)
 				return err
 			}
 		} else {
-			fmt.Printf("Incorrect record length for file %s, Expected record length: %d, Actual record length: %d.\n", key, validator.maxRecordLength, bytelength)
+			fmt.Fprintf(w, "Incorrect record length for file %s, Expected record length: %d, Actual record length: %d.\n", key, validator.maxRecordLength, bytelength)
 			err := fmt.Errorf("incorrect record length for file %s (expected: %d, actual: %d)", key, validator.maxRecordLength, bytelength)
 			log.Error(err)
 			return err
 		}
 	}
-	fmt.Printf("Successfully validated CCLF%d file %s.\n", fileMetadata.cclfNum, fileMetadata)
+	fmt.Fprintf(w, "Successfully validated CCLF%d file %s.\n", fileMetadata.cclfNum, fileMetadata)
 	log.Infof("Successfully validated CCLF%d file %s.", fileMetadata.cclfNum, fileMetadata)
 	return nil
 }
 
-func validateCCLFFolderName(folderName string) error {
+func validateCCLFFolderName(w io.Writer, folderName string) error {
 	// CCLF foldername convention for SSP with BCD identifier: P.BCD.A****.ZCY**.Dyymmdd.Thhmmsst
 	folderNameRegexp := regexp.MustCompile(`(T|P)\.BCD\.((?:A|T)\d{4})\.ZCY(\d{2})\.(D\d{6})\.T(\d{4})\d{3}`)
 	valid := folderNameRegexp.MatchString(folderName)
 	if !valid {
-		fmt.Printf("Invalid foldername for CCLF archive: %s.\n", folderName)
+		fmt.Fprintf(w, "Invalid foldername for CCLF archive: %s.\n", folderName)
 		err := fmt.Errorf("invalid foldername for CCLF archive: %s", folderName)
 		log.Error(err)
 		return err
@@ -679,20 +912,3 @@ func (m cclfFileMetadata) String() string {
 	}
 	return m.filePath
 }
-
-func updateImportStatus(m *cclfFileMetadata, status string) {
-	if m == nil {
-		return
-	}
-	var cclfFile models.CCLFFile
-
-	db := database.GetGORMDbConnection()
-	defer database.Close(db)
-
-	err := db.Model(&cclfFile).Where("id = ?", m.fileID).Update("import_status", status).Error
-	if err != nil {
-		fmt.Printf("Could not update cclf file record for file: %s. \n", m)
-		err = errors.Wrapf(err, "could not update cclf file record for file: %s.", m)
-		log.Error(err)
-	}
-}
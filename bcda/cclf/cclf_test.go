@@ -1,17 +1,22 @@
 package cclf
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/CMSgov/bcda-app/bcda/constants"
 
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
+	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -69,7 +74,7 @@ func (s *CCLFTestSuite) TestImportCCLFDirectory_PriorityACOs() {
 
 	sc, f, sk, err := ImportCCLFDirectory(BASE_FILE_PATH + "cclf/archives/valid/")
 	assert.Nil(err)
-	assert.Equal(6, sc)
+	assert.Equal(7, sc)
 	assert.Equal(0, f)
 	assert.Equal(1, sk)
 
@@ -91,25 +96,29 @@ func (s *CCLFTestSuite) TestImportCCLF0() {
 	cclf0metadata := &cclfFileMetadata{env: "test", acoID: "A0001", cclfNum: 0, timestamp: time.Now(), filePath: cclf0filePath, perfYear: 18, name: "T.BCD.A0001.ZC0Y18.D181120.T1000011"}
 
 	// positive
-	validator, err := importCCLF0(cclf0metadata)
+	validator, err := importCCLF0(os.Stdout, cclf0metadata)
 	assert.Nil(err)
 	assert.Equal(cclfFileValidator{totalRecordCount: 6, maxRecordLength: 549}, validator["CCLF8"])
+	// every file type in the package is recorded
+	assert.Len(validator, 11)
+	assert.Equal(cclfFileValidator{totalRecordCount: 6, maxRecordLength: 54}, validator["CCLF9"])
+	assert.Equal(cclfFileValidator{totalRecordCount: 6, maxRecordLength: 93}, validator["CCLFB"])
 
 	// negative
 	cclf0metadata = &cclfFileMetadata{}
-	_, err = importCCLF0(cclf0metadata)
+	_, err = importCCLF0(os.Stdout, cclf0metadata)
 	assert.EqualError(err, "could not read CCLF0 archive : read .: is a directory")
 
 	// missing cclf8 from cclf0
 	cclf0filePath = BASE_FILE_PATH + "cclf/archives/0/missing_data/T.BCD.A0001.ZCY18.D181120.T1000000"
 	cclf0metadata = &cclfFileMetadata{env: "test", acoID: "A0001", cclfNum: 0, timestamp: time.Now(), filePath: cclf0filePath, perfYear: 18, name:"T.BCD.A0001.ZC0Y18.D181120.T1000011"}
-	_, err = importCCLF0(cclf0metadata)
+	_, err = importCCLF0(os.Stdout, cclf0metadata)
 	assert.EqualError(err, "failed to parse CCLF8 from CCLF0 file T.BCD.A0001.ZC0Y18.D181120.T1000011")
 
 	// duplicate file types from cclf0
 	cclf0filePath = BASE_FILE_PATH + "cclf/archives/0/missing_data/T.BCD.A0001.ZCY18.D181122.T1000000"
 	cclf0metadata = &cclfFileMetadata{env: "test", acoID: "A0001", cclfNum: 0, timestamp: time.Now(), filePath: cclf0filePath, perfYear: 18, name: "T.BCD.A0001.ZC0Y18.D181120.T1000013"}
-	_, err = importCCLF0(cclf0metadata)
+	_, err = importCCLF0(os.Stdout, cclf0metadata)
 	assert.EqualError(err, "duplicate CCLF8 file type found from CCLF0 file")
 }
 
@@ -119,7 +128,7 @@ func (s *CCLFTestSuite) TestImportCCLF0_SplitFiles() {
 	cclf0filePath := BASE_FILE_PATH + "cclf/archives/split/T.BCD.A0001.ZCY18.D181120.T1000000"
 	cclf0metadata := &cclfFileMetadata{env: "test", acoID: "A0001", cclfNum: 0, timestamp: time.Now(), filePath: cclf0filePath, perfYear: 18, name:"T.BCD.A0001.ZC0Y18.D181120.T1000011-1"}
 
-	validator, err := importCCLF0(cclf0metadata)
+	validator, err := importCCLF0(os.Stdout, cclf0metadata)
 	assert.Nil(err)
 	assert.Equal(cclfFileValidator{totalRecordCount: 6, maxRecordLength: 549}, validator["CCLF8"])
 }
@@ -132,41 +141,52 @@ func (s *CCLFTestSuite) TestValidate() {
 
 	// positive
 	cclfvalidator := map[string]cclfFileValidator{"CCLF8": {totalRecordCount: 6, maxRecordLength: 549}}
-	err := validate(cclf8metadata, cclfvalidator)
+	err := validate(os.Stdout, cclf8metadata, cclfvalidator)
 	assert.Nil(err)
 
 	// negative
 	cclfvalidator = map[string]cclfFileValidator{"CCLF8": {totalRecordCount: 2, maxRecordLength: 549}}
-	err = validate(cclf8metadata, cclfvalidator)
+	err = validate(os.Stdout, cclf8metadata, cclfvalidator)
 	assert.EqualError(err, "maximum record count reached for file CCLF8 (expected: 2, actual: 3)")
+
+	cclf9filePath := BASE_FILE_PATH + "cclf/archives/valid/T.BCD.A0001.ZCY18.D181122.T1000000"
+	cclf9metadata := &cclfFileMetadata{env: "test", acoID: "A0001", cclfNum: 9, timestamp: time.Now(), filePath: cclf9filePath, perfYear: 18, name: "T.BCD.A0001.ZC9Y18.D181120.T1000010"}
+	cclfvalidator = map[string]cclfFileValidator{"CCLF8": {totalRecordCount: 6, maxRecordLength: 549}, "CCLF9": {totalRecordCount: 6, maxRecordLength: 54}}
+	err = validate(os.Stdout, cclf9metadata, cclfvalidator)
+	assert.Nil(err)
+
+	// the CCLF0 file has no counts for CCLF9
+	cclfvalidator = map[string]cclfFileValidator{"CCLF8": {totalRecordCount: 6, maxRecordLength: 549}}
+	err = validate(os.Stdout, cclf9metadata, cclfvalidator)
+	assert.EqualError(err, "no CCLF9 record count or length found in CCLF0 file for file: T.BCD.A0001.ZC9Y18.D181120.T1000010")
 }
 
 func (s *CCLFTestSuite) TestValidate_FolderName() {
 	assert := assert.New(s.T())
 
 	filePath := BASE_FILE_PATH + "path/T.BCD.A0001.ZCY18.D181120.T1000000"
-	err := validateCCLFFolderName(filePath)
+	err := validateCCLFFolderName(os.Stdout, filePath)
 	assert.Nil(err)
 
 	filePath = BASE_FILE_PATH + "path/T.A0001.ACO.ZC8Y18.D18NOV20.T1000009"
-	err = validateCCLFFolderName(filePath)
+	err = validateCCLFFolderName(os.Stdout, filePath)
 	assert.EqualError(err, fmt.Sprintf("invalid foldername for CCLF archive: %s", filePath))
 
 	filePath = BASE_FILE_PATH + "path/T.BCD.ACO.ZC0Y18.D181120.T0001000"
-	err = validateCCLFFolderName(filePath)
+	err = validateCCLFFolderName(os.Stdout, filePath)
 	assert.EqualError(err, fmt.Sprintf("invalid foldername for CCLF archive: %s", filePath))
 }
 
 func (s *CCLFTestSuite) TestParseTimestamp() {
 	assert := assert.New(s.T())
 
-	cclfMetadata, err := getCCLFFileMetadata("T.BCD.A0001.ZC8Y18.D181120.T1000009")
+	cclfMetadata, err := getCCLFFileMetadata(os.Stdout, "T.BCD.A0001.ZC8Y18.D181120.T1000009")
 	assert.Nil(err)
 	assert.Equal(10, cclfMetadata.timestamp.Hour())
 	assert.Equal(00, cclfMetadata.timestamp.Minute())
 
 	// valid file name out of range
-	cclfMetadata, err = getCCLFFileMetadata("T.BCD.A0001.ZC8Y18.D190117.T9909420")
+	cclfMetadata, err = getCCLFFileMetadata(os.Stdout, "T.BCD.A0001.ZC8Y18.D190117.T9909420")
 	assert.EqualError(err, "failed to parse date 'D190117.T990942' from file: T.BCD.A0001.ZC8Y18.D190117.T9909420: parsing time \"D190117.T990942\": hour out of range")
 }
 
@@ -224,6 +244,140 @@ func (s *CCLFTestSuite) TestImportCCLF8() {
 	assert.Nil(err)
 }
 
+func (s *CCLFTestSuite) TestImportCCLF9() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	err := deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+
+	acoID := "A0001"
+	fileTime, _ := time.Parse(time.RFC3339, "2018-11-20T10:00:00Z")
+	metadata := &cclfFileMetadata{
+		name:      "T.BCD.A0001.ZC9Y18.D181120.T1000010",
+		env:       "test",
+		acoID:     acoID,
+		cclfNum:   9,
+		perfYear:  18,
+		timestamp: fileTime,
+		filePath:  BASE_FILE_PATH + "cclf/archives/valid/T.BCD.A0001.ZCY18.D181122.T1000000",
+	}
+
+	err = importCCLF9(metadata)
+	if err != nil {
+		s.FailNow("importCCLF9() error: %s", err.Error())
+	}
+
+	file := models.CCLFFile{}
+	db.First(&file, "name = ?", metadata.name)
+	assert.Equal(9, file.CCLFNum)
+	assert.Equal(acoID, file.ACOCMSID)
+	assert.Equal(constants.ImportComplete, file.ImportStatus)
+
+	xrefs := []models.CCLFBeneficiaryXref{}
+	db.Order("id").Find(&xrefs, "file_id = ?", file.ID)
+	assert.Equal(6, len(xrefs))
+	assert.Equal("H", xrefs[0].XrefIndicator)
+	assert.Equal("203031401M", xrefs[0].CurrentNum)
+	assert.Equal("203031401A", xrefs[0].PrevNum)
+	assert.Equal("1959-12-31", xrefs[0].PrevsEfctDt)
+	assert.Equal("2016-12-31", xrefs[0].PrevsObsltDt)
+	assert.Equal("20303140244", xrefs[1].CurrentNum)
+	assert.Equal("203031402B", xrefs[1].PrevNum)
+
+	err = deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+	var count int
+	db.Model(&models.CCLFBeneficiaryXref{}).Where("file_id = ?", file.ID).Count(&count)
+	assert.Zero(count)
+}
+
+func (s *CCLFTestSuite) TestImportCCLF8_WithSuppressions() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	err := deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+
+	acoID := "A0001"
+	aco := models.ACO{UUID: uuid.NewRandom(), CMSID: &acoID, Name: "CCLF Suppression Test ACO"}
+	assert.Nil(db.Create(&aco).Error)
+	defer db.Unscoped().Delete(&aco)
+
+	suppression := models.Suppression{BlueButtonID: "cclfTestSuppressedBBID", PrefIndicator: "N", EffectiveDt: time.Now().Add(-24 * time.Hour)}
+	assert.Nil(db.Create(&suppression).Error)
+	defer db.Unscoped().Delete(&suppression)
+
+	metadata := &cclfFileMetadata{
+		name:      "T.BCD.A0001.ZC8Y18.D181120.T1000009",
+		env:       "test",
+		acoID:     acoID,
+		cclfNum:   8,
+		perfYear:  18,
+		timestamp: time.Now(),
+		filePath:  BASE_FILE_PATH + "cclf/archives/valid/T.BCD.A0001.ZCY18.D181121.T1000000",
+	}
+	err = importCCLF8(metadata)
+	if err != nil {
+		s.FailNow("importCCLF8() error: %s", err.Error())
+	}
+
+	// the copied beneficiaries have no Blue Button IDs yet, and none of them are suppressed
+	beneficiaries, err := aco.GetBeneficiaries(false)
+	assert.Nil(err)
+	assert.Len(beneficiaries, 6)
+	for _, beneficiary := range beneficiaries {
+		assert.Empty(beneficiary.BlueButtonID)
+	}
+
+	err = deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+}
+
+func (s *CCLFTestSuite) TestImportCCLF8_RollsBack() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	err := deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+
+	// the second record is too long to be read, after the first has been copied
+	name := "T.BCD.A0001.ZC8Y18.D181120.T1000009"
+	dir, err := ioutil.TempDir("", "cclf")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "T.BCD.A0001.ZCY18.D181121.T1000000")
+	zf, err := os.Create(filePath)
+	assert.Nil(err)
+	zw := zip.NewWriter(zf)
+	w, err := zw.Create(name)
+	assert.Nil(err)
+	_, err = fmt.Fprintf(w, "1A69B98CD30203031401M \n%s\n", strings.Repeat("X", 70000))
+	assert.Nil(err)
+	assert.Nil(zw.Close())
+	assert.Nil(zf.Close())
+
+	metadata := &cclfFileMetadata{name: name, env: "test", acoID: "A0001", cclfNum: 8, perfYear: 18, timestamp: time.Now(), filePath: filePath}
+	err = importCCLF8(metadata)
+	assert.EqualError(err, "could not read CCLF8 file T.BCD.A0001.ZC8Y18.D181120.T1000009: bufio.Scanner: token too long")
+
+	// the failure is recorded, but none of the file's records are left behind
+	var files []models.CCLFFile
+	db.Find(&files, "name = ?", name)
+	assert.Len(files, 1)
+	assert.Equal(constants.ImportFail, files[0].ImportStatus)
+	assert.Equal(files[0].ID, metadata.fileID)
+	var count int
+	db.Model(&models.CCLFBeneficiary{}).Where("file_id = ?", files[0].ID).Count(&count)
+	assert.Zero(count)
+
+	err = deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+}
+
 func (s *CCLFTestSuite) TestImportCCLF8_InvalidMetadata() {
 	assert := assert.New(s.T())
 
@@ -237,7 +391,7 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata() {
 
 	expDate, _ := time.Parse("2006-01-02", "2019-01-19")
 	os.Setenv("CCLF_REF_DATE", "190120")
-	metadata, err := getCCLFFileMetadata("T.BCD.A0002.ZC0Y18.D190119.T1000009")
+	metadata, err := getCCLFFileMetadata(os.Stdout, "T.BCD.A0002.ZC0Y18.D190119.T1000009")
 	assert.Equal("test", metadata.env)
 	assert.Equal("A0002", metadata.acoID)
 	assert.Equal(0, metadata.cclfNum)
@@ -248,7 +402,7 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata() {
 	assert.Nil(err)
 
 	expDate, _ = time.Parse("2006-01-02", "2019-01-17")
-	metadata, err = getCCLFFileMetadata("T.BCD.A0000.ZC8Y18.D190117.T0000000")
+	metadata, err = getCCLFFileMetadata(os.Stdout, "T.BCD.A0000.ZC8Y18.D190117.T0000000")
 	assert.Equal("test", metadata.env)
 	assert.Equal("A0000", metadata.acoID)
 	assert.Equal(8, metadata.cclfNum)
@@ -259,13 +413,13 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata() {
 	assert.Nil(err)
 
 	expDate, _ = time.Parse("2006-01-02", "2019-01-08")
-	metadata, err = getCCLFFileMetadata("/path/P.A0001.ACO.ZC9Y18.D190108.T2355000")
+	metadata, err = getCCLFFileMetadata(os.Stdout, "/path/P.A0001.ACO.ZC9Y18.D190108.T2355000")
 	assert.EqualError(err, "invalid filename for file: /path/P.A0001.ACO.ZC9Y18.D190108.T2355000")
 
 	// CMS EFT file format with BCD identifier
 	expDate, _ = time.Parse("2006-01-02", "2018-11-20")
 	os.Setenv("CCLF_REF_DATE", "181124")
-	metadata, err = getCCLFFileMetadata("T.BCD.A0001.ZC0Y18.D181120.T0001000")
+	metadata, err = getCCLFFileMetadata(os.Stdout, "T.BCD.A0001.ZC0Y18.D181120.T0001000")
 	assert.Equal("test", metadata.env)
 	assert.Equal("A0001", metadata.acoID)
 	assert.Equal(0, metadata.cclfNum)
@@ -277,12 +431,12 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata() {
 
 	//CMS EFT file format with ACOB identifier
 	expDate, _ = time.Parse("2006-01-02", "2018-11-20")
-	metadata, err = getCCLFFileMetadata("/BCD/T.BCD.ACOB.ZC0Y18.D181120.T0001000")
+	metadata, err = getCCLFFileMetadata(os.Stdout, "/BCD/T.BCD.ACOB.ZC0Y18.D181120.T0001000")
 	assert.EqualError(err, "invalid filename for file: /BCD/T.BCD.ACOB.ZC0Y18.D181120.T0001000")
 
 	expDate, _ = time.Parse("2006-01-02", "2019-01-12")
 	os.Setenv("CCLF_REF_DATE", "190120")
-	metadata, err = getCCLFFileMetadata("T.BCD.A0012.ZC8Y18.D190112.T1000009")
+	metadata, err = getCCLFFileMetadata(os.Stdout, "T.BCD.A0012.ZC8Y18.D190112.T1000009")
 	assert.Equal("test", metadata.env)
 	assert.Equal("A0012", metadata.acoID)
 	assert.Equal(8, metadata.cclfNum)
@@ -293,7 +447,7 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata() {
 	assert.Nil(err)
 
 	os.Setenv("CCLF_REF_DATE", "180612")
-	metadata, err = getCCLFFileMetadata("/BCD/P.BCD.ACO.ZC9Y19.D180610.T0002000")
+	metadata, err = getCCLFFileMetadata(os.Stdout, "/BCD/P.BCD.ACO.ZC9Y19.D180610.T0002000")
 	assert.EqualError(err, "invalid filename for file: /BCD/P.BCD.ACO.ZC9Y19.D180610.T0002000")
 
 	os.Unsetenv("CCLF_REF_DATE")
@@ -304,12 +458,12 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata_DateOutOfRange() {
 
 	// File is postdated
 	os.Setenv("CCLF_REF_DATE", "181119")
-	_, err := getCCLFFileMetadata("T.BCD.A0001.ZC0Y18.D181120.T0001000")
+	_, err := getCCLFFileMetadata(os.Stdout, "T.BCD.A0001.ZC0Y18.D181120.T0001000")
 	assert.EqualError(err, "date 'D181120.T000100' from file T.BCD.A0001.ZC0Y18.D181120.T0001000 out of range; comparison date 181119")
 
 	// File is older than 45 days
 	os.Setenv("CCLF_REF_DATE", "190120")
-	_, err = getCCLFFileMetadata("T.BCD.A0001.ZC0Y18.D181120.T0001000")
+	_, err = getCCLFFileMetadata(os.Stdout, "T.BCD.A0001.ZC0Y18.D181120.T0001000")
 	assert.EqualError(err, "date 'D181120.T000100' from file T.BCD.A0001.ZC0Y18.D181120.T0001000 out of range; comparison date 190120")
 }
 
@@ -317,16 +471,16 @@ func (s *CCLFTestSuite) TestGetCCLFFileMetadata_InvalidFilename() {
 	assert := assert.New(s.T())
 	os.Setenv("CCLF_REF_DATE", "190615")
 
-	_, err := getCCLFFileMetadata("/path/to/file")
+	_, err := getCCLFFileMetadata(os.Stdout, "/path/to/file")
 	assert.EqualError(err, "invalid filename for file: /path/to/file")
 
-	_, err = getCCLFFileMetadata("T.BCD.A0001.ZC8Y18.D191317.T0000000")
+	_, err = getCCLFFileMetadata(os.Stdout, "T.BCD.A0001.ZC8Y18.D191317.T0000000")
 	assert.EqualError(err, "failed to parse date 'D191317.T000000' from file: T.BCD.A0001.ZC8Y18.D191317.T0000000: parsing time \"D191317.T000000\": month out of range")
 
-	_, err = getCCLFFileMetadata("/cclf/T.A0001.ACO.ZC8Y18.D18NOV20.T1000010")
+	_, err = getCCLFFileMetadata(os.Stdout, "/cclf/T.A0001.ACO.ZC8Y18.D18NOV20.T1000010")
 	assert.EqualError(err, "invalid filename for file: /cclf/T.A0001.ACO.ZC8Y18.D18NOV20.T1000010")
 
-	_, err = getCCLFFileMetadata("/cclf/T.ABCDE.ACO.ZC8Y18.D181120.T1000010")
+	_, err = getCCLFFileMetadata(os.Stdout, "/cclf/T.ABCDE.ACO.ZC8Y18.D181120.T1000010")
 	assert.EqualError(err, "invalid filename for file: /cclf/T.ABCDE.ACO.ZC8Y18.D181120.T1000010")
 }
 
@@ -338,7 +492,7 @@ func (s *CCLFTestSuite) TestSortCCLFArchives() {
 	filePath := BASE_FILE_PATH + "cclf/archives/valid/"
 	err := filepath.Walk(filePath, sortCCLFArchives(&cclfmap, &skipped))
 	assert.Nil(err)
-	assert.Equal(2, len(cclfmap["A0001"][18]))
+	assert.Equal(3, len(cclfmap["A0001"][18]))
 	assert.Equal(1, skipped)
 	testUtils.ResetFiles(s.Suite, filePath)
 
@@ -473,6 +627,58 @@ func (s *CCLFTestSuite) TestSortCCLFArchives_InvalidPath() {
 	assert.EqualError(s.T(), err, "error in sorting cclf file: nil,: lstat ./foo: no such file or directory")
 }
 
+func (s *CCLFTestSuite) TestValidateCCLFDirectory() {
+	assert := assert.New(s.T())
+	testUtils.SetPendingDeletionDir(s.Suite)
+	folderPath := BASE_FILE_PATH + "cclf/mixed/with_invalid_filenames/"
+	filePath := folderPath + "T.BCDE.ACO.ZC0Y18.D181120.T0001000"
+
+	// old enough to be moved to the pending deletion dir by an import
+	timeChange := time.Now().Add(-(time.Hour * 73)).Truncate(time.Second)
+	err := os.Chtimes(filePath, timeChange, timeChange)
+	if err != nil {
+		s.FailNow("Failed to change modified time for file", err)
+	}
+
+	var progress bytes.Buffer
+	checked, problems, err := ValidateCCLFDirectory(&progress, folderPath)
+	assert.Nil(err)
+	assert.Equal(2, checked)
+	assert.Contains(progress.String(), "Skipping CCLF archive: T.BCDE.ACO.ZC0Y18.D181120.T0001000.")
+	assert.Len(problems, 4)
+	assert.Contains(problems, utils.FileProblem{File: filePath, Problem: "invalid foldername for CCLF archive: T.BCDE.ACO.ZC0Y18.D181120.T0001000"})
+	assert.Contains(problems, utils.FileProblem{File: folderPath + "T.A0001.ACO.ZC8Y18.D18NOV20.T1000009", Problem: "file is not a CCLF archive"})
+
+	// assert that this file is still here.
+	_, err = os.Open(filePath)
+	assert.Nil(err)
+	testUtils.ResetFiles(s.Suite, folderPath)
+
+	folderPath = BASE_FILE_PATH + "cclf/archives/split/"
+	checked, problems, err = ValidateCCLFDirectory(&progress, folderPath)
+	assert.Nil(err)
+	assert.Equal(3, checked)
+	assert.Len(problems, 3)
+	assert.Contains(problems, utils.FileProblem{
+		File:    filepath.Join(folderPath, "T.BCD.A0001.ZCY18.D181121.T1000000", "T.BCD.A0001.ZC8Y18.D181120.T1000009"),
+		Problem: "no CCLF8 record count or length found in CCLF0 file for file: T.BCD.A0001.ZC8Y18.D181120.T1000009",
+	})
+
+	_, _, err = ValidateCCLFDirectory(&progress, "./foo")
+	assert.EqualError(err, "error in sorting cclf file: nil,: lstat ./foo: no such file or directory")
+}
+
+func (s *CCLFTestSuite) TestParseCCLF8() {
+	assert := assert.New(s.T())
+
+	fields, err := parseCCLF8([]byte("1A69B98CD30203031401M    "))
+	assert.Nil(err)
+	assert.Equal([]interface{}{"1A69B98CD30", "203031401M", ""}, fields)
+
+	_, err = parseCCLF8([]byte("1A69B98CD30"))
+	assert.EqualError(err, "record too short (expected at least: 22, actual: 11)")
+}
+
 func (s *CCLFTestSuite) TestOrderACOs() {
 	origACOs := os.Getenv("CCLF_PRIORITY_ACO_CMS_IDS")
 	os.Setenv("CCLF_PRIORITY_ACO_CMS_IDS", "A3456, A8765, A4321")
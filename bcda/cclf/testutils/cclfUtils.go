@@ -92,11 +92,11 @@ func ImportCCLFPackage(acoSize, environment string) (err error) {
 		return err
 	}
 	fmt.Printf("Completed CCLF import.  Successfully imported %d files.  Failed to import %d files.  Skipped %d files.  See logs for more details.\n", success, failure, skipped)
-	if success == 2 {
+	if success == len(fileList) {
 		_, err = utils.DeleteDirectoryContents(DestDir)
 		return err
 	} else {
-		err = errors.New("did not import 2 files")
+		err = fmt.Errorf("did not import %d files", len(fileList))
 		return err
 	}
 }
@@ -1,12 +1,18 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
@@ -30,18 +36,25 @@ var logger *logrus.Logger
 
 const blueButtonBasePath = "/v1/fhir"
 
+// APIClient gets data from Blue Button as JSON to be decoded from a reader.  Searches for a beneficiary's resources
+// read as every page of the search bundle, one bundle after another.
 type APIClient interface {
-	GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (string, error)
-	GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (string, error)
-	GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (string, error)
-	GetPatientByIdentifierHash(hashedIdentifier, patientIdMode string) (string, error)
+	GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (io.Reader, error)
+	GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (io.Reader, error)
+	GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (io.Reader, error)
+	GetPatientByIdentifierHash(hashedIdentifier, patientIdMode string) (io.Reader, error)
 }
 
 type BlueButtonClient struct {
 	httpClient http.Client
+	// timeout limits how long a request waits for Blue Button to respond, and each read of a response waits for data;
+	// 0 is no limit.  A response is not timed as a whole, since a bundle is read only as fast as it is written out.
+	timeout time.Duration
 }
 
 func init() {
+	rand.Seed(time.Now().UnixNano())
+
 	logger = logrus.New()
 	logger.Formatter = &logrus.JSONFormatter{}
 	logger.SetReportCaller(true)
@@ -90,21 +103,21 @@ func NewBlueButtonClient() (*BlueButtonClient, error) {
 		logger.Info("Could not get Blue Button timeout from environment variable; using default value of 500.")
 		timeout = 500
 	}
-	client := &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Millisecond}
+	client := &http.Client{Transport: transport}
 
-	return &BlueButtonClient{*client}, nil
+	return &BlueButtonClient{httpClient: *client, timeout: time.Duration(timeout) * time.Millisecond}, nil
 }
 
-type BeneDataFunc func(string, string, string, string, time.Time) (string, error)
+type BeneDataFunc func(string, string, string, string, time.Time, url.Values) (io.Reader, error)
 
-func (bbc *BlueButtonClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (string, error) {
+func (bbc *BlueButtonClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (io.Reader, error) {
 	params := GetDefaultParams()
 	params.Set("_id", patientID)
 	UpdateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getData(blueButtonBasePath+"/Patient/", params, jobID, cmsID)
+	return bbc.getBundle(blueButtonBasePath+"/Patient/", params, jobID, cmsID)
 }
 
-func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier, patientIdMode string) (string, error) {
+func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier, patientIdMode string) (io.Reader, error) {
 	params := GetDefaultParams()
 
 	identifier := "hicn-hash"
@@ -114,30 +127,272 @@ func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier, patien
 
 	// FHIR spec requires a FULLY qualified namespace so this is in fact the argument, not a URL
 	params.Set("identifier", fmt.Sprintf("https://bluebutton.cms.gov/resources/identifier/%s|%v", identifier, hashedIdentifier))
-	return bbc.getData(blueButtonBasePath+"/Patient/", params, "", "")
+	data, err := bbc.getData(blueButtonBasePath+"/Patient/", params, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
 }
 
-func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (string, error) {
+func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (io.Reader, error) {
 	params := GetDefaultParams()
 	params.Set("beneficiary", beneficiaryID)
 	UpdateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getData(blueButtonBasePath+"/Coverage/", params, jobID, cmsID)
+	return bbc.getBundle(blueButtonBasePath+"/Coverage/", params, jobID, cmsID)
 }
 
-func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (string, error) {
+func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (io.Reader, error) {
 	params := GetDefaultParams()
 	params.Set("patient", patientID)
 	params.Set("excludeSAMHSA", "true")
 	UpdateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getData(blueButtonBasePath+"/ExplanationOfBenefit/", params, jobID, cmsID)
+	AddTypeFilterParams(&params, typeFilter)
+	return bbc.getBundle(blueButtonBasePath+"/ExplanationOfBenefit/", params, jobID, cmsID)
 }
 
 func (bbc *BlueButtonClient) GetMetadata() (string, error) {
 	params := GetDefaultParams()
-	return bbc.getData(blueButtonBasePath+"/metadata/", params, "", "")
+	data, err := bbc.getData(blueButtonBasePath+"/metadata/", params, "", "")
+	return string(data), err
+}
+
+// maxBundlePages guards against a bundle whose next links never end.
+const maxBundlePages = 10000
+
+// getBundle requests a search bundle with an explicit page size and returns a reader of its pages one after another.
+// Only the first page is requested before getBundle returns; the bundle's next links are followed as the reader
+// reaches the end of each page.  Each page is streamed from Blue Button's response as it is read, and scanned on the
+// way through for its links and entries, so no more of a bundle is held in memory than the reader holds.  If Blue
+// Button gives the bundle's total, the pages must have that many entries between them, so that a beneficiary's data is
+// never cut off silently; a reader that finds otherwise fails at the end of the bundle.  The returned reader should be
+// closed if it is not read to the end.
+func (bbc *BlueButtonClient) getBundle(path string, params url.Values, jobID, cmsID string) (io.Reader, error) {
+	if params.Get("_count") == "" {
+		params.Set("_count", strconv.Itoa(utils.GetEnvInt("BB_REQUEST_PAGE_SIZE", 50)))
+	}
+
+	br := &bundleReader{bbc: bbc, bundlePath: path, path: path, params: params, jobID: jobID, cmsID: cmsID}
+	if err := br.nextPage(); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// bundleReader reads the pages of a search bundle, requesting each page once the one before it has been read.
+type bundleReader struct {
+	bbc          *BlueButtonClient
+	bundlePath   string
+	path         string
+	params       url.Values
+	jobID, cmsID string
+	body         io.ReadCloser   // the response of the page being read
+	page         io.Reader       // body, copied to the page's scanner as it is read
+	scanner      *io.PipeWriter  // feeds the page being read to scanBundlePage
+	scanned      chan bundlePage // the result of scanning the page being read
+	pages        int
+	entries      int
+	done         bool // the last page has been read, or the reader closed
+}
+
+// bundlePage is what getBundle needs to know of a page of a search bundle to follow its paging.
+type bundlePage struct {
+	total   *int
+	next    string
+	entries int
+	err     error
+}
+
+func (br *bundleReader) Read(p []byte) (int, error) {
+	for {
+		if br.page == nil {
+			if br.done {
+				return 0, io.EOF
+			}
+			if err := br.nextPage(); err != nil {
+				br.done = true
+				return 0, err
+			}
+		}
+
+		n, err := br.page.Read(p)
+		if err == io.EOF {
+			if err = br.endPage(); err != nil {
+				br.done = true
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		if err != nil {
+			br.Close()
+			return n, errors.Wrapf(err, "could not read page %d of Blue Button bundle %s", br.pages, br.bundlePath)
+		}
+		return n, nil
+	}
+}
+
+// Close stops reading the bundle, releasing the page being read.
+func (br *bundleReader) Close() error {
+	br.done = true
+	if br.page == nil {
+		return nil
+	}
+	br.page = nil
+	br.scanner.CloseWithError(errors.New("bundle reader closed"))
+	<-br.scanned
+	return br.body.Close()
+}
+
+// nextPage requests the bundle's next page and starts scanning it.
+func (br *bundleReader) nextPage() error {
+	if br.pages >= maxBundlePages {
+		return fmt.Errorf("Blue Button bundle has more than %d pages", maxBundlePages)
+	}
+	body, err := br.bbc.openData(br.path, br.params, br.jobID, br.cmsID)
+	if err != nil {
+		return err
+	}
+	br.pages++
+
+	pr, pw := io.Pipe()
+	br.body, br.scanner, br.scanned = body, pw, make(chan bundlePage, 1)
+	go func(scanned chan<- bundlePage) {
+		page := scanBundlePage(pr)
+		// the rest of a page that could not be scanned is still read, so reading the bundle is never held up
+		_, _ = io.Copy(ioutil.Discard, pr)
+		scanned <- page
+	}(br.scanned)
+	br.page = io.TeeReader(body, pw)
+	return nil
+}
+
+// endPage finishes a page that has been read to the end, noting where the page after it is.
+func (br *bundleReader) endPage() error {
+	br.page = nil
+	br.scanner.Close()
+	page := <-br.scanned
+	if err := br.body.Close(); err != nil {
+		logger.Error(err)
+	}
+	if page.err != nil {
+		return errors.Wrapf(page.err, "could not read page %d of Blue Button bundle %s", br.pages, br.bundlePath)
+	}
+	br.entries += page.entries
+
+	if page.next == "" {
+		br.done = true
+		if page.total != nil && *page.total != br.entries {
+			return fmt.Errorf("Blue Button bundle %s has %d entries on %d page(s), but its total is %d", br.bundlePath, br.entries, br.pages, *page.total)
+		}
+		return nil
+	}
+
+	// The next page is requested from the configured server, with the client's certificate, wherever the link points;
+	// only its path and query are used.
+	nextURL, err := url.Parse(page.next)
+	if err != nil {
+		return errors.Wrapf(err, "could not follow next link of Blue Button bundle %s", br.bundlePath)
+	}
+	br.path, br.params = nextURL.Path, nextURL.Query()
+	return nil
+}
+
+// scanBundlePage reads a page of a search bundle a token at a time, noting its total and next link and counting its
+// entries.  The entries are skipped, not kept.
+func scanBundlePage(r io.Reader) (page bundlePage) {
+	dec := json.NewDecoder(r)
+	t, err := dec.Token()
+	if err != nil {
+		page.err = err
+		return
+	}
+	if t != json.Delim('{') {
+		page.err = fmt.Errorf("expected a bundle, found %v", t)
+		return
+	}
+	for dec.More() {
+		if t, err = dec.Token(); err != nil {
+			page.err = err
+			return
+		}
+		switch t {
+		case "total":
+			err = dec.Decode(&page.total)
+		case "link":
+			var links []struct {
+				Relation string `json:"relation"`
+				URL      string `json:"url"`
+			}
+			if err = dec.Decode(&links); err == nil {
+				for _, link := range links {
+					if link.Relation == "next" {
+						page.next = link.URL
+					}
+				}
+			}
+		case "entry":
+			if t, err = dec.Token(); err == nil && t == json.Delim('[') {
+				for dec.More() && err == nil {
+					err = skipJSONValue(dec)
+					page.entries++
+				}
+				if err == nil {
+					_, err = dec.Token()
+				}
+			} else if err == nil && t != nil {
+				err = fmt.Errorf("expected bundle entries, found %v", t)
+			}
+		default:
+			err = skipJSONValue(dec)
+		}
+		if err != nil {
+			page.err = err
+			return
+		}
+	}
+	return
+}
+
+// skipJSONValue reads past the next value a token at a time, without holding on to it.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
 }
 
-func (bbc *BlueButtonClient) getData(path string, params url.Values, jobID, cmsID string) (string, error) {
+// getData requests a resource from Blue Button and reads the whole of it.
+func (bbc *BlueButtonClient) getData(path string, params url.Values, jobID, cmsID string) ([]byte, error) {
+	body, err := bbc.openData(path, params, jobID, cmsID)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading response from %s", path)
+	}
+	return data, nil
+}
+
+// openData requests a resource from Blue Button, retrying failed requests, and returns the body of the response to be
+// read and closed by the caller.
+func (bbc *BlueButtonClient) openData(path string, params url.Values, jobID, cmsID string) (io.ReadCloser, error) {
 	m := monitoring.GetMonitor()
 	txn := m.Start(path, nil, nil)
 	defer m.End(txn)
@@ -146,7 +401,7 @@ func (bbc *BlueButtonClient) getData(path string, params url.Values, jobID, cmsI
 
 	req, err := http.NewRequest("GET", bbServer+path, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	req.URL.RawQuery = params.Encode()
@@ -156,24 +411,41 @@ func (bbc *BlueButtonClient) getData(path string, params url.Values, jobID, cmsI
 
 	tryCount := 0
 	maxTries := utils.GetEnvInt("BB_REQUEST_MAX_TRIES", 3)
-	retryInterval := utils.GetEnvInt("BB_REQUEST_RETRY_INTERVAL_MS", 1000)
+	retryInterval := time.Duration(utils.GetEnvInt("BB_REQUEST_RETRY_INTERVAL_MS", 1000)) * time.Millisecond
+	maxRetryInterval := time.Duration(utils.GetEnvInt("BB_REQUEST_MAX_RETRY_INTERVAL_MS", 10000)) * time.Millisecond
+	rate, burst := workerRateLimit()
+	breakerThreshold := utils.GetEnvInt("BB_BREAKER_FAILURES", 10)
+	breakerOpenFor := time.Duration(utils.GetEnvInt("BB_BREAKER_OPEN_SEC", 30)) * time.Second
 
 	for tryCount < maxTries {
+		if tryCount > 0 {
+			backoff := retryBackoff(tryCount, retryInterval, maxRetryInterval)
+			logger.Infof("Blue Button request %s try #%d in %d ms...", queryID, tryCount+1, backoff/time.Millisecond)
+			time.Sleep(backoff)
+		}
+
+		if !bbBreaker.allow(time.Now()) {
+			return nil, ErrCircuitOpen
+		}
 		tryCount++
-		if tryCount > 1 {
-			logger.Infof("Blue Button request %s try #%d in %d ms...", queryID, tryCount, retryInterval)
-			time.Sleep(time.Duration(retryInterval) * time.Millisecond)
+		time.Sleep(bbLimiter.reserve(time.Now(), rate, burst))
+
+		body, err := bbc.tryRequest(req)
+		if err == nil {
+			bbBreaker.success()
+			return body, nil
 		}
+		logger.Error(err)
 
-		data, err := bbc.tryRequest(req)
-		if err != nil {
-			logger.Error(err)
-			continue
+		// an error response other than 429 or 5xx still shows that Blue Button is up
+		if re, ok := err.(*responseError); ok && re.statusCode < 500 && re.statusCode != http.StatusTooManyRequests {
+			bbBreaker.success()
+		} else if bbBreaker.failure(time.Now(), breakerThreshold, breakerOpenFor) {
+			logger.Warnf("Blue Button circuit breaker opened after request %s failed; pausing requests for %s", queryID, breakerOpenFor)
 		}
-		return data, nil
 	}
 
-	return "", fmt.Errorf("Blue Button request %s failed %d time(s)", queryID, tryCount)
+	return nil, fmt.Errorf("Blue Button request %s failed %d time(s)", queryID, tryCount)
 }
 
 func AddRequestHeaders(req *http.Request, reqID uuid.UUID, jobID, cmsID string) {
@@ -198,27 +470,78 @@ func AddRequestHeaders(req *http.Request, reqID uuid.UUID, jobID, cmsID string)
 
 }
 
-func (bbc *BlueButtonClient) tryRequest(req *http.Request) (string, error) {
+func (bbc *BlueButtonClient) tryRequest(req *http.Request) (io.ReadCloser, error) {
 	go logRequest(req)
-	resp, err := bbc.httpClient.Do(req)
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := bbc.startTimeout(cancel)
+	resp, err := bbc.httpClient.Do(req.WithContext(ctx))
 	if resp != nil {
-		defer resp.Body.Close()
 		logResponse(req, resp)
 	}
+	if !timer.Stop() && err == nil {
+		err = context.DeadlineExceeded
+	}
 	if err != nil {
-		return "", errors.Wrapf(err, "error from request %s", req.Header.Get("BlueButton-OriginalQueryId"))
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errors.Wrapf(err, "error from request %s", req.Header.Get("BlueButton-OriginalQueryId"))
 	}
 
 	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf("error from request %s: %s", req.Header.Get("BlueButton-OriginalQueryId"), resp.Status)
+		resp.Body.Close()
+		cancel()
+		return nil, &responseError{queryID: req.Header.Get("BlueButton-OriginalQueryId"), status: resp.Status, statusCode: resp.StatusCode}
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", errors.Wrapf(err, "error reading response from request %s", req.Header.Get("BlueButton-OriginalQueryId"))
+	return &responseBody{body: resp.Body, cancel: cancel, bbc: bbc, queryID: req.Header.Get("BlueButton-OriginalQueryId")}, nil
+}
+
+// startTimeout calls cancel if the client's timeout passes before the returned timer is stopped.
+func (bbc *BlueButtonClient) startTimeout(cancel func()) *time.Timer {
+	if bbc.timeout <= 0 {
+		// a timer that never fires, so it can be stopped like any other
+		return time.NewTimer(math.MaxInt64)
+	}
+	return time.AfterFunc(bbc.timeout, cancel)
+}
+
+// responseBody is the body of a response from Blue Button.  Each read that waits longer than the client's timeout for
+// data fails, but a body may be read as slowly as its reader likes.
+type responseBody struct {
+	body    io.ReadCloser
+	cancel  func()
+	bbc     *BlueButtonClient
+	queryID string
+}
+
+func (rb *responseBody) Read(p []byte) (int, error) {
+	timer := rb.bbc.startTimeout(rb.cancel)
+	n, err := rb.body.Read(p)
+	if !timer.Stop() && err == nil {
+		err = context.DeadlineExceeded
+	}
+	if err != nil && err != io.EOF {
+		err = errors.Wrapf(err, "error reading response from request %s", rb.queryID)
 	}
+	return n, err
+}
+
+func (rb *responseBody) Close() error {
+	defer rb.cancel()
+	return rb.body.Close()
+}
 
-	return string(data), nil
+// responseError is an error status returned by Blue Button.
+type responseError struct {
+	queryID    string
+	status     string
+	statusCode int
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("error from request %s: %s", e.queryID, e.status)
 }
 
 func logRequest(req *http.Request) {
@@ -269,3 +592,16 @@ func UpdateParamWithLastUpdated(params *url.Values, since string, transactionTim
 		params.Add("_lastUpdated", since)
 	}
 }
+
+// AddTypeFilterParams adds the search parameters from a _typeFilter query.  Parameters the client sets itself are
+// never overwritten, so a filter can only narrow a request.
+func AddTypeFilterParams(params *url.Values, typeFilter url.Values) {
+	for name, values := range typeFilter {
+		if _, set := (*params)[name]; set {
+			continue
+		}
+		for _, v := range values {
+			params.Add(name, v)
+		}
+	}
+}
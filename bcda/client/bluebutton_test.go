@@ -2,6 +2,8 @@ package client_test
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -39,7 +41,7 @@ func (s *BBTestSuite) SetupSuite() {
 func (s *BBRequestTestSuite) SetupSuite() {
 	ts200 = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", r.URL.Query().Get("_format"))
-		response := fmt.Sprintf("{ \"test\": \"ok\"; \"url\": %v}", r.URL.String())
+		response := fmt.Sprintf("{ \"test\": \"ok\", \"url\": \"%v\"}", r.URL.String())
 		fmt.Fprint(w, response)
 	}))
 
@@ -64,6 +66,15 @@ func (s *BBRequestTestSuite) BeforeTest(suiteName, testName string) {
 	os.Setenv("BB_SERVER_LOCATION", s.ts.URL)
 }
 
+// readBody reads the whole of a response from the client.
+func readBody(r io.Reader, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(r)
+	return string(body), err
+}
+
 /* Tests for creating client and other functions that don't make requests */
 func (s *BBTestSuite) TestNewBlueButtonClientNoCertFile() {
 	origCertFile := os.Getenv("BB_CLIENT_CERT_FILE")
@@ -185,10 +196,18 @@ func (s *BBTestSuite) TestGetDefaultParams() {
 
 }
 
+func (s *BBTestSuite) TestAddTypeFilterParams() {
+	params := client.GetDefaultParams()
+	params.Set("patient", "012345")
+	client.AddTypeFilterParams(&params, url.Values{"type": []string{"carrier"}, "patient": []string{"99999"}})
+	assert.Equal(s.T(), "carrier", params.Get("type"))
+	assert.Equal(s.T(), []string{"012345"}, params["patient"])
+}
+
 /* Tests that make requests, using clients configured with the 200 response and 500 response httptest.Servers initialized in SetupSuite() */
 func (s *BBRequestTestSuite) TestGetPatientWithoutSince() {
 	since := ""
-	p, err := s.bbClient.GetPatient("012345", "543210", "A0000", since, now)
+	p, err := readBody(s.bbClient.GetPatient("012345", "543210", "A0000", since, now))
 	assert.Nil(s.T(), err)
 	assert.Contains(s.T(), p, `{ "test": "ok"`)
 	assert.NotContains(s.T(), p, "excludeSAMHSA=true")
@@ -198,14 +217,14 @@ func (s *BBRequestTestSuite) TestGetPatientWithoutSince() {
 
 func (s *BBRequestTestSuite) TestGetPatientWithInvalidSince_500() {
 	since := "invalid"
-	p, err := s.bbClient.GetPatient("012345", "543210", "A0000", since, now)
+	p, err := readBody(s.bbClient.GetPatient("012345", "543210", "A0000", since, now))
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Equal(s.T(), "", p)
 }
 
 func (s *BBRequestTestSuite) TestGetPatientWithSince() {
 	since := "gt2020-02-14"
-	p, err := s.bbClient.GetPatient("012345", "543210", "A0000", since, now)
+	p, err := readBody(s.bbClient.GetPatient("012345", "543210", "A0000", since, now))
 	assert.Nil(s.T(), err)
 	assert.Contains(s.T(), p, `{ "test": "ok"`)
 	assert.NotContains(s.T(), p, "excludeSAMHSA=true")
@@ -215,14 +234,14 @@ func (s *BBRequestTestSuite) TestGetPatientWithSince() {
 
 func (s *BBRequestTestSuite) TestGetPatient_500() {
 	since := ""
-	p, err := s.bbClient.GetPatient("012345", "543210", "A0000", since, now)
+	p, err := readBody(s.bbClient.GetPatient("012345", "543210", "A0000", since, now))
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Equal(s.T(), "", p)
 }
 
 func (s *BBRequestTestSuite) TestGetCoverageWithoutSince() {
 	since := ""
-	c, err := s.bbClient.GetCoverage("012345", "543210", "A0000", since, now)
+	c, err := readBody(s.bbClient.GetCoverage("012345", "543210", "A0000", since, now))
 	assert.Nil(s.T(), err)
 	assert.Contains(s.T(), c, `{ "test": "ok"`)
 	assert.NotContains(s.T(), c, "excludeSAMHSA=true")
@@ -232,14 +251,14 @@ func (s *BBRequestTestSuite) TestGetCoverageWithoutSince() {
 
 func (s *BBRequestTestSuite) TestGetCoverageWithInvalidSince_500() {
 	since := "invalid"
-	c, err := s.bbClient.GetCoverage("012345", "543210", "A0000", since, now)
+	c, err := readBody(s.bbClient.GetCoverage("012345", "543210", "A0000", since, now))
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Equal(s.T(), "", c)
 }
 
 func (s *BBRequestTestSuite) TestGetCoverageWithSince() {
 	since := "gt2020-02-14"
-	c, err := s.bbClient.GetCoverage("012345", "543210", "A0000", since, now)
+	c, err := readBody(s.bbClient.GetCoverage("012345", "543210", "A0000", since, now))
 	assert.Nil(s.T(), err)
 	assert.Contains(s.T(), c, `{ "test": "ok"`)
 	assert.NotContains(s.T(), c, "excludeSAMHSA=true")
@@ -249,14 +268,14 @@ func (s *BBRequestTestSuite) TestGetCoverageWithSince() {
 
 func (s *BBRequestTestSuite) TestGetCoverage_500() {
 	since := ""
-	p, err := s.bbClient.GetCoverage("012345", "543210", "A0000", since, now)
+	p, err := readBody(s.bbClient.GetCoverage("012345", "543210", "A0000", since, now))
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Equal(s.T(), "", p)
 }
 
 func (s *BBRequestTestSuite) TestGetExplanationOfBenefitWithoutSince() {
 	since := ""
-	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now)
+	e, err := readBody(s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now, nil))
 	assert.Nil(s.T(), err)
 	assert.Contains(s.T(), e, `{ "test": "ok"`)
 	assert.Contains(s.T(), e, "excludeSAMHSA=true")
@@ -266,14 +285,14 @@ func (s *BBRequestTestSuite) TestGetExplanationOfBenefitWithoutSince() {
 
 func (s *BBRequestTestSuite) TestGetExplanationOfBenefitWithInvalidSince_500() {
 	since := "invalid"
-	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now)
+	e, err := readBody(s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now, nil))
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Equal(s.T(), "", e)
 }
 
 func (s *BBRequestTestSuite) TestGetExplanationOfBenefitWithSince() {
 	since := "gt2020-02-14"
-	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now)
+	e, err := readBody(s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now, nil))
 	assert.Nil(s.T(), err)
 	assert.Contains(s.T(), e, `{ "test": "ok"`)
 	assert.Contains(s.T(), e, "excludeSAMHSA=true")
@@ -281,13 +300,89 @@ func (s *BBRequestTestSuite) TestGetExplanationOfBenefitWithSince() {
 	assert.Contains(s.T(), e, fmt.Sprintf("_lastUpdated=le%s", nowFormatted))
 }
 
+func (s *BBRequestTestSuite) TestGetExplanationOfBenefitWithTypeFilter() {
+	typeFilter := url.Values{"type": []string{"carrier,inpatient"}}
+	e, err := readBody(s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now, typeFilter))
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), e, `{ "test": "ok"`)
+	assert.Contains(s.T(), e, "type=carrier%2Cinpatient")
+	assert.Contains(s.T(), e, "excludeSAMHSA=true")
+}
+
 func (s *BBRequestTestSuite) TestGetExplanationOfBenefit_500() {
 	since := ""
-	p, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now)
+	p, err := readBody(s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", since, now, nil))
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Equal(s.T(), "", p)
 }
 
+func (s *BBRequestTestSuite) TestGetExplanationOfBenefitPages() {
+	var requests []*url.URL
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL)
+		// the next link names another host, but is followed on the configured server
+		switch r.URL.Query().Get("startIndex") {
+		case "":
+			fmt.Fprint(w, `{"resourceType":"Bundle","total":3,"link":[{"relation":"next","url":"https://bfd.example/v1/fhir/ExplanationOfBenefit?patient=012345&_count=2&startIndex=2"}],"entry":[{"resource":{"id":"1"}},{"resource":{"id":"2"}}]}`)
+		default:
+			fmt.Fprint(w, `{"resourceType":"Bundle","total":3,"link":[{"relation":"self","url":"https://bfd.example/v1/fhir/ExplanationOfBenefit?patient=012345&_count=2&startIndex=2"}],"entry":[{"resource":{"id":"3"}}]}`)
+		}
+	}))
+	defer ts.Close()
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+	origPageSize := os.Getenv("BB_REQUEST_PAGE_SIZE")
+	defer os.Setenv("BB_REQUEST_PAGE_SIZE", origPageSize)
+	os.Setenv("BB_REQUEST_PAGE_SIZE", "2")
+
+	r, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now, nil)
+	assert.Nil(s.T(), err)
+	// the next page isn't requested until the first has been read
+	assert.Len(s.T(), requests, 1)
+	e, err := readBody(r, err)
+	assert.Nil(s.T(), err)
+	// the pages are read one after another
+	assert.Contains(s.T(), e, `"entry":[{"resource":{"id":"1"}},{"resource":{"id":"2"}}]}{"resourceType":"Bundle"`)
+	assert.Contains(s.T(), e, `"id":"3"`)
+	assert.Len(s.T(), requests, 2)
+	assert.Equal(s.T(), "2", requests[0].Query().Get("_count"))
+	assert.Equal(s.T(), "/v1/fhir/ExplanationOfBenefit", requests[1].Path)
+	assert.Equal(s.T(), "2", requests[1].Query().Get("startIndex"))
+}
+
+func (s *BBRequestTestSuite) TestGetExplanationOfBenefitTotalMismatch() {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"resourceType":"Bundle","total":3,"entry":[{"resource":{"id":"1"}},{"resource":{"id":"2"}}]}`)
+	}))
+	defer ts.Close()
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+
+	// the page is streamed to the reader before the shortfall is found at the end of the bundle
+	e, err := readBody(s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now, nil))
+	assert.EqualError(s.T(), err, "Blue Button bundle /v1/fhir/ExplanationOfBenefit/ has 2 entries on 1 page(s), but its total is 3")
+	assert.Contains(s.T(), e, `"id":"2"`)
+}
+
+func (s *BBRequestTestSuite) TestGetExplanationOfBenefitSlowReader() {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"resourceType":"Bundle","total":1,"entry":[{"resource":{"id":"1"}}]}`)
+	}))
+	defer ts.Close()
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+	origTimeout := os.Getenv("BB_TIMEOUT_MS")
+	defer os.Setenv("BB_TIMEOUT_MS", origTimeout)
+	os.Setenv("BB_TIMEOUT_MS", "100")
+	bbClient, err := client.NewBlueButtonClient()
+	assert.Nil(s.T(), err)
+
+	// the timeout limits waiting on Blue Button, not how long the reader takes to get to the response
+	r, err := bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now, nil)
+	assert.Nil(s.T(), err)
+	time.Sleep(300 * time.Millisecond)
+	e, err := readBody(r, err)
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), e, `"id":"1"`)
+}
+
 func (s *BBRequestTestSuite) TestGetMetadata() {
 	m, err := s.bbClient.GetMetadata()
 	assert.Nil(s.T(), err)
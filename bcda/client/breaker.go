@@ -0,0 +1,154 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// ErrCircuitOpen is returned instead of making a request while Blue Button is considered to be down.  Callers should
+// wait for CircuitBreakerWait and try again rather than treat the request as failed.
+var ErrCircuitOpen = errors.New("Blue Button circuit breaker is open")
+
+// Every Blue Button client in the process shares one circuit breaker and one rate limit, so that concurrent jobs back
+// off from Blue Button together.  Processes don't share them: each worker counts its own failures and limits its own
+// requests, so the breaker settings apply per worker, and the rate limit is divided among the workers by
+// workerRateLimit.
+var (
+	bbBreaker = &circuitBreaker{}
+	bbLimiter = &tokenBucket{}
+)
+
+// trialWait is how long CircuitBreakerWait suggests waiting while a request is testing whether Blue Button is back.
+const trialWait = time.Second
+
+// CircuitBreakerWait returns how long until requests to Blue Button may be tried again, or 0 if they may be now.
+func CircuitBreakerWait() time.Duration {
+	return bbBreaker.wait(time.Now())
+}
+
+// circuitBreaker stops requests to Blue Button after a number of consecutive failures.  Once it has been open for a
+// while, it lets one request through at a time to test whether Blue Button has recovered, and closes when one succeeds.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int       // consecutive failed requests
+	openUntil time.Time // zero while the breaker is closed
+	trial     bool      // a request is testing whether Blue Button has recovered
+}
+
+// allow reports whether a request may be made now.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(cb.openUntil) || cb.trial {
+		return false
+	}
+	cb.trial = true
+	return true
+}
+
+// success records that Blue Button answered a request, closing the breaker.
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures, cb.openUntil, cb.trial = 0, time.Time{}, false
+}
+
+// failure records a failed request, and reports whether it opened the breaker for openFor.  The breaker opens after
+// threshold consecutive failures, or at once if the request was a trial; a threshold of 0 never opens it.
+func (cb *circuitBreaker) failure(now time.Time, threshold int, openFor time.Duration) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.trial || (threshold > 0 && cb.failures >= threshold && cb.openUntil.IsZero()) {
+		cb.openUntil, cb.trial = now.Add(openFor), false
+		return true
+	}
+	return false
+}
+
+// wait returns how long until allow will let a request through.
+func (cb *circuitBreaker) wait(now time.Time) time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openUntil.IsZero() {
+		return 0
+	}
+	if cb.trial {
+		return trialWait
+	}
+	if now.Before(cb.openUntil) {
+		return cb.openUntil.Sub(now)
+	}
+	return 0
+}
+
+// workerRateLimit returns this worker's share of the rate limit for requests to Blue Button.  BB_REQUEST_RATE and
+// BB_REQUEST_BURST are for all of the BB_WORKER_COUNT workers together, and each worker takes an equal share.
+func workerRateLimit() (rate float64, burst int) {
+	workers := utils.GetEnvInt("BB_WORKER_COUNT", 1)
+	if workers < 1 {
+		workers = 1
+	}
+	// requests per second across all workers; 0 is no limit
+	total := utils.GetEnvInt("BB_REQUEST_RATE", 0)
+	return float64(total) / float64(workers), utils.GetEnvInt("BB_REQUEST_BURST", total) / workers
+}
+
+// tokenBucket limits the rate of requests to Blue Button, allowing bursts of up to burst requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64 // negative when callers are waiting for tokens
+	last   time.Time
+}
+
+// reserve takes a token and returns how long the caller must wait before using it.  A rate of 0 or less is no limit.
+func (tb *tokenBucket) reserve(now time.Time, rate float64, burst int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.last.IsZero() {
+		tb.tokens = float64(burst)
+	} else {
+		tb.tokens = math.Min(float64(burst), tb.tokens+now.Sub(tb.last).Seconds()*rate)
+	}
+	tb.last = now
+
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / rate * float64(time.Second))
+}
+
+// retryBackoff returns how long to wait before the given retry of a request, counting from 1.  The backoff doubles
+// from base with each retry up to max, and is jittered to between half and all of that, so that requests that failed
+// together aren't retried together.
+func retryBackoff(retry int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
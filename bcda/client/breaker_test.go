@@ -0,0 +1,152 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &circuitBreaker{}
+	now := time.Now()
+
+	assert.False(t, cb.failure(now, 3, time.Minute))
+	assert.False(t, cb.failure(now, 3, time.Minute))
+	cb.success()
+	assert.False(t, cb.failure(now, 3, time.Minute))
+	assert.False(t, cb.failure(now, 3, time.Minute))
+	assert.True(t, cb.allow(now))
+	assert.Equal(t, time.Duration(0), cb.wait(now))
+
+	// three failures in a row open the breaker
+	assert.True(t, cb.failure(now, 3, time.Minute))
+	assert.False(t, cb.allow(now))
+	assert.Equal(t, time.Minute, cb.wait(now))
+
+	// once it has been open for a while, one request at a time may test Blue Button
+	later := now.Add(time.Minute)
+	assert.True(t, cb.allow(later))
+	assert.False(t, cb.allow(later))
+	assert.Equal(t, trialWait, cb.wait(later))
+
+	// a failed test opens it again
+	assert.True(t, cb.failure(later, 3, time.Minute))
+	assert.False(t, cb.allow(later))
+
+	// a successful one closes it
+	later = later.Add(time.Minute)
+	assert.True(t, cb.allow(later))
+	cb.success()
+	assert.True(t, cb.allow(later))
+	assert.True(t, cb.allow(later))
+	assert.Equal(t, time.Duration(0), cb.wait(later))
+
+	// a threshold of 0 never opens it
+	for i := 0; i < 10; i++ {
+		assert.False(t, cb.failure(later, 0, time.Minute))
+	}
+	assert.True(t, cb.allow(later))
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := &tokenBucket{}
+	now := time.Now()
+
+	// a burst of 2 is allowed, then requests wait their turn at 10 per second
+	assert.Equal(t, time.Duration(0), tb.reserve(now, 10, 2))
+	assert.Equal(t, time.Duration(0), tb.reserve(now, 10, 2))
+	assert.Equal(t, 100*time.Millisecond, tb.reserve(now, 10, 2))
+	assert.Equal(t, 200*time.Millisecond, tb.reserve(now, 10, 2))
+
+	// tokens accumulate up to the burst
+	later := now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), tb.reserve(later, 10, 2))
+	assert.Equal(t, time.Duration(0), tb.reserve(later, 10, 2))
+	assert.Equal(t, 100*time.Millisecond, tb.reserve(later, 10, 2))
+
+	// no rate is no limit
+	assert.Equal(t, time.Duration(0), tb.reserve(later, 0, 0))
+}
+
+func TestWorkerRateLimit(t *testing.T) {
+	for _, name := range []string{"BB_WORKER_COUNT", "BB_REQUEST_RATE", "BB_REQUEST_BURST"} {
+		orig := os.Getenv(name)
+		defer os.Setenv(name, orig)
+		os.Unsetenv(name)
+	}
+
+	rate, _ := workerRateLimit()
+	assert.Zero(t, rate)
+
+	os.Setenv("BB_REQUEST_RATE", "30")
+	rate, burst := workerRateLimit()
+	assert.Equal(t, 30.0, rate)
+	assert.Equal(t, 30, burst)
+
+	// the rate and burst are for all workers, and each takes its share
+	os.Setenv("BB_WORKER_COUNT", "4")
+	os.Setenv("BB_REQUEST_BURST", "8")
+	rate, burst = workerRateLimit()
+	assert.Equal(t, 7.5, rate)
+	assert.Equal(t, 2, burst)
+
+	os.Setenv("BB_WORKER_COUNT", "0")
+	rate, _ = workerRateLimit()
+	assert.Equal(t, 30.0, rate)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for retry, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		for i := 0; i < 20; i++ {
+			backoff := retryBackoff(retry, time.Second, 5*time.Second)
+			assert.True(t, backoff >= max/2 && backoff <= max, "retry %d backoff %s should be between %s and %s", retry, backoff, max/2, max)
+		}
+	}
+	assert.Equal(t, time.Duration(0), retryBackoff(1, 0, time.Second))
+}
+
+func TestGetData_CircuitBreaker(t *testing.T) {
+	origBreaker := bbBreaker
+	defer func() { bbBreaker = origBreaker }()
+	bbBreaker = &circuitBreaker{}
+	for name, value := range map[string]string{"BB_REQUEST_MAX_TRIES": "3", "BB_REQUEST_RETRY_INTERVAL_MS": "1", "BB_BREAKER_FAILURES": "2"} {
+		orig := os.Getenv(name)
+		defer os.Setenv(name, orig)
+		os.Setenv(name, value)
+	}
+
+	var requests int32
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	origServer := os.Getenv("BB_SERVER_LOCATION")
+	defer os.Setenv("BB_SERVER_LOCATION", origServer)
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+	bbc := &BlueButtonClient{httpClient: http.Client{}}
+
+	// the second failure opens the breaker, so the request isn't tried a third time
+	_, err := bbc.GetMetadata()
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	_, err = bbc.GetMetadata()
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.True(t, CircuitBreakerWait() > 0)
+
+	// errors that show Blue Button is up don't open it
+	bbBreaker = &circuitBreaker{}
+	status = http.StatusNotFound
+	_, err = bbc.GetMetadata()
+	assert.Regexp(t, `Blue Button request .+ failed 3 time\(s\)`, err.Error())
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+	assert.Equal(t, time.Duration(0), CircuitBreakerWait())
+}
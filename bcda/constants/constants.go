@@ -9,5 +9,12 @@ const ImportInprog = "In-Progress"
 const ImportComplete = "Completed"
 const ImportFail = "Failed"
 
+// Output formats for export data files, as named in the _outputFormat parameter and the job manifest
+const FHIRNDJSON = "application/fhir+ndjson"
+const GzipFHIRNDJSON = "application/fhir+ndjson+gzip"
+
+// Resource types that can be exported, in the order they are exported when _type is not given
+var ExportResourceTypes = []string{"Patient", "ExplanationOfBenefit", "Coverage"}
+
 // This is set during compilation.  See build_and_package.sh in the ops repo
 var Version = "latest"
@@ -26,6 +26,20 @@ func GetDbConnection() *sql.DB {
 	return db
 }
 
+// GetQueueDbConnection returns a connection to the database holding the que_jobs work queue.
+func GetQueueDbConnection() *sql.DB {
+	databaseURL := os.Getenv("QUEUE_DATABASE_URL")
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		LogFatal(err)
+	}
+	pingErr := db.Ping()
+	if pingErr != nil {
+		LogFatal(pingErr)
+	}
+	return db
+}
+
 func GetGORMDbConnection() *gorm.DB {
 	databaseURL := os.Getenv("DATABASE_URL")
 	db, err := gorm.Open("postgres", databaseURL)
@@ -78,6 +78,11 @@ type JobStatusResponse struct {
 	XProgress string `json:"X-Progress"`
 }
 
+// Data export job has been cancelled. Any files it had generated are deleted.
+// swagger:response deleteJobResponse
+type DeleteJobResponse struct {
+}
+
 // JSON object containing a version field
 // swagger:response VersionResponse
 type VersionResponse struct {
@@ -105,6 +110,13 @@ type MetadataResponse struct {
 	Body fhirmodels.CapabilityStatement `json:"body,omitempty"`
 }
 
+// FHIR OperationDefinition in JSON format
+// swagger:response OperationDefinitionResponse
+type OperationDefinitionResponse struct {
+	// in: body
+	Body fhirmodels.OperationDefinition `json:"body,omitempty"`
+}
+
 // File of newline-delimited JSON FHIR objects
 // swagger:response FileNDJSON
 type FileNDJSON struct {
@@ -112,10 +124,20 @@ type FileNDJSON struct {
 	Body string `json:"ndjson"`
 }
 
+// The file has not changed since the version identified by the If-None-Match or If-Modified-Since header.
+// swagger:response notModifiedResponse
+type NotModifiedResponse struct {
+}
+
+// The requested byte range is not within the file.
+// swagger:response rangeNotSatisfiableResponse
+type RangeNotSatisfiableResponse struct {
+}
+
 // A JobStatus parameter model.
 //
 // This is used for operations that want the ID of a job in the path
-// swagger:parameters jobStatus serveData
+// swagger:parameters jobStatus deleteJob serveData
 type JobIDParam struct {
 	// ID of data export job
 	//
@@ -149,6 +171,30 @@ type SinceParam struct {
         DateTime string `json:"_since"`
 }
 
+// swagger:parameters bulkPatientRequest bulkGroupRequest
+type TypeFilterParam struct {
+	// (Optional) Comma-separated FHIR search queries that narrow the exported resources, e.g. `ExplanationOfBenefit?type=carrier,inpatient`.  ExplanationOfBenefit may be filtered by claim type: carrier, dme, hha, hospice, inpatient, outpatient, pde, or snf
+	// in: query
+	// required: false
+	TypeFilter string `json:"_typeFilter"`
+}
+
+// swagger:parameters bulkPatientRequest bulkGroupRequest
+type ElementsParam struct {
+	// (Optional) Comma-separated root elements to include in each resource, e.g. `id,ExplanationOfBenefit.type`.  An element without a resource type applies to every resource type.  resourceType, id, and meta are always included, and trimmed resources are tagged SUBSETTED
+	// in: query
+	// required: false
+	Elements string `json:"_elements"`
+}
+
+// swagger:parameters bulkPatientRequest bulkGroupRequest
+type OutputFormatParam struct {
+	// (Optional) Format of the generated data files.  application/fhir+ndjson (the default), application/ndjson, and ndjson all produce NDJSON files; application/fhir+ndjson+gzip produces gzip-compressed NDJSON files
+	// in: query
+	// required: false
+	OutputFormat string `json:"_outputFormat"`
+}
+
 // swagger:parameters bulkPatientRequest bulkGroupRequest
 type BulkRequestHeaders struct {
 	// required: true
@@ -157,6 +203,30 @@ type BulkRequestHeaders struct {
 	Prefer string
 }
 
+// swagger:parameters listJobs
+type JobListParams struct {
+	// (Optional) Comma-separated job statuses to include: Pending, In Progress, Completed, Failed, Archived, Expired, or Cancelled
+	// in: query
+	Status string `json:"status"`
+	// (Optional) Only include jobs created at or after the given instant in time.  Format of string must align with the FHIR dateTime datatype
+	// in: query
+	Since string `json:"_since"`
+	// (Optional) Number of jobs per page, from 1 to 200 (default 50)
+	// in: query
+	Count int `json:"_count"`
+	// (Optional) Page number, starting at 1
+	// in: query
+	Page int `json:"_page"`
+}
+
+// swagger:parameters operationDefinition
+type OperationIDParam struct {
+	// ID of the OperationDefinition: patient-export or group-export
+	// in: path
+	// required: true
+	OperationID string `json:"operationId"`
+}
+
 // A BulkGroupRequest parameter model.
 //
 // This is used for operations that want the groupID of a group in the path
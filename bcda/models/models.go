@@ -2,13 +2,18 @@ package models
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/CMSgov/bcda-app/bcda/constants"
@@ -17,6 +22,7 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/auth/rsautils"
 	"github.com/CMSgov/bcda-app/bcda/client"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/bgentry/que-go"
 	"github.com/jinzhu/gorm"
@@ -29,6 +35,19 @@ const BCDA_FHIR_MAX_RECORDS_EOB_DEFAULT = 200
 const BCDA_FHIR_MAX_RECORDS_PATIENT_DEFAULT = 5000
 const BCDA_FHIR_MAX_RECORDS_COVERAGE_DEFAULT = 4000
 
+// GroupAll is the Group identifier that exports every beneficiary attributed to the ACO
+const GroupAll = "all"
+
+// GroupNewlyAttributed is the Group identifier that exports the beneficiaries newly attributed to the ACO by its latest
+// CCLF8 file
+const GroupNewlyAttributed = "new"
+
+// Attribution change types
+const (
+	AttributionAdded   = "added"
+	AttributionDropped = "dropped"
+)
+
 func InitializeGormModels() *gorm.DB {
 	log.Println("Initialize bcda models")
 	db := database.GetGORMDbConnection()
@@ -43,14 +62,22 @@ func InitializeGormModels() *gorm.DB {
 		&ACO{},
 		&Job{},
 		&JobKey{},
+		&JobError{},
+		&JobCheckpoint{},
 		&CCLFBeneficiaryXref{},
 		&CCLFFile{},
 		&CCLFBeneficiary{},
+		&CCLFAttributionChange{},
 		&Suppression{},
 		&SuppressionFile{},
+		&BeneficiaryGroup{},
+		&BeneficiaryGroupMember{},
 	)
 
 	db.Model(&CCLFBeneficiary{}).AddForeignKey("file_id", "cclf_files(id)", "RESTRICT", "RESTRICT")
+	// for GetChunkSize's look at recent chunks
+	db.Model(&JobKey{}).AddIndex("idx_job_keys_resource_type_created_at", "resource_type", "created_at")
+	db.Model(&Job{}).AddIndex("idx_jobs_aco_id", "aco_id")
 
 	return db
 }
@@ -62,6 +89,15 @@ type Job struct {
 	RequestURL        string    `json:"request_url"` // request_url
 	Status            string    `json:"status"`      // status
 	TransactionTime   time.Time // most recent data load transaction time from BFD
+	GroupID           string    `json:"group_id"`           // export group requested; empty for Patient/$export and the "all" group
+	OutputFormat      string    `json:"output_format"`      // format of the data files; empty for jobs created before _outputFormat was supported
+	TypeFilter        string    `json:"type_filter"`        // _typeFilter queries, encoded as resource type=Blue Button query string
+	FailureReason     string    `json:"failure_reason"`     // explanation shown to the client when the job fails; empty if the cause is internal
+	Elements          string    `json:"elements"`           // _elements requested, comma-separated; empty to export whole resources
+	ResourceTypes     string    `json:"resource_types"`     // resource types the job's chunks export, comma-separated; empty for jobs created before they were recorded
+	Since             string    `json:"since"`              // Blue Button _lastUpdated filter from _since, e.g. gt2020-02-13T08:00:00.000-05:00
+	ChunkSizes        string    `json:"chunk_sizes"`        // beneficiaries per chunk used for each resource type, encoded as resource type=size
+	BeneficiaryDigest string    `json:"beneficiary_digest"` // SHA-256 of the IDs of the beneficiaries the job's chunks export, in chunk order
 	JobCount          int
 	CompletedJobCount int
 	JobKeys           []JobKey
@@ -79,32 +115,61 @@ func (job *Job) CheckCompletedAndCleanup(db *gorm.DB) (bool, error) {
 
 	if int(completedJobs) >= job.JobCount {
 
-		staging := fmt.Sprintf("%s/%d", os.Getenv("FHIR_STAGING_DIR"), job.ID)
-		payload := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), job.ID)
-
-		files, err := ioutil.ReadDir(staging)
+		store, err := storage.Get()
 		if err != nil {
-			log.Error(err)
+			return false, err
 		}
-
-		for _, f := range files {
-			oldPath := fmt.Sprintf("%s/%s", staging, f.Name())
-			newPath := fmt.Sprintf("%s/%s", payload, f.Name())
-			err := os.Rename(oldPath, newPath)
-			if err != nil {
-				log.Error(err)
-			}
+		// The job is not complete until its files are where the client will download them
+		if err = store.MoveDir(storage.Staging, storage.Payload, strconv.Itoa(int(job.ID))); err != nil {
+			return false, errors.Wrapf(err, "cannot move files for job %d to the payload area", job.ID)
 		}
-		err = os.Remove(staging)
-		if err != nil {
-			log.Error(err)
-		}
-		return true, db.Model(&job).Update("status", "Completed").Error
+
+		// A job cancelled while its last chunk was running stays cancelled
+		return true, db.Model(&job).Where("status <> ?", "Cancelled").Update("status", "Completed").Error
 	}
 
 	return false, nil
 }
 
+// Cancel stops a Pending or In Progress job. The job is marked Cancelled, its remaining chunks are removed from the
+// work queue, and any staging or payload files already written are deleted. Workers processing a chunk of the job
+// notice within a few seconds, stop, and remove anything they wrote in the meantime. Returns false if the job was not
+// in a state that can be cancelled.
+func (job *Job) Cancel(db *gorm.DB) (bool, error) {
+	result := db.Model(&Job{}).Where("id = ? and status in (?)", job.ID, []string{"Pending", "In Progress"}).Update("status", "Cancelled")
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	job.Status = "Cancelled"
+
+	queueDB := database.GetQueueDbConnection()
+	defer queueDB.Close()
+
+	_, err := queueDB.Exec(`delete from que_jobs where args->>'ID' = $1`, strconv.Itoa(int(job.ID)))
+	if err != nil {
+		return true, errors.Wrapf(err, "could not remove queued chunks for job %d", job.ID)
+	}
+
+	return true, job.RemoveFiles()
+}
+
+// RemoveFiles deletes the staging and payload files written for the job.
+func (job *Job) RemoveFiles() error {
+	store, err := storage.Get()
+	if err != nil {
+		return err
+	}
+	for _, area := range []storage.Area{storage.Staging, storage.Payload} {
+		if err = store.RemoveAll(area, strconv.Itoa(int(job.ID))); err != nil {
+			log.Error(err)
+		}
+	}
+	return nil
+}
+
 func (job *Job) GetEnqueJobs(resourceTypes []string, since string) (enqueJobs []*que.Job, err error) {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
@@ -114,8 +179,34 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string) (enqueJobs []
 		return nil, err
 	}
 
+	typeFilters, err := url.ParseQuery(job.TypeFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks are queued a round at a time behind the ACO's chunks already in the queue, so that the queue works
+	// through ACOs round-robin and one large export doesn't hold up everyone else's.
+	firstRound, err := nextACORound("", job.ACOID.String())
+	if err != nil {
+		return nil, err
+	}
+
 	// includeSuppressed = false to exclude beneficiaries who have opted out of data sharing
-	beneficiaries, err := aco.GetBeneficiaries(false)
+	var beneficiaries []CCLFBeneficiary
+	if job.GroupID == "" || job.GroupID == GroupAll {
+		beneficiaries, err = aco.GetBeneficiaries(false)
+	} else if job.GroupID == GroupNewlyAttributed {
+		beneficiaries, err = aco.GetNewlyAttributedBeneficiaries(false)
+	} else {
+		beneficiaries, err = aco.GetGroupBeneficiaries(job.GroupID, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.BeneficiaryDigest = beneficiaryDigest(beneficiaries)
+
+	// A job's chunks are regenerated with the sizes first chosen for them, so they come out the same.
+	chunkSizes, err := url.ParseQuery(job.ChunkSizes)
 	if err != nil {
 		return nil, err
 	}
@@ -123,9 +214,12 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string) (enqueJobs []
 	for _, rt := range resourceTypes {
 		var rowCount = 0
 		var jobIDs []string
-		maxBeneficiaries, err := GetMaxBeneCount(rt)
+		maxBeneficiaries, err := strconv.Atoi(chunkSizes.Get(rt))
 		if err != nil {
-			return nil, err
+			if maxBeneficiaries, err = GetChunkSize(db, job.ACOID.String(), rt); err != nil {
+				return nil, err
+			}
+			chunkSizes.Set(rt, strconv.Itoa(maxBeneficiaries))
 		}
 		for _, b := range beneficiaries {
 			rowCount++
@@ -134,19 +228,24 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string) (enqueJobs []
 
 				args, err := json.Marshal(jobEnqueueArgs{
 					ID:              int(job.ID),
+					Chunk:           len(enqueJobs) + 1,
 					ACOID:           job.ACOID.String(),
 					BeneficiaryIDs:  jobIDs,
 					ResourceType:    rt,
 					Since:           since,
 					TransactionTime: job.TransactionTime,
+					OutputFormat:    job.GetOutputFormat(),
+					TypeFilter:      typeFilters.Get(rt),
+					Elements:        job.GetElements(rt),
 				})
 				if err != nil {
 					return nil, err
 				}
 
 				j := &que.Job{
-					Type: "ProcessJob",
-					Args: args,
+					Type:     "ProcessJob",
+					Args:     args,
+					Priority: chunkPriority(firstRound + len(enqueJobs)),
 				}
 
 				enqueJobs = append(enqueJobs, j)
@@ -155,9 +254,141 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string) (enqueJobs []
 			}
 		}
 	}
+	job.ChunkSizes = chunkSizes.Encode()
 	return enqueJobs, nil
 }
 
+// beneficiaryDigest identifies the beneficiaries a job exports, so that a later delivery or change in suppressions
+// that alters them can be detected.
+func beneficiaryDigest(beneficiaries []CCLFBeneficiary) string {
+	h := sha256.New()
+	for _, b := range beneficiaries {
+		fmt.Fprintf(h, "%d\n", b.ID)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// nextACORound returns the round of the work queue that the ACO's next chunk belongs in.  A chunk's round is its que
+// priority, so que works through a round, one chunk from each ACO with chunks queued, before the next.  The round
+// being worked is the lowest one with a chunk still queued; an ACO's next chunk goes in that round, or the round after
+// the ACO's last queued chunk if that is later, so an ACO that starts an export after others doesn't jump ahead of
+// rounds already under way, and isn't queued behind all of their chunks either.
+func nextACORound(queue, acoID string) (int, error) {
+	queueDB := database.GetQueueDbConnection()
+	defer queueDB.Close()
+
+	var current, last int
+	err := queueDB.QueryRow(`select coalesce(min(priority), 1), coalesce(max(priority) filter (where args->>'ACOID' = $2), 0)
+		from que_jobs where queue = $1 and job_class = 'ProcessJob'`, queue, acoID).Scan(&current, &last)
+	if err != nil {
+		return 0, err
+	}
+	if last >= current {
+		return last + 1, nil
+	}
+	return current, nil
+}
+
+// chunkPriority is the que priority of a chunk in the given round of the work queue.  que works lower priorities
+// first; rounds past the largest priority share it and are worked in the order they were queued.
+func chunkPriority(round int) int16 {
+	if round < 1 {
+		return 1
+	}
+	if round >= math.MaxInt16 {
+		return math.MaxInt16
+	}
+	return int16(round)
+}
+
+// CountQueuedChunks returns the number of the job's chunks still in the work queue, whether waiting, being worked, or
+// waiting to be retried.
+func (job *Job) CountQueuedChunks() (int, error) {
+	queueDB := database.GetQueueDbConnection()
+	defer queueDB.Close()
+
+	var count int
+	err := queueDB.QueryRow(`select count(*) from que_jobs where args->>'ID' = $1`, strconv.Itoa(int(job.ID))).Scan(&count)
+	return count, err
+}
+
+// GetMissingChunks regenerates the job's chunks and returns those that have not written a data file.  It returns an
+// error if the chunks cannot be regenerated as they were first enqueued: if the job does not record its resource types
+// or beneficiaries, a file was written before chunks were numbered, or a new CCLF8 file or change in suppressions has
+// since changed the beneficiaries the job would export.
+func (job *Job) GetMissingChunks(db *gorm.DB) ([]*que.Job, error) {
+	if job.ResourceTypes == "" {
+		return nil, errors.New("job does not record the resource types it exports")
+	}
+	if job.BeneficiaryDigest == "" {
+		return nil, errors.New("job does not record the beneficiaries it exports")
+	}
+	enqueuedDigest := job.BeneficiaryDigest
+
+	var jobKeys []JobKey
+	if err := db.Find(&jobKeys, "job_id = ?", job.ID).Error; err != nil {
+		return nil, err
+	}
+	written := make(map[int]bool)
+	for _, jobKey := range jobKeys {
+		if jobKey.Chunk == 0 {
+			return nil, errors.New("job has files written before chunks were numbered")
+		}
+		written[jobKey.Chunk] = true
+	}
+
+	chunks, err := job.GetEnqueJobs(strings.Split(job.ResourceTypes, ","), job.Since)
+	if err != nil {
+		return nil, err
+	}
+	if job.BeneficiaryDigest != enqueuedDigest {
+		job.BeneficiaryDigest = enqueuedDigest
+		return nil, errors.New("job's beneficiaries have changed since its chunks were enqueued")
+	}
+	if len(chunks) != job.JobCount {
+		return nil, fmt.Errorf("job had %d chunks, but its beneficiaries now make %d", job.JobCount, len(chunks))
+	}
+
+	var missing []*que.Job
+	for i, chunk := range chunks {
+		if !written[i+1] {
+			missing = append(missing, chunk)
+		}
+	}
+	return missing, nil
+}
+
+// GetOutputFormat returns the format of the job's data files.
+func (j *Job) GetOutputFormat() string {
+	if j.OutputFormat == "" {
+		return constants.FHIRNDJSON
+	}
+	return j.OutputFormat
+}
+
+// GetElements returns the elements requested with _elements that apply to resources of the given type: those named
+// for the type (ExplanationOfBenefit.status) and those named without a type (id).  It returns nil, meaning whole
+// resources are exported, when none apply.
+func (j *Job) GetElements(resourceType string) []string {
+	if j.Elements == "" {
+		return nil
+	}
+	var elements []string
+	for _, e := range strings.Split(j.Elements, ",") {
+		parts := strings.SplitN(e, ".", 2)
+		if len(parts) == 2 {
+			if parts[0] != resourceType {
+				continue
+			}
+			e = parts[1]
+		}
+		if !utils.ContainsString(elements, e) {
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
 func (j *Job) StatusMessage() string {
 	if j.Status == "In Progress" && j.JobCount > 0 {
 		pct := float64(j.CompletedJobCount) / float64(j.JobCount) * 100
@@ -167,6 +398,33 @@ func (j *Job) StatusMessage() string {
 	return j.Status
 }
 
+// JobStatuses lists every status a job can be in.
+var JobStatuses = []string{"Pending", "In Progress", "Completed", "Failed", "Archived", "Expired", "Cancelled"}
+
+// GetJobs retrieves a page of the ACO's jobs, newest first, along with the total number of jobs matching the filters.
+// An empty statuses list matches every status, and a zero createdSince matches every creation time.
+func GetJobs(db *gorm.DB, acoID string, statuses []string, createdSince time.Time, limit, offset int) ([]Job, int, error) {
+	query := db.Model(&Job{}).Where("aco_id = ?", acoID)
+	if len(statuses) > 0 {
+		query = query.Where("status in (?)", statuses)
+	}
+	if !createdSince.IsZero() {
+		query = query.Where("created_at >= ?", createdSince)
+	}
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var jobs []Job
+	if err := query.Order("created_at desc, id desc").Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return jobs, total, nil
+}
+
 func GetMaxBeneCount(requestType string) (int, error) {
 	var envVar string
 	var defaultVal int
@@ -190,12 +448,200 @@ func GetMaxBeneCount(requestType string) (int, error) {
 	return maxBeneficiaries, nil
 }
 
+// chunkTimingSamples is the number of recent chunks whose timings GetChunkSize considers, and minChunkTimingSamples
+// the number it needs before it trusts them.
+const (
+	chunkTimingSamples    = 100
+	minChunkTimingSamples = 3
+	minChunkSize          = 10
+)
+
+// BCDA_CHUNK_MAX_SIZE_DEFAULT is the most beneficiaries GetChunkSize puts in a chunk, however quickly they are fetched.
+const BCDA_CHUNK_MAX_SIZE_DEFAULT = 10000
+
+// GetChunkSize returns the number of beneficiaries to put in each chunk of an ACO's export of a resource type.  It
+// aims for chunks that take BCDA_CHUNK_TARGET_SEC to run, judging by the time recent chunks took per beneficiary (see
+// estimateMSPerBeneficiary).  Chunks for ACOs whose beneficiaries are quick to fetch may be larger than GetMaxBeneCount,
+// up to BCDA_CHUNK_MAX_SIZE; GetMaxBeneCount is used as is without timings or when the target is 0.
+func GetChunkSize(db *gorm.DB, acoID, resourceType string) (int, error) {
+	maxBeneficiaries, err := GetMaxBeneCount(resourceType)
+	if err != nil {
+		return -1, err
+	}
+
+	target := utils.GetEnvInt("BCDA_CHUNK_TARGET_SEC", 300)
+	if target <= 0 {
+		return maxBeneficiaries, nil
+	}
+
+	msPerBeneficiary, err := getMSPerBeneficiary(db, acoID, resourceType)
+	if err != nil {
+		return -1, err
+	}
+	if msPerBeneficiary == 0 {
+		return maxBeneficiaries, nil
+	}
+
+	ceiling := utils.GetEnvInt("BCDA_CHUNK_MAX_SIZE", BCDA_CHUNK_MAX_SIZE_DEFAULT)
+	size := int(math.Min(float64(target)*1000/msPerBeneficiary, float64(ceiling)))
+	if size < minChunkSize {
+		size = int(math.Min(minChunkSize, float64(ceiling)))
+	}
+	return size, nil
+}
+
+// chunkTiming sums the counts and run times of recent chunks.
+type chunkTiming struct {
+	Chunks        int
+	Beneficiaries int64
+	Records       int64
+	DurationMS    int64
+}
+
+// estimateMSPerBeneficiary estimates the time a chunk of an ACO's export takes per beneficiary from the timings of the
+// ACO's recent chunks, if it has enough, since its claimants may be heavier or lighter than most.  Otherwise it uses
+// all ACOs' recent chunks, weighted by the number of records the ACO's few chunks found per beneficiary compared with
+// everyone's, since the time a chunk takes grows with the data it fetches.  It returns 0 if there are too few timings.
+func estimateMSPerBeneficiary(aco, all chunkTiming) float64 {
+	if aco.Chunks >= minChunkTimingSamples && aco.Beneficiaries > 0 {
+		return float64(aco.DurationMS) / float64(aco.Beneficiaries)
+	}
+	if all.Chunks < minChunkTimingSamples || all.Beneficiaries == 0 {
+		return 0
+	}
+
+	ms := float64(all.DurationMS) / float64(all.Beneficiaries)
+	if aco.Chunks > 0 && aco.Beneficiaries > 0 && aco.Records > 0 && all.Records > 0 {
+		acoVolume := float64(aco.Records) / float64(aco.Beneficiaries)
+		allVolume := float64(all.Records) / float64(all.Beneficiaries)
+		ms *= acoVolume / allVolume
+	}
+	return ms
+}
+
+// msPerBeneficiaryCache keeps estimates from getMSPerBeneficiary for BCDA_CHUNK_TIMING_CACHE_SEC, so that the timings
+// aren't summed again for every export request.
+var msPerBeneficiaryCache = struct {
+	sync.Mutex
+	estimates map[string]cachedEstimate
+}{estimates: make(map[string]cachedEstimate)}
+
+type cachedEstimate struct {
+	msPerBeneficiary float64
+	expires          time.Time
+}
+
+// getMSPerBeneficiary estimates the time a chunk of an ACO's export of a resource type takes per beneficiary.
+func getMSPerBeneficiary(db *gorm.DB, acoID, resourceType string) (float64, error) {
+	key := acoID + "/" + resourceType
+	msPerBeneficiaryCache.Lock()
+	cached, ok := msPerBeneficiaryCache.estimates[key]
+	msPerBeneficiaryCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.msPerBeneficiary, nil
+	}
+
+	var aco, all chunkTiming
+	for _, timing := range []struct {
+		aco    string
+		timing *chunkTiming
+	}{{acoID, &aco}, {"", &all}} {
+		err := db.Raw(`select count(*) as chunks, coalesce(sum(beneficiary_count), 0) as beneficiaries,
+				coalesce(sum(record_count), 0) as records, coalesce(sum(duration_ms), 0) as duration_ms
+			from (select job_keys.beneficiary_count, job_keys.record_count, job_keys.duration_ms from job_keys join jobs on jobs.id = job_keys.job_id
+				where job_keys.deleted_at is null and job_keys.resource_type = ? and job_keys.duration_ms > 0 and job_keys.beneficiary_count > 0
+				and (? = '' or jobs.aco_id = ?)
+				order by job_keys.created_at desc limit ?) recent`,
+			resourceType, timing.aco, timing.aco, chunkTimingSamples).Scan(timing.timing).Error
+		if err != nil {
+			return 0, err
+		}
+		if timing.aco != "" && aco.Chunks >= minChunkTimingSamples {
+			break
+		}
+	}
+
+	msPerBeneficiary := estimateMSPerBeneficiary(aco, all)
+	ttl := time.Duration(utils.GetEnvInt("BCDA_CHUNK_TIMING_CACHE_SEC", 300)) * time.Second
+	if ttl > 0 {
+		msPerBeneficiaryCache.Lock()
+		msPerBeneficiaryCache.estimates[key] = cachedEstimate{msPerBeneficiary, time.Now().Add(ttl)}
+		msPerBeneficiaryCache.Unlock()
+	}
+	return msPerBeneficiary, nil
+}
+
+// JobKey is a data file written by one chunk of an export job, with counts describing its contents.  The counts are
+// zero for files written before they were recorded.
 type JobKey struct {
 	gorm.Model
-	Job          Job    `gorm:"foreignkey:jobID"`
-	JobID        uint   `gorm:"primary_key" json:"job_id"`
-	FileName     string `gorm:"type:char(127)"`
-	ResourceType string
+	Job              Job    `gorm:"foreignkey:jobID"`
+	JobID            uint   `gorm:"primary_key" json:"job_id"`
+	FileName         string `gorm:"type:char(127)"`
+	ResourceType     string
+	Chunk            int   `json:"chunk"`             // number of the chunk that wrote the file; 0 for files written before chunks were numbered
+	RecordCount      int   `json:"record_count"`      // resources written to the file
+	ByteSize         int64 `json:"byte_size"`         // size of the file as written, compressed if gzip
+	BeneficiaryCount int   `json:"beneficiary_count"` // beneficiaries requested in the chunk
+	SuppressedCount  int   `json:"suppressed_count"`  // beneficiaries skipped because they opted out of data sharing
+	FailedCount      int   `json:"failed_count"`      // beneficiaries whose data could not be retrieved from Blue Button
+	DurationMS       int64 `json:"duration_ms"`       // time the chunk took to write the file; 0 if unknown, or if the chunk resumed from a checkpoint
+}
+
+// JobError is the number of errors with one error code that a chunk of an export job hit.  Each chunk records its own
+// counts, which are summed by resource type and code to summarize the job's errors.
+type JobError struct {
+	gorm.Model
+	JobID        uint   `gorm:"not null;index" json:"job_id"`
+	ResourceType string `json:"resource_type"`
+	Code         string `json:"code"` // details code of the OperationOutcomes written, e.g. responseutils.BbErr
+	Count        int    `json:"count"`
+	FileName     string `json:"file_name"` // error file holding the OperationOutcomes
+}
+
+// JobCheckpoint records how far the que job for a chunk of an export job has gotten, so that a retry after the worker
+// stops can append to the same data file rather than starting over.
+type JobCheckpoint struct {
+	gorm.Model
+	QueJobID         int64  `gorm:"unique_index;not null" json:"que_job_id"`
+	JobID            uint   `gorm:"index" json:"job_id"`
+	FileUUID         string `gorm:"type:char(36)" json:"file_uuid"`
+	Completed        int    `json:"completed"` // number of the chunk's beneficiaries handled, in order
+	RecordCount      int    `json:"record_count"`
+	SuppressedCount  int    `json:"suppressed_count"`
+	BbErrCount       int    `json:"bb_err_count"`
+	InternalErrCount int    `json:"internal_err_count"`
+	DataFileSize     int64  `json:"data_file_size"`  // size of the data file when the checkpoint was saved
+	ErrorFileSize    int64  `json:"error_file_size"` // size of the error file when the checkpoint was saved
+}
+
+// JobErrorSummary is the total number of errors with one error code hit while exporting a resource type for a job.
+type JobErrorSummary struct {
+	ResourceType string `json:"type"`
+	Code         string `json:"code"`
+	Count        int    `json:"count"`
+}
+
+// GetJobErrorSummary totals the errors recorded for a job by resource type and error code.
+func GetJobErrorSummary(db *gorm.DB, jobID uint) ([]JobErrorSummary, error) {
+	var summary []JobErrorSummary
+	err := db.Model(&JobError{}).Select("resource_type, code, sum(count) as count").Where("job_id = ?", jobID).
+		Group("resource_type, code").Order("resource_type, code").Scan(&summary).Error
+	return summary, err
+}
+
+// JobErrorFile is an error file written for a job and the number of errors in it.
+type JobErrorFile struct {
+	FileName string
+	Count    int
+}
+
+// GetJobErrorFiles returns the error files written for a job.
+func GetJobErrorFiles(db *gorm.DB, jobID uint) ([]JobErrorFile, error) {
+	var files []JobErrorFile
+	err := db.Model(&JobError{}).Select("file_name, sum(count) as count").Where("job_id = ?", jobID).
+		Group("file_name").Order("file_name").Scan(&files).Error
+	return files, err
 }
 
 // ACO represents an Accountable Care Organization.
@@ -229,36 +675,67 @@ func (aco *ACO) GetBeneficiaryIDs(includeSuppressed bool) (cclfBeneficiaryIDs []
 
 // GetBeneficiaries retrieves beneficiaries associated with the ACO.
 func (aco *ACO) GetBeneficiaries(includeSuppressed bool) ([]CCLFBeneficiary, error) {
-	var cclfBeneficiaries []CCLFBeneficiary
+	return aco.getBeneficiaries(nil, includeSuppressed)
+}
 
-	if aco.CMSID == nil {
-		log.Errorf("No CMSID set for ACO: %s", aco.UUID)
-		return cclfBeneficiaries, fmt.Errorf("no CMS ID set for this ACO")
+// GetGroupBeneficiaries retrieves the beneficiaries in the ACO's named group who are attributed to the ACO
+// in its latest CCLF8 file. Group members who are no longer attributed are left out.
+func (aco *ACO) GetGroupBeneficiaries(groupID string, includeSuppressed bool) ([]CCLFBeneficiary, error) {
+	group, err := GetBeneficiaryGroup(aco.UUID.String(), groupID)
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("no group %s found for ACO ID %s", groupID, aco.UUID.String())
+	} else if err != nil {
+		return nil, err
+	}
+
+	mbis, err := group.GetMemberMBIs()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mbis) == 0 {
+		log.Errorf("Found 0 members in group %s for ACO ID %s", groupID, aco.UUID.String())
+		return nil, fmt.Errorf("found 0 members in group %s for ACO ID %s", groupID, aco.UUID.String())
 	}
+
+	return aco.getBeneficiaries(mbis, includeSuppressed)
+}
+
+// GetNewlyAttributedBeneficiaries retrieves the beneficiaries attributed to the ACO by its latest CCLF8 file who were
+// not in its CCLF8 file before that.  If the latest file is the first of its performance year, every beneficiary in it
+// is newly attributed.  If it attributes none newly, there are none to retrieve, which is not an error.
+func (aco *ACO) GetNewlyAttributedBeneficiaries(includeSuppressed bool) ([]CCLFBeneficiary, error) {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
-	var cclfFile CCLFFile
-	// todo add a filter here to make sure the file is up to date.
-	if db.Where("aco_cms_id = ? and cclf_num = 8 and import_status= ?", aco.CMSID, constants.ImportComplete).Order("timestamp desc").First(&cclfFile).RecordNotFound() {
-		log.Errorf("Unable to find CCLF8 File for ACO: %v", *aco.CMSID)
-		return cclfBeneficiaries, fmt.Errorf("unable to find cclfFile")
+	cclfFile, err := aco.getLatestCCLF8File(db)
+	if err != nil {
+		return nil, err
 	}
 
-	var suppressedBBIDs []string
+	if cclfFile.PreviousFileID == 0 {
+		return aco.getBeneficiaries(nil, includeSuppressed)
+	}
+	// matched in the database, since an ACO's churn may be more MBIs than a query can take as parameters
+	query := db.Where(`file_id = ? and mbi in (select mbi from cclf_attribution_changes
+		where file_id = ? and change_type = ? and deleted_at is null)`, cclfFile.ID, cclfFile.ID, AttributionAdded)
+	return aco.findBeneficiaries(db, query, includeSuppressed)
+}
 
-	if !includeSuppressed {
-		suppressedBBIDs = GetSuppressedBlueButtonIDs(db)
+func (aco *ACO) getBeneficiaries(mbis []string, includeSuppressed bool) ([]CCLFBeneficiary, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+	cclfFile, err := aco.getLatestCCLF8File(db)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
-	if suppressedBBIDs != nil {
-		err = db.Not("blue_button_id", suppressedBBIDs).Find(&cclfBeneficiaries, "file_id = ?", cclfFile.ID).Error
-	} else {
-		err = db.Find(&cclfBeneficiaries, "file_id = ?", cclfFile.ID).Error
+	query := db.Where("file_id = ?", cclfFile.ID)
+	if mbis != nil {
+		query = query.Where("mbi in (?)", mbis)
 	}
 
+	cclfBeneficiaries, err := aco.findBeneficiaries(db, query, includeSuppressed)
 	if err != nil {
-		log.Errorf("Error retrieving beneficiaries from latest CCLF8 file for ACO ID %s: %s", aco.UUID.String(), err.Error())
 		return nil, err
 	} else if len(cclfBeneficiaries) == 0 {
 		log.Errorf("Found 0 beneficiaries from latest CCLF8 file for ACO ID %s", aco.UUID.String())
@@ -268,6 +745,89 @@ func (aco *ACO) GetBeneficiaries(includeSuppressed bool) ([]CCLFBeneficiary, err
 	return cclfBeneficiaries, nil
 }
 
+// findBeneficiaries retrieves the beneficiaries that query matches, leaving out those who have opted out of data
+// sharing unless includeSuppressed.
+func (aco *ACO) findBeneficiaries(db *gorm.DB, query *gorm.DB, includeSuppressed bool) ([]CCLFBeneficiary, error) {
+	var cclfBeneficiaries []CCLFBeneficiary
+
+	if !includeSuppressed {
+		if suppressedBBIDs := GetSuppressedBlueButtonIDs(db); suppressedBBIDs != nil {
+			// beneficiaries whose Blue Button IDs have not been looked up yet cannot be suppressed
+			query = query.Where("blue_button_id is null or blue_button_id not in (?)", suppressedBBIDs)
+		}
+	}
+
+	// ordered so that a job's chunks are the same each time they are generated
+	err := query.Order("id").Find(&cclfBeneficiaries).Error
+	if err != nil {
+		log.Errorf("Error retrieving beneficiaries from latest CCLF8 file for ACO ID %s: %s", aco.UUID.String(), err.Error())
+		return nil, err
+	}
+
+	return cclfBeneficiaries, nil
+}
+
+// ErrNoCCLF8File is returned when an ACO has no imported CCLF8 file attributing beneficiaries to it.
+var ErrNoCCLF8File = errors.New("unable to find cclfFile")
+
+func (aco *ACO) getLatestCCLF8File(db *gorm.DB) (CCLFFile, error) {
+	var cclfFile CCLFFile
+
+	if aco.CMSID == nil {
+		log.Errorf("No CMSID set for ACO: %s", aco.UUID)
+		return cclfFile, ErrNoCCLF8File
+	}
+	// todo add a filter here to make sure the file is up to date.
+	err := db.Where("aco_cms_id = ? and cclf_num = 8 and import_status= ?", aco.CMSID, constants.ImportComplete).Order("timestamp desc").First(&cclfFile).Error
+	if gorm.IsRecordNotFoundError(err) {
+		log.Errorf("Unable to find CCLF8 File for ACO: %v", *aco.CMSID)
+		return cclfFile, ErrNoCCLF8File
+	}
+	if err != nil {
+		return cclfFile, errors.Wrapf(err, "cannot retrieve latest CCLF8 file for ACO %s", *aco.CMSID)
+	}
+	return cclfFile, nil
+}
+
+// AttributionChanges are the beneficiaries, identified by MBI, added to and dropped from an ACO by a CCLF8 file.
+type AttributionChanges struct {
+	File CCLFFile
+	// the ACO's CCLF8 file before File, or nil if File is the first of its performance year
+	PreviousFile *CCLFFile
+	Added        []string
+	Dropped      []string
+}
+
+// GetAttributionChanges returns the changes to the ACO's attribution made by its latest CCLF8 file.
+func (aco *ACO) GetAttributionChanges() (AttributionChanges, error) {
+	var changes AttributionChanges
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+	cclfFile, err := aco.getLatestCCLF8File(db)
+	if err != nil {
+		return changes, err
+	}
+	changes.File = cclfFile
+
+	if cclfFile.PreviousFileID == 0 {
+		return changes, nil
+	}
+	var prev CCLFFile
+	if err = db.First(&prev, cclfFile.PreviousFileID).Error; err != nil {
+		return changes, errors.Wrapf(err, "cannot find CCLF8 file before %s", cclfFile.Name)
+	}
+	changes.PreviousFile = &prev
+
+	for changeType, mbis := range map[string]*[]string{AttributionAdded: &changes.Added, AttributionDropped: &changes.Dropped} {
+		err = db.Model(&CCLFAttributionChange{}).Where("file_id = ? and change_type = ?", cclfFile.ID, changeType).Order("mbi").Pluck("mbi", mbis).Error
+		if err != nil {
+			return changes, errors.Wrapf(err, "cannot retrieve attribution changes for CCLF8 file %s", cclfFile.Name)
+		}
+	}
+	return changes, nil
+}
+
 func GetSuppressedBlueButtonIDs(db *gorm.DB) []string {
 
 	var suppressedBBIDs []string
@@ -289,12 +849,84 @@ type CCLFBeneficiaryXref struct {
 	gorm.Model
 	FileID        uint   `gorm:"not null"`
 	XrefIndicator string `json:"xref_indicator"`
-	CurrentNum    string `json:"current_number"`
+	CurrentNum    string `gorm:"index:idx_cclf_beneficiary_xrefs_current_num" json:"current_number"`
 	PrevNum       string `json:"previous_number"`
 	PrevsEfctDt   string `json:"effective_date"`
 	PrevsObsltDt  string `json:"obsolete_date"`
 }
 
+// BeneficiaryGroup is a named set of beneficiaries, identified by MBI, that an ACO can export with
+// Group/{groupId}/$export. Members are matched against the ACO's latest CCLF8 file when the export is requested.
+type BeneficiaryGroup struct {
+	gorm.Model
+	ACOID   uuid.UUID                `gorm:"type:uuid;not null;unique_index:idx_beneficiary_groups_aco_group" json:"aco_id"`
+	GroupID string                   `gorm:"not null;unique_index:idx_beneficiary_groups_aco_group" json:"group_id"`
+	Name    string                   `json:"name"`
+	Members []BeneficiaryGroupMember `json:"members"`
+}
+
+type BeneficiaryGroupMember struct {
+	gorm.Model
+	BeneficiaryGroupID uint   `gorm:"not null;index:idx_beneficiary_group_members_group_id"`
+	MBI                string `gorm:"type:char(11);not null"`
+}
+
+// CreateBeneficiaryGroup saves a group of beneficiaries for the ACO. The group identifier must be unique for the ACO
+// and may not be one of the reserved identifiers "all" and "new".
+func CreateBeneficiaryGroup(acoID uuid.UUID, groupID, name string, mbis []string) (BeneficiaryGroup, error) {
+	group := BeneficiaryGroup{ACOID: acoID, GroupID: groupID, Name: name}
+
+	if groupID == "" {
+		return group, errors.New("group ID is required")
+	}
+	if groupID == GroupAll || groupID == GroupNewlyAttributed {
+		return group, fmt.Errorf("group ID %s is reserved", groupID)
+	}
+	if len(mbis) == 0 {
+		return group, errors.New("at least one MBI is required")
+	}
+
+	for _, mbi := range mbis {
+		group.Members = append(group.Members, BeneficiaryGroupMember{MBI: mbi})
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	err := db.Create(&group).Error
+	if err != nil {
+		return group, errors.Wrapf(err, "cannot create group %s for ACO %s", groupID, acoID.String())
+	}
+
+	return group, nil
+}
+
+// GetBeneficiaryGroup retrieves the ACO's group with the given identifier.  If the ACO has no such group, the error is
+// gorm.ErrRecordNotFound.
+func GetBeneficiaryGroup(acoID, groupID string) (BeneficiaryGroup, error) {
+	var group BeneficiaryGroup
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	err := db.First(&group, "aco_id = ? and group_id = ?", acoID, groupID).Error
+	return group, err
+}
+
+// GetMemberMBIs returns the MBIs of every member of the group.
+func (group *BeneficiaryGroup) GetMemberMBIs() ([]string, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var mbis []string
+	err := db.Model(&BeneficiaryGroupMember{}).Where("beneficiary_group_id = ?", group.ID).Pluck("mbi", &mbis).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return mbis, nil
+}
+
 // GetPublicKey returns the ACO's public key.
 func (aco *ACO) GetPublicKey() (*rsa.PublicKey, error) {
 	var key string
@@ -398,6 +1030,34 @@ type CCLFFile struct {
 	Timestamp       time.Time `gorm:"not null"`
 	PerformanceYear int       `gorm:"not null"`
 	ImportStatus    string    `gorm:"column:import_status"`
+	PreviousFileID  uint      // CCLF8 file whose beneficiaries the file's attribution changes are from; zero if there is none
+}
+
+// RecordAttributionChanges records the beneficiaries added to and dropped from the ACO by a CCLF8 file, compared by MBI
+// with the ACO's latest completed CCLF8 file before it for the same performance year.  The first file of a performance
+// year has no changes.
+func (cclfFile *CCLFFile) RecordAttributionChanges(db *gorm.DB) error {
+	var prev CCLFFile
+	err := db.Where("aco_cms_id = ? and cclf_num = 8 and performance_year = ? and import_status = ? and timestamp < ?",
+		cclfFile.ACOCMSID, cclfFile.PerformanceYear, constants.ImportComplete, cclfFile.Timestamp).Order("timestamp desc").First(&prev).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = db.Model(cclfFile).Update("previous_file_id", prev.ID).Error; err != nil {
+		return err
+	}
+
+	// a beneficiary is added if they are in this file and not the one before, and dropped if the reverse
+	const insertChanges = `insert into cclf_attribution_changes (created_at, updated_at, file_id, change_type, mbi, hicn)
+		select distinct now(), now(), ?, ?, b.mbi, b.hicn from cclf_beneficiaries b
+		where b.file_id = ? and not exists (select 1 from cclf_beneficiaries o where o.file_id = ? and o.mbi = b.mbi)`
+	if err = db.Exec(insertChanges, cclfFile.ID, AttributionAdded, cclfFile.ID, prev.ID).Error; err != nil {
+		return err
+	}
+	return db.Exec(insertChanges, cclfFile.ID, AttributionDropped, prev.ID, cclfFile.ID).Error
 }
 
 func (cclfFile *CCLFFile) Delete() error {
@@ -407,6 +1067,14 @@ func (cclfFile *CCLFFile) Delete() error {
 	if err != nil {
 		return err
 	}
+	err = db.Unscoped().Where("file_id = ?", cclfFile.ID).Delete(&CCLFBeneficiaryXref{}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Unscoped().Where("file_id = ?", cclfFile.ID).Delete(&CCLFAttributionChange{}).Error
+	if err != nil {
+		return err
+	}
 	return db.Unscoped().Delete(&cclfFile).Error
 }
 
@@ -421,6 +1089,15 @@ type CCLFBeneficiary struct {
 	BlueButtonID string `gorm:"type: text;index:idx_cclf_beneficiaries_bb_id"`
 }
 
+// CCLFAttributionChange is a beneficiary added to or dropped from an ACO by a CCLF8 file.
+type CCLFAttributionChange struct {
+	gorm.Model
+	FileID     uint   `gorm:"not null;index:idx_cclf_attribution_changes_file_id"`
+	ChangeType string `gorm:"not null"` // AttributionAdded or AttributionDropped
+	MBI        string `gorm:"type:char(11);not null"`
+	HICN       string `gorm:"type:varchar(11)"`
+}
+
 type SuppressionFile struct {
 	gorm.Model
 	Name         string    `gorm:"not null;unique"`
@@ -465,10 +1142,60 @@ func (cclfBeneficiary *CCLFBeneficiary) GetBlueButtonID(bb client.APIClient) (bl
 	}
 
 	blueButtonID, err = GetBlueButtonID(bb, modelIdentifier, patientIdMode, "beneficiary", cclfBeneficiary.ID)
-	if err != nil {
+	if _, notFound := err.(patientNotFoundError); !notFound {
+		return blueButtonID, err
+	}
+
+	// The beneficiary's identifier may have changed since Blue Button last heard of it.  A Blue Button ID already found
+	// for the beneficiary is still theirs; otherwise the identifiers CCLF9 files say they had before are tried.
+	if cclfBeneficiary.BlueButtonID != "" {
+		log.Infof("Using stored Blue Button ID for CCLF beneficiary ID: %v", cclfBeneficiary.ID)
+		return cclfBeneficiary.BlueButtonID, nil
+	}
+	prevIdentifiers, xrefErr := previousIdentifiers(modelIdentifier, patientIdMode)
+	if xrefErr != nil {
+		log.Error(xrefErr)
 		return "", err
 	}
-	return blueButtonID, nil
+	for _, prevIdentifier := range prevIdentifiers {
+		prevBlueButtonID, prevErr := GetBlueButtonID(bb, prevIdentifier, patientIdMode, "beneficiary", cclfBeneficiary.ID)
+		if prevErr == nil {
+			log.Infof("Found Blue Button ID for CCLF beneficiary ID: %v by a previous identifier", cclfBeneficiary.ID)
+			return prevBlueButtonID, nil
+		}
+		// Only a missing patient is worth trying the next identifier for; Blue Button failing is reported as it is
+		if _, notFound := prevErr.(patientNotFoundError); !notFound {
+			return "", prevErr
+		}
+	}
+	return "", err
+}
+
+// previousIdentifiers returns the identifiers that CCLF9 files list as having been replaced by identifier, most recent
+// first.
+func previousIdentifiers(identifier, patientIdMode string) ([]string, error) {
+	xrefIndicator := "H"
+	if patientIdMode == "MBI_MODE" {
+		xrefIndicator = "M"
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var xrefs []CCLFBeneficiaryXref
+	err := db.Select("prev_num").Where("current_num = ? and xref_indicator = ?", identifier, xrefIndicator).
+		Order("prevs_efct_dt desc").Find(&xrefs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var prevIdentifiers []string
+	for _, xref := range xrefs {
+		if xref.PrevNum != "" && xref.PrevNum != identifier && !utils.ContainsString(prevIdentifiers, xref.PrevNum) {
+			prevIdentifiers = append(prevIdentifiers, xref.PrevNum)
+		}
+	}
+	return prevIdentifiers, nil
 }
 
 // This method will ensure that a valid BlueButton ID is returned.
@@ -496,12 +1223,12 @@ func GetBlueButtonID(bb client.APIClient, modelIdentifier, patientIdMode, reqTyp
 	hashedIdentifier := client.HashIdentifier(modelIdentifier)
 
 	// until NGD supports MBI, pass in the patientIdMode
-	jsonData, err := bb.GetPatientByIdentifierHash(hashedIdentifier, patientIdMode)
+	patientData, err := bb.GetPatientByIdentifierHash(hashedIdentifier, patientIdMode)
 	if err != nil {
 		return "", err
 	}
 	var patient Patient
-	err = json.Unmarshal([]byte(jsonData), &patient)
+	err = json.NewDecoder(patientData).Decode(&patient)
 	if err != nil {
 		log.Error(err)
 		return "", err
@@ -509,7 +1236,7 @@ func GetBlueButtonID(bb client.APIClient, modelIdentifier, patientIdMode, reqTyp
 
 	if len(patient.Entry) == 0 {
 
-		err = fmt.Errorf("patient identifier not found at Blue Button for CCLF %s ID: %v", reqType, modelID)
+		err = patientNotFoundError{reqType: reqType, modelID: modelID}
 
 		log.Error(err)
 		return "", err
@@ -548,6 +1275,16 @@ func GetBlueButtonID(bb client.APIClient, modelIdentifier, patientIdMode, reqTyp
 	return blueButtonID, nil
 }
 
+// patientNotFoundError reports that Blue Button has no patient with an identifier.
+type patientNotFoundError struct {
+	reqType string
+	modelID uint
+}
+
+func (e patientNotFoundError) Error() string {
+	return fmt.Sprintf("patient identifier not found at Blue Button for CCLF %s ID: %v", e.reqType, e.modelID)
+}
+
 // StoreSuppressionBBID stores the suppression beneficiary's Blue Button ID
 // the ID value is retrieved from BB and saved.
 func StoreSuppressionBBID() (success, failure int, err error) {
@@ -591,4 +1328,8 @@ type jobEnqueueArgs struct {
 	ResourceType    string
 	Since           string
 	TransactionTime time.Time
+	OutputFormat    string
+	TypeFilter      string
+	Elements        []string
+	Chunk           int // number of the chunk among the job's chunks, starting at 1
 }
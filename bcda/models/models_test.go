@@ -6,11 +6,15 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"encoding/pem"
+	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -391,6 +395,40 @@ func (s *ModelsTestSuite) TestJobCompleted() {
 	assert.True(s.T(), completed)
 	s.db.Delete(&j)
 }
+
+func (s *ModelsTestSuite) TestJobCompleted_MoveFails() {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		s.FailNow("Failed to create directory", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer testUtils.SetAndRestoreEnvKey("FHIR_STAGING_DIR", filepath.Join(dir, "staging"))()
+	defer testUtils.SetAndRestoreEnvKey("FHIR_PAYLOAD_DIR", filepath.Join(dir, "payload"))()
+
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "In Progress",
+		JobCount:   1,
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+	err = s.db.Create(&JobKey{JobID: j.ID, FileName: "SOMETHING.ndjson"}).Error
+	assert.Nil(s.T(), err)
+
+	// a directory in the staging area cannot be moved into the job's existing payload directory
+	id := fmt.Sprint(j.ID)
+	assert.Nil(s.T(), os.MkdirAll(filepath.Join(dir, "staging", id, "nested"), os.ModePerm))
+	assert.Nil(s.T(), os.MkdirAll(filepath.Join(dir, "payload", id), os.ModePerm))
+
+	completed, err := j.CheckCompletedAndCleanup(s.db)
+	assert.NotNil(s.T(), err)
+	assert.False(s.T(), completed)
+	var saved Job
+	assert.Nil(s.T(), s.db.First(&saved, j.ID).Error)
+	assert.Equal(s.T(), "In Progress", saved.Status)
+}
+
 func (s *ModelsTestSuite) TestJobDefaultCompleted() {
 
 	// Job is completed, but no keys exist.  This is fine, it is still complete
@@ -484,6 +522,267 @@ func (s *ModelsTestSuite) TestGetEnqueJobs_AllResourcesTypes_WithSince() {
 	}
 }
 
+func (s *ModelsTestSuite) TestGetEnqueJobs_Priority() {
+	assert := s.Assert()
+
+	j := Job{
+		ACOID:      uuid.Parse(constants.DevACOUUID),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "Pending",
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	round, err := nextACORound("", constants.DevACOUUID)
+	assert.Nil(err)
+	enqueueJobs, err := j.GetEnqueJobs([]string{"Patient", "ExplanationOfBenefit", "Coverage"}, "")
+	assert.Nil(err)
+	// each chunk is queued in the round after the ACO's chunk before it
+	for i, queJob := range enqueueJobs {
+		assert.Equal(chunkPriority(round+i), queJob.Priority)
+	}
+}
+
+func (s *ModelsTestSuite) TestNextACORound() {
+	assert := s.Assert()
+	queueDB := database.GetQueueDbConnection()
+	defer queueDB.Close()
+
+	// a queue of its own keeps running workers and other tests' chunks out of the rounds
+	queue := "aco-round-robin-test"
+	defer func() {
+		_, err := queueDB.Exec(`delete from que_jobs where queue = $1`, queue)
+		assert.Nil(err)
+	}()
+	enqueue := func(acoID string, chunks int) {
+		round, err := nextACORound(queue, acoID)
+		assert.Nil(err)
+		for i := 0; i < chunks; i++ {
+			_, err = queueDB.Exec(`insert into que_jobs (queue, priority, job_class, args) values ($1, $2, 'ProcessJob', $3)`,
+				queue, chunkPriority(round+i), fmt.Sprintf(`{"ACOID":%q}`, acoID))
+			assert.Nil(err)
+		}
+	}
+	queued := func() []string {
+		rows, err := queueDB.Query(`select args->>'ACOID' from que_jobs where queue = $1 order by priority, run_at, job_id`, queue)
+		if err != nil {
+			s.FailNow("Failed to read queue", err.Error())
+		}
+		defer rows.Close()
+		var acoIDs []string
+		for rows.Next() {
+			var acoID string
+			assert.Nil(rows.Scan(&acoID))
+			acoIDs = append(acoIDs, acoID)
+		}
+		return acoIDs
+	}
+
+	acoA, acoB := uuid.New(), uuid.New()
+	enqueue(acoA, 3)
+	// A's first chunk is worked before B submits an export
+	_, err := queueDB.Exec(`delete from que_jobs where job_id = (select job_id from que_jobs where queue = $1 order by priority, run_at, job_id limit 1)`, queue)
+	assert.Nil(err)
+
+	// B takes turns with A from the round under way, rather than waiting for all of A's chunks or going ahead of them
+	enqueue(acoB, 3)
+	assert.Equal([]string{acoA, acoB, acoA, acoB, acoB}, queued())
+
+	// A's next export follows its own queued chunks
+	enqueue(acoA, 2)
+	assert.Equal([]string{acoA, acoB, acoA, acoB, acoB, acoA, acoA}, queued())
+}
+
+func (s *ModelsTestSuite) TestGetEnqueJobs_ChunkSizes() {
+	assert := s.Assert()
+
+	j := Job{
+		ACOID:      uuid.Parse(constants.DevACOUUID),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "Pending",
+		ChunkSizes: "Patient=30",
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	// the stored size is used, and the size chosen for a new resource type is stored with it
+	enqueueJobs, err := j.GetEnqueJobs([]string{"Patient", "Coverage"}, "")
+	assert.Nil(err)
+	coverageSize, err := GetChunkSize(s.db, constants.DevACOUUID, "Coverage")
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("Coverage=%d&Patient=30", coverageSize), j.ChunkSizes)
+	jobArgs := jobEnqueueArgs{}
+	assert.Nil(json.Unmarshal(enqueueJobs[0].Args, &jobArgs))
+	assert.Equal("Patient", jobArgs.ResourceType)
+	assert.Len(jobArgs.BeneficiaryIDs, 30)
+}
+
+func (s *ModelsTestSuite) TestGetChunkSize() {
+	assert := s.Assert()
+	origTarget := os.Getenv("BCDA_CHUNK_TARGET_SEC")
+	defer os.Setenv("BCDA_CHUNK_TARGET_SEC", origTarget)
+
+	acoID := uuid.NewRandom()
+	j := Job{ACOID: acoID, RequestURL: "/api/v1/Patient/$export", Status: "Completed"}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	for i := 1; i <= minChunkTimingSamples; i++ {
+		// 1000 ms per beneficiary
+		jobKey := JobKey{JobID: j.ID, FileName: fmt.Sprintf("%d.ndjson", i), ResourceType: "Coverage", Chunk: i, BeneficiaryCount: 10, DurationMS: 10000}
+		s.db.Save(&jobKey)
+		defer s.db.Unscoped().Delete(&jobKey)
+	}
+
+	// never less than the minimum
+	os.Setenv("BCDA_CHUNK_TARGET_SEC", "1")
+	size, err := GetChunkSize(s.db, acoID.String(), "Coverage")
+	assert.Nil(err)
+	assert.Equal(minChunkSize, size)
+
+	os.Setenv("BCDA_CHUNK_TARGET_SEC", "60")
+	size, err = GetChunkSize(s.db, acoID.String(), "Coverage")
+	assert.Nil(err)
+	assert.Equal(60, size)
+
+	// quick beneficiaries make chunks larger than the default, but never more than the ceiling
+	os.Setenv("BCDA_CHUNK_TARGET_SEC", "6000")
+	size, err = GetChunkSize(s.db, acoID.String(), "Coverage")
+	assert.Nil(err)
+	assert.Equal(6000, size)
+	assert.True(size > BCDA_FHIR_MAX_RECORDS_COVERAGE_DEFAULT)
+	os.Setenv("BCDA_CHUNK_MAX_SIZE", "5")
+	defer os.Unsetenv("BCDA_CHUNK_MAX_SIZE")
+	size, err = GetChunkSize(s.db, acoID.String(), "Coverage")
+	assert.Nil(err)
+	assert.Equal(5, size)
+	os.Unsetenv("BCDA_CHUNK_MAX_SIZE")
+
+	// without a target, the maximum is used
+	os.Setenv("BCDA_CHUNK_TARGET_SEC", "0")
+	size, err = GetChunkSize(s.db, acoID.String(), "Coverage")
+	assert.Nil(err)
+	assert.Equal(BCDA_FHIR_MAX_RECORDS_COVERAGE_DEFAULT, size)
+
+	_, err = GetChunkSize(s.db, acoID.String(), "Coverages")
+	assert.EqualError(err, "invalid request type")
+}
+
+func TestEstimateMSPerBeneficiary(t *testing.T) {
+	all := chunkTiming{Chunks: 100, Beneficiaries: 1000, Records: 10000, DurationMS: 100000}
+
+	// the ACO's own chunks, when there are enough of them
+	aco := chunkTiming{Chunks: minChunkTimingSamples, Beneficiaries: 30, Records: 30, DurationMS: 600}
+	assert.Equal(t, 20.0, estimateMSPerBeneficiary(aco, all))
+
+	// everyone's chunks, weighted by the data the ACO's few chunks found
+	aco = chunkTiming{Chunks: 1, Beneficiaries: 10, Records: 20, DurationMS: 0}
+	assert.Equal(t, 20.0, estimateMSPerBeneficiary(aco, all))
+	aco = chunkTiming{Chunks: 1, Beneficiaries: 10, Records: 200, DurationMS: 0}
+	assert.Equal(t, 200.0, estimateMSPerBeneficiary(aco, all))
+
+	// everyone's chunks, as they are, for an ACO without any
+	assert.Equal(t, 100.0, estimateMSPerBeneficiary(chunkTiming{}, all))
+
+	assert.Zero(t, estimateMSPerBeneficiary(chunkTiming{}, chunkTiming{Chunks: 1, Beneficiaries: 10, DurationMS: 100}))
+}
+
+func TestChunkPriority(t *testing.T) {
+	assert.Equal(t, int16(1), chunkPriority(0))
+	assert.Equal(t, int16(1), chunkPriority(1))
+	assert.Equal(t, int16(500), chunkPriority(500))
+	assert.Equal(t, int16(math.MaxInt16), chunkPriority(math.MaxInt16))
+	assert.Equal(t, int16(math.MaxInt16), chunkPriority(100000))
+}
+
+func (s *ModelsTestSuite) TestGetMissingChunks() {
+	assert := s.Assert()
+
+	j := Job{
+		ACOID:         uuid.Parse(constants.DevACOUUID),
+		RequestURL:    "/api/v1/Patient/$export",
+		Status:        "In Progress",
+		ResourceTypes: "Patient,ExplanationOfBenefit,Coverage",
+		JobCount:      3,
+	}
+	_, err := j.GetEnqueJobs(strings.Split(j.ResourceTypes, ","), "")
+	assert.Nil(err)
+	assert.NotEmpty(j.BeneficiaryDigest)
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+	jobKey := JobKey{JobID: j.ID, FileName: "patient.ndjson", ResourceType: "Patient", Chunk: 1}
+	s.db.Save(&jobKey)
+	defer s.db.Unscoped().Delete(&jobKey)
+
+	missing, err := j.GetMissingChunks(s.db)
+	assert.Nil(err)
+	assert.Len(missing, 2)
+	var resourceTypes []string
+	for i, queJob := range missing {
+		jobArgs := jobEnqueueArgs{}
+		assert.Nil(json.Unmarshal(queJob.Args, &jobArgs))
+		assert.Equal(i+2, jobArgs.Chunk)
+		resourceTypes = append(resourceTypes, jobArgs.ResourceType)
+	}
+	assert.Equal([]string{"ExplanationOfBenefit", "Coverage"}, resourceTypes)
+
+	// chunks regenerated from a different set of beneficiaries would export different beneficiaries than the originals
+	enqueuedDigest := j.BeneficiaryDigest
+	j.BeneficiaryDigest = beneficiaryDigest(nil)
+	_, err = j.GetMissingChunks(s.db)
+	assert.EqualError(err, "job's beneficiaries have changed since its chunks were enqueued")
+	j.BeneficiaryDigest = ""
+	_, err = j.GetMissingChunks(s.db)
+	assert.EqualError(err, "job does not record the beneficiaries it exports")
+	j.BeneficiaryDigest = enqueuedDigest
+
+	// the ACO's beneficiaries no longer make the same chunks
+	j.JobCount = 4
+	_, err = j.GetMissingChunks(s.db)
+	assert.EqualError(err, "job had 4 chunks, but its beneficiaries now make 3")
+
+	// files from before chunks were numbered can't be matched to chunks
+	j.JobCount = 3
+	legacyKey := JobKey{JobID: j.ID, FileName: "eob.ndjson", ResourceType: "ExplanationOfBenefit"}
+	s.db.Save(&legacyKey)
+	defer s.db.Unscoped().Delete(&legacyKey)
+	_, err = j.GetMissingChunks(s.db)
+	assert.NotNil(err)
+
+	j.ResourceTypes = ""
+	_, err = j.GetMissingChunks(s.db)
+	assert.EqualError(err, "job does not record the resource types it exports")
+}
+
+func (s *ModelsTestSuite) TestGetEnqueJobs_TypeFilter() {
+	assert := s.Assert()
+
+	j := Job{
+		ACOID:      uuid.Parse(constants.DevACOUUID),
+		RequestURL: "/api/v1/Patient/$export?_typeFilter=ExplanationOfBenefit%3Ftype%3Dcarrier%2Cinpatient",
+		Status:     "Pending",
+		TypeFilter: "ExplanationOfBenefit=type%3Dcarrier%252Cinpatient",
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	enqueueJobs, err := j.GetEnqueJobs([]string{"ExplanationOfBenefit", "Coverage"}, "")
+	assert.Nil(err)
+	assert.Equal(2, len(enqueueJobs))
+	for _, queJob := range enqueueJobs {
+		jobArgs := jobEnqueueArgs{}
+		err := json.Unmarshal(queJob.Args, &jobArgs)
+		if err != nil {
+			s.T().Error(err)
+		}
+		if jobArgs.ResourceType == "ExplanationOfBenefit" {
+			assert.Equal("type=carrier%2Cinpatient", jobArgs.TypeFilter)
+		} else {
+			assert.Equal("", jobArgs.TypeFilter)
+		}
+	}
+}
+
 func (s *ModelsTestSuite) TestGetEnqueJobs_Patient() {
 	assert := s.Assert()
 
@@ -591,6 +890,64 @@ func (s *ModelsTestSuite) TestGetEnqueJobs_Coverage() {
 	os.Unsetenv("BCDA_FHIR_MAX_RECORDS_COVERAGE")
 }
 
+func (s *ModelsTestSuite) TestGetEnqueJobs_Group() {
+	assert := s.Assert()
+
+	var aco ACO
+	err := s.db.Find(&aco, "UUID = ?", uuid.Parse(constants.DevACOUUID)).Error
+	assert.Nil(err)
+	beneficiaries, err := aco.GetBeneficiaries(true)
+	assert.Nil(err)
+
+	mbis := []string{beneficiaries[0].MBI, beneficiaries[1].MBI, beneficiaries[2].MBI, "NOTATTRIBTD"}
+	group, err := CreateBeneficiaryGroup(aco.UUID, "unit-test-cohort", "Unit Test Cohort", mbis)
+	assert.Nil(err)
+	defer s.db.Unscoped().Where("beneficiary_group_id = ?", group.ID).Delete(&BeneficiaryGroupMember{})
+	defer s.db.Unscoped().Delete(&group)
+
+	j := Job{
+		ACOID:      aco.UUID,
+		RequestURL: "/api/v1/Group/unit-test-cohort/$export?_type=Patient",
+		Status:     "Pending",
+		GroupID:    "unit-test-cohort",
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	enqueueJobs, err := j.GetEnqueJobs([]string{"Patient"}, "")
+	assert.Nil(err)
+	assert.Equal(1, len(enqueueJobs))
+
+	jobArgs := jobEnqueueArgs{}
+	err = json.Unmarshal(enqueueJobs[0].Args, &jobArgs)
+	assert.Nil(err)
+	// The unattributed MBI is left out
+	assert.Equal(3, len(jobArgs.BeneficiaryIDs))
+
+	// Unknown group
+	j.GroupID = "no-such-group"
+	enqueueJobs, err = j.GetEnqueJobs([]string{"Patient"}, "")
+	assert.Nil(enqueueJobs)
+	assert.EqualError(err, "no group no-such-group found for ACO ID "+aco.UUID.String())
+}
+
+func (s *ModelsTestSuite) TestCreateBeneficiaryGroup_Invalid() {
+	assert := s.Assert()
+	acoUUID := uuid.Parse(constants.DevACOUUID)
+
+	_, err := CreateBeneficiaryGroup(acoUUID, "", "No ID", []string{"1A00A00AA00"})
+	assert.EqualError(err, "group ID is required")
+
+	_, err = CreateBeneficiaryGroup(acoUUID, GroupAll, "Reserved", []string{"1A00A00AA00"})
+	assert.EqualError(err, "group ID all is reserved")
+
+	_, err = CreateBeneficiaryGroup(acoUUID, GroupNewlyAttributed, "Reserved", []string{"1A00A00AA00"})
+	assert.EqualError(err, "group ID new is reserved")
+
+	_, err = CreateBeneficiaryGroup(acoUUID, "empty", "Empty", nil)
+	assert.EqualError(err, "at least one MBI is required")
+}
+
 func (s *ModelsTestSuite) TestJobStatusMessage() {
 	j := Job{Status: "In Progress", JobCount: 25, CompletedJobCount: 6}
 	assert.Equal(s.T(), "In Progress (24%)", j.StatusMessage())
@@ -602,6 +959,19 @@ func (s *ModelsTestSuite) TestJobStatusMessage() {
 	assert.Equal(s.T(), "Completed", j.StatusMessage())
 }
 
+func (s *ModelsTestSuite) TestJobGetElements() {
+	j := Job{}
+	assert.Nil(s.T(), j.GetElements("Patient"))
+
+	j = Job{Elements: "id,ExplanationOfBenefit.type,ExplanationOfBenefit.status,Patient.name,id"}
+	assert.Equal(s.T(), []string{"id", "type", "status"}, j.GetElements("ExplanationOfBenefit"))
+	assert.Equal(s.T(), []string{"id", "name"}, j.GetElements("Patient"))
+	assert.Equal(s.T(), []string{"id"}, j.GetElements("Coverage"))
+
+	j = Job{Elements: "Patient.name"}
+	assert.Nil(s.T(), j.GetElements("Coverage"))
+}
+
 func (s *ModelsTestSuite) TestGetMaxBeneCount() {
 	assert := s.Assert()
 
@@ -753,6 +1123,78 @@ func (s *ModelsTestSuite) TestGetBeneficiaries_DuringETL() {
 	assert.Equal(s.T(), cclfFile.ID, result[0].FileID)
 }
 
+func (s *ModelsTestSuite) TestRecordAttributionChanges() {
+	assert := s.Assert()
+	acoCMSID := "T0009"
+	aco := ACO{UUID: uuid.NewRandom(), CMSID: &acoCMSID}
+	err := s.db.Save(&aco).Error
+	if err != nil {
+		s.FailNow("Failed to save ACO", err.Error())
+	}
+	defer s.db.Unscoped().Delete(&aco)
+
+	saveFile := func(timestamp time.Time, mbis ...string) *CCLFFile {
+		cclfFile := &CCLFFile{CCLFNum: 8, Name: uuid.New(), ACOCMSID: acoCMSID, Timestamp: timestamp, PerformanceYear: 19, ImportStatus: constants.ImportComplete}
+		if err := s.db.Save(cclfFile).Error; err != nil {
+			s.FailNow("Failed to save CCLF file", err.Error())
+		}
+		for _, mbi := range mbis {
+			if err := s.db.Save(&CCLFBeneficiary{FileID: cclfFile.ID, MBI: mbi, HICN: mbi}).Error; err != nil {
+				s.FailNow("Failed to save beneficiary", err.Error())
+			}
+		}
+		return cclfFile
+	}
+
+	_, err = aco.GetAttributionChanges()
+	assert.Equal(ErrNoCCLF8File, err)
+
+	// the first file of the performance year has no changes, and all of its beneficiaries are newly attributed
+	file1 := saveFile(time.Now().Add(-48*time.Hour), "1A00A00AA01", "1A00A00AA02", "1A00A00AA03")
+	defer file1.Delete()
+	assert.Nil(file1.RecordAttributionChanges(s.db))
+	assert.Zero(file1.PreviousFileID)
+
+	changes, err := aco.GetAttributionChanges()
+	assert.Nil(err)
+	assert.Equal(file1.ID, changes.File.ID)
+	assert.Nil(changes.PreviousFile)
+	assert.Empty(changes.Added)
+	assert.Empty(changes.Dropped)
+	beneficiaries, err := aco.GetNewlyAttributedBeneficiaries(true)
+	assert.Nil(err)
+	assert.Len(beneficiaries, 3)
+
+	file2 := saveFile(time.Now().Add(-24*time.Hour), "1A00A00AA02", "1A00A00AA03", "1A00A00AA04", "1A00A00AA05")
+	defer file2.Delete()
+	assert.Nil(file2.RecordAttributionChanges(s.db))
+	assert.Equal(file1.ID, file2.PreviousFileID)
+
+	changes, err = aco.GetAttributionChanges()
+	assert.Nil(err)
+	assert.Equal(file2.ID, changes.File.ID)
+	assert.Equal(file1.ID, changes.PreviousFile.ID)
+	assert.Equal([]string{"1A00A00AA04", "1A00A00AA05"}, changes.Added)
+	assert.Equal([]string{"1A00A00AA01"}, changes.Dropped)
+
+	beneficiaries, err = aco.GetNewlyAttributedBeneficiaries(true)
+	assert.Nil(err)
+	assert.Len(beneficiaries, 2)
+	for _, b := range beneficiaries {
+		assert.Equal(file2.ID, b.FileID)
+		assert.Contains(changes.Added, b.MBI)
+	}
+
+	// a file with the same beneficiaries attributes none newly
+	file3 := saveFile(time.Now(), "1A00A00AA02", "1A00A00AA03", "1A00A00AA04", "1A00A00AA05")
+	defer file3.Delete()
+	assert.Nil(file3.RecordAttributionChanges(s.db))
+	assert.Equal(file2.ID, file3.PreviousFileID)
+	beneficiaries, err = aco.GetNewlyAttributedBeneficiaries(true)
+	assert.Nil(err)
+	assert.Empty(beneficiaries)
+}
+
 func (s *ModelsTestSuite) TestGetBeneficiaries_Unsuppressed() {
 	acoCMSID := "T0000"
 	aco := ACO{UUID: uuid.NewRandom(), CMSID: &acoCMSID}
@@ -983,6 +1425,82 @@ func (s *ModelsTestSuite) TestGetBlueButtonID_CCLFBeneficiary() {
 	os.Unsetenv("PATIENT_IDENTIFIER_MODE")
 }
 
+func (s *ModelsTestSuite) TestGetBlueButtonID_CCLFBeneficiaryPreviousMBI() {
+	assert := s.Assert()
+	origMode := os.Getenv("PATIENT_IDENTIFIER_MODE")
+	defer os.Setenv("PATIENT_IDENTIFIER_MODE", origMode)
+	os.Setenv("PATIENT_IDENTIFIER_MODE", "MBI_MODE")
+
+	cclfFile := CCLFFile{CCLFNum: 9, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.BCD.A0001.ZC9Y19.D191120.T1000010"}
+	assert.Nil(s.db.Create(&cclfFile).Error)
+	defer func() {
+		assert.Nil(cclfFile.Delete())
+	}()
+	for _, xref := range []CCLFBeneficiaryXref{
+		{FileID: cclfFile.ID, XrefIndicator: "M", CurrentNum: "NEWMBI00001", PrevNum: "OLDMBI00001", PrevsEfctDt: "2017-01-01", PrevsObsltDt: "2018-12-31"},
+		{FileID: cclfFile.ID, XrefIndicator: "M", CurrentNum: "NEWMBI00001", PrevNum: "OLDMBI00002", PrevsEfctDt: "2019-01-01", PrevsObsltDt: "2019-06-30"},
+		// HICN cross-references aren't tried in MBI mode
+		{FileID: cclfFile.ID, XrefIndicator: "H", CurrentNum: "NEWMBI00001", PrevNum: "OLDHICN0001", PrevsEfctDt: "2019-01-01"},
+	} {
+		assert.Nil(s.db.Create(&xref).Error)
+	}
+
+	notFound := `{"resourceType":"Bundle","total":0}`
+	cclfBeneficiary := CCLFBeneficiary{HICN: "HICN", MBI: "NEWMBI00001"}
+	prevMBI := "OLDMBI00001"
+	bbc := testUtils.BlueButtonClient{}
+	bbc.MBI = &prevMBI
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("NEWMBI00001"), "MBI_MODE").Return(notFound, nil)
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("OLDMBI00002"), "MBI_MODE").Return(notFound, nil)
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("OLDMBI00001"), "MBI_MODE").Return(bbc.GetData("Patient", "BB_VALUE"))
+
+	// the most recent previous MBI is tried first
+	blueButtonID, err := cclfBeneficiary.GetBlueButtonID(&bbc)
+	assert.Nil(err)
+	assert.Equal("BB_VALUE", blueButtonID)
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 3)
+
+	// once a Blue Button ID has been stored for the beneficiary, it is used without trying previous MBIs again
+	cclfBeneficiary.BlueButtonID = "BB_VALUE"
+	blueButtonID, err = cclfBeneficiary.GetBlueButtonID(&bbc)
+	assert.Nil(err)
+	assert.Equal("BB_VALUE", blueButtonID)
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 4)
+
+	// a beneficiary with no previous MBIs is still not found
+	cclfBeneficiary = CCLFBeneficiary{HICN: "HICN", MBI: "OLDMBI00002"}
+	_, err = cclfBeneficiary.GetBlueButtonID(&bbc)
+	assert.EqualError(err, "patient identifier not found at Blue Button for CCLF beneficiary ID: 0")
+}
+
+func (s *ModelsTestSuite) TestGetBlueButtonID_CCLFBeneficiaryPreviousMBIUnavailable() {
+	assert := s.Assert()
+	origMode := os.Getenv("PATIENT_IDENTIFIER_MODE")
+	defer os.Setenv("PATIENT_IDENTIFIER_MODE", origMode)
+	os.Setenv("PATIENT_IDENTIFIER_MODE", "MBI_MODE")
+
+	cclfFile := CCLFFile{CCLFNum: 9, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.BCD.A0001.ZC9Y19.D191120.T1000011"}
+	assert.Nil(s.db.Create(&cclfFile).Error)
+	defer func() {
+		assert.Nil(cclfFile.Delete())
+	}()
+	for _, xref := range []CCLFBeneficiaryXref{
+		{FileID: cclfFile.ID, XrefIndicator: "M", CurrentNum: "NEWMBI00002", PrevNum: "OLDMBI00003", PrevsEfctDt: "2017-01-01"},
+		{FileID: cclfFile.ID, XrefIndicator: "M", CurrentNum: "NEWMBI00002", PrevNum: "OLDMBI00004", PrevsEfctDt: "2019-01-01"},
+	} {
+		assert.Nil(s.db.Create(&xref).Error)
+	}
+
+	// Blue Button failing on a previous MBI is reported rather than trying the next one
+	bbc := testUtils.BlueButtonClient{}
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("NEWMBI00002"), "MBI_MODE").Return(`{"resourceType":"Bundle","total":0}`, nil)
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("OLDMBI00004"), "MBI_MODE").Return("", client.ErrCircuitOpen)
+	cclfBeneficiary := CCLFBeneficiary{HICN: "HICN", MBI: "NEWMBI00002"}
+	_, err := cclfBeneficiary.GetBlueButtonID(&bbc)
+	assert.Equal(client.ErrCircuitOpen, err)
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 2)
+}
+
 func (s *ModelsTestSuite) TestGetBlueButtonID_Suppression() {
 	assert := s.Assert()
 	suppressBene := Suppression{HICN: "HASH_ME"}
@@ -0,0 +1,92 @@
+package responseutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	fhirmodels "github.com/eug48/fhir/models"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+)
+
+// IDs of the OperationDefinitions for the export operations, as served under /api/v1/OperationDefinition
+const (
+	PatientExportOperation = "patient-export"
+	GroupExportOperation   = "group-export"
+)
+
+// CreateOperationDefinition returns the OperationDefinition with the given ID, or nil if there is none.
+func CreateOperationDefinition(id string, reldate time.Time, relversion, baseurl string) *fhirmodels.OperationDefinition {
+	yes, no := true, false
+	definition := &fhirmodels.OperationDefinition{
+		Url:       baseurl + "/api/v1/OperationDefinition/" + id,
+		Version:   relversion,
+		Status:    "active",
+		Kind:      "operation",
+		Date:      &fhirmodels.FHIRDateTime{Time: reldate, Precision: fhirmodels.Date},
+		Publisher: "Centers for Medicare & Medicaid Services",
+		Code:      "export",
+		System:    &no,
+		Parameter: exportParameters(),
+	}
+	definition.Id = id
+
+	switch id {
+	case PatientExportOperation:
+		definition.Name = "BCDA Patient Export"
+		definition.Description = "Export data for all of the ACO's beneficiaries. The response is 202 Accepted with the job status URL in Content-Location."
+		definition.Resource = []string{"Patient"}
+		definition.Type = &yes
+		definition.Instance = &no
+	case GroupExportOperation:
+		definition.Name = "BCDA Group Export"
+		definition.Description = "Export data for the beneficiaries in a group: all for every beneficiary attributed to the ACO, new for the beneficiaries newly attributed by the ACO's latest attribution file, or the ID of a beneficiary group. The response is 202 Accepted with the job status URL in Content-Location."
+		definition.Resource = []string{"Group"}
+		definition.Type = &no
+		definition.Instance = &yes
+	default:
+		return nil
+	}
+
+	return definition
+}
+
+// exportParameters describes the parameters accepted by both export operations.
+func exportParameters() []fhirmodels.OperationDefinitionParameterComponent {
+	var min int32
+	param := func(name, paramType, documentation string) fhirmodels.OperationDefinitionParameterComponent {
+		return fhirmodels.OperationDefinitionParameterComponent{
+			Name:          name,
+			Use:           "in",
+			Min:           &min,
+			Max:           "1",
+			Type:          paramType,
+			Documentation: documentation,
+		}
+	}
+
+	return []fhirmodels.OperationDefinitionParameterComponent{
+		param("_outputFormat", "string", fmt.Sprintf("Format of the generated files: %s (the default; application/ndjson and ndjson are accepted as synonyms) or %s for gzip-compressed NDJSON.", constants.FHIRNDJSON, constants.GzipFHIRNDJSON)),
+		param("_since", "instant", "Only include resources updated at or after this time, in FHIR instant format."),
+		param("_type", "string", fmt.Sprintf("Comma-separated resource types to export: %s. All are exported by default.", strings.Join(constants.ExportResourceTypes, ", "))),
+		param("_typeFilter", "string", "Comma-separated FHIR search queries that narrow the exported resources, e.g. ExplanationOfBenefit?type=carrier,inpatient."),
+		param("_elements", "string", "Comma-separated root elements to include in each resource, optionally prefixed by resource type. Trimmed resources are tagged SUBSETTED."),
+	}
+}
+
+func WriteOperationDefinition(definition *fhirmodels.OperationDefinition, w http.ResponseWriter) {
+	definitionJSON, err := json.Marshal(definition)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(definitionJSON)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
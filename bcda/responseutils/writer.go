@@ -2,11 +2,14 @@ package responseutils
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"time"
 
 	fhirmodels "github.com/eug48/fhir/models"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
 )
 
 func CreateOpOutcome(severity, code, detailsCode, detailsDisplay string) *fhirmodels.OperationOutcome {
@@ -28,10 +31,27 @@ func WriteError(outcome *fhirmodels.OperationOutcome, w http.ResponseWriter, cod
 	}
 }
 
+// oauthURIsExtension is the SMART on FHIR extension that tells clients where to get an access token
+const oauthURIsExtension = "http://fhir-registry.smarthealthit.org/StructureDefinition/oauth-uris"
+
+// CreateCapabilityStatement describes the server: the resource types it exports, the export operations and their
+// OperationDefinitions, and how to authorize.  The SMART on FHIR security extension is added by WriteCapabilityStatement.
 func CreateCapabilityStatement(reldate time.Time, relversion, baseurl string) *fhirmodels.CapabilityStatement {
 	usecors := true
 	bbServer := os.Getenv("BB_SERVER_LOCATION")
+
+	var resources []fhirmodels.CapabilityStatementRestResourceComponent
+	for _, resourceType := range constants.ExportResourceTypes {
+		resources = append(resources, fhirmodels.CapabilityStatementRestResourceComponent{
+			Type:          resourceType,
+			Documentation: fmt.Sprintf("%s resources for the ACO's beneficiaries are available through $export.", resourceType),
+		})
+	}
+
 	statement := &fhirmodels.CapabilityStatement{
+		Name:         "BCDA",
+		Title:        "Beneficiary Claims Data API",
+		Description:  "Bulk export of Medicare claims data for the beneficiaries attributed to an Accountable Care Organization, following the FHIR Bulk Data Access specification.",
 		Status:       "active",
 		Date:         &fhirmodels.FHIRDateTime{Time: reldate, Precision: fhirmodels.Date},
 		Publisher:    "Centers for Medicare & Medicaid Services",
@@ -51,9 +71,11 @@ func CreateCapabilityStatement(reldate time.Time, relversion, baseurl string) *f
 		Format:        []string{"application/json", "application/fhir+json"},
 		Rest: []fhirmodels.CapabilityStatementRestComponent{
 			{
-				Mode: "server",
+				Mode:          "server",
+				Documentation: "Start an export with Patient/$export or Group/[id]/$export, poll the job status URL returned in Content-Location, and download the files listed in the completed job's manifest.",
 				Security: &fhirmodels.CapabilityStatementRestSecurityComponent{
-					Cors: &usecors,
+					Cors:        &usecors,
+					Description: "SMART backend services authorization: request an access token from the token endpoint with your client credentials and send it as a bearer token.",
 					Service: []fhirmodels.CodeableConcept{
 						{
 							Coding: []fhirmodels.Coding{
@@ -69,6 +91,7 @@ func CreateCapabilityStatement(reldate time.Time, relversion, baseurl string) *f
 						},
 					},
 				},
+				Resource: resources,
 				Interaction: []fhirmodels.CapabilityStatementSystemInteractionComponent{
 					{
 						Code: "batch",
@@ -81,14 +104,21 @@ func CreateCapabilityStatement(reldate time.Time, relversion, baseurl string) *f
 					{
 						Name: "export",
 						Definition: &fhirmodels.Reference{
-							Reference: baseurl + "/api/v1/Patient/$export",
-							Type:      "Endpoint",
+							Reference: baseurl + "/api/v1/OperationDefinition/" + PatientExportOperation,
+							Type:      "OperationDefinition",
 						},
 					},
 					{
 						Name: "export",
 						Definition: &fhirmodels.Reference{
-							Reference: baseurl + "/api/v1/Group/[id]/$export",
+							Reference: baseurl + "/api/v1/OperationDefinition/" + GroupExportOperation,
+							Type:      "OperationDefinition",
+						},
+					},
+					{
+						Name: "jobs",
+						Definition: &fhirmodels.Reference{
+							Reference: baseurl + "/api/v1/jobs",
 							Type:      "Endpoint",
 						},
 					},
@@ -99,6 +129,20 @@ func CreateCapabilityStatement(reldate time.Time, relversion, baseurl string) *f
 							Type:      "Endpoint",
 						},
 					},
+					{
+						Name: "cancel",
+						Definition: &fhirmodels.Reference{
+							Reference: baseurl + "/api/v1/jobs/[jobId]",
+							Type:      "Endpoint",
+						},
+					},
+					{
+						Name: "attribution-changes",
+						Definition: &fhirmodels.Reference{
+							Reference: baseurl + "/api/v1/attribution/changes",
+							Type:      "Endpoint",
+						},
+					},
 					{
 						Name: "metadata",
 						Definition: &fhirmodels.Reference{
@@ -128,9 +172,10 @@ func CreateCapabilityStatement(reldate time.Time, relversion, baseurl string) *f
 }
 
 func WriteCapabilityStatement(statement *fhirmodels.CapabilityStatement, w http.ResponseWriter) {
-	statementJSON, err := json.Marshal(statement)
+	statementJSON, err := MarshalCapabilityStatement(statement)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -139,3 +184,36 @@ func WriteCapabilityStatement(statement *fhirmodels.CapabilityStatement, w http.
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
+
+// MarshalCapabilityStatement encodes a statement made by CreateCapabilityStatement, adding the SMART on FHIR oauth-uris
+// extension to its security section.  fhirmodels.Extension cannot hold the token URL because it does not nest
+// extensions, so the extension is added to the encoded statement.
+func MarshalCapabilityStatement(statement *fhirmodels.CapabilityStatement) ([]byte, error) {
+	statementJSON, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+	if statement.Implementation == nil || len(statement.Rest) == 0 {
+		return statementJSON, nil
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal(statementJSON, &fields); err != nil {
+		return nil, err
+	}
+	rest := fields["rest"].([]interface{})[0].(map[string]interface{})
+	security, ok := rest["security"].(map[string]interface{})
+	if !ok {
+		security = make(map[string]interface{})
+		rest["security"] = security
+	}
+	security["extension"] = []interface{}{
+		map[string]interface{}{
+			"url": oauthURIsExtension,
+			"extension": []interface{}{
+				map[string]interface{}{"url": "token", "valueUri": statement.Implementation.Url + "/auth/token"},
+			},
+		},
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local keeps files on a filesystem, which must be shared by the API and workers.  Each area is a directory named by
+// an environment variable, read on every call.
+type Local struct{}
+
+// NewLocal returns a storage keeping files in the FHIR_STAGING_DIR, FHIR_PAYLOAD_DIR, and FHIR_ARCHIVE_DIR directories.
+func NewLocal() *Local {
+	return &Local{}
+}
+
+var localDirs = map[Area]string{
+	Staging: "FHIR_STAGING_DIR",
+	Payload: "FHIR_PAYLOAD_DIR",
+	Archive: "FHIR_ARCHIVE_DIR",
+}
+
+func (l *Local) path(area Area, name string) string {
+	return filepath.Join(os.Getenv(localDirs[area]), filepath.FromSlash(cleanName(name)))
+}
+
+// PutFile moves localPath into place, copying it if it is on another filesystem.  A file already in place is left as
+// it is.
+func (l *Local) PutFile(area Area, name, localPath string) error {
+	dest := l.path(area, name)
+	if filepath.Clean(localPath) == dest {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(localPath, dest); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+func (l *Local) Open(area Area, name string) (File, error) {
+	return os.Open(l.path(area, name))
+}
+
+func (l *Local) List(area Area, dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(l.path(area, dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return files, err
+}
+
+// MoveDir renames the directory, or if the directory already exists in the other area, moves the files into it one by
+// one.
+func (l *Local) MoveDir(from, to Area, dir string) error {
+	src, dest := l.path(from, dir), l.path(to, dir)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return err
+		}
+		return os.Rename(src, dest)
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			return fmt.Errorf("%s is a directory", filepath.Join(src, f.Name()))
+		}
+		if err = os.Rename(filepath.Join(src, f.Name()), filepath.Join(dest, f.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
+func (l *Local) RemoveAll(area Area, dir string) error {
+	return os.RemoveAll(l.path(area, dir))
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// S3 keeps files as objects in a bucket of S3, or of an object store with the same API, such as MinIO.  An object's
+// key is the area and name of its file, after an optional prefix, e.g. "bcda/payload/42/<file UUID>.ndjson".
+type S3 struct {
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// S3 copies an object of up to maxCopySize in one request; larger objects are copied in parts of copyPartSize.
+var (
+	maxCopySize  int64 = 5 << 30
+	copyPartSize int64 = 1 << 30
+)
+
+// NewS3 returns a storage keeping files in the bucket BCDA_S3_BUCKET, under the key prefix BCDA_S3_PREFIX.  Requests
+// go to BCDA_S3_ENDPOINT, by default the S3 endpoint for BCDA_S3_REGION (by default us-east-1), and name the bucket in
+// the path rather than the host, as object stores other than S3 expect.  Credentials are found the same way as for
+// other AWS services, e.g. from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.  Files are uploaded in parts, so they may
+// be larger than S3 allows a single request to send.
+func NewS3() (*S3, error) {
+	bucket := os.Getenv("BCDA_S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("BCDA_S3_BUCKET must be set to use S3 storage")
+	}
+
+	config := &aws.Config{
+		Region:           aws.String(utils.FromEnv("BCDA_S3_REGION", "us-east-1")),
+		S3ForcePathStyle: aws.Bool(true),
+		HTTPClient:       &http.Client{Timeout: time.Duration(utils.GetEnvInt("BCDA_S3_TIMEOUT_SEC", 300)) * time.Second},
+	}
+	if endpoint := os.Getenv("BCDA_S3_ENDPOINT"); endpoint != "" {
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, errors.Wrap(err, "invalid BCDA_S3_ENDPOINT")
+		}
+		config.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create AWS session")
+	}
+
+	client := s3.New(sess)
+	return &S3{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+		prefix:   strings.Trim(os.Getenv("BCDA_S3_PREFIX"), "/"),
+	}, nil
+}
+
+func (s *S3) key(area Area, name string) string {
+	return path.Join(s.prefix, string(area), cleanName(name))
+}
+
+// notExist returns an error for which os.IsNotExist is true in place of S3 reporting that an object doesn't exist.
+func notExist(err error, op, key string) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+		}
+	}
+	return err
+}
+
+// PutFile uploads the file and then removes it.
+func (s *S3) PutFile(area Area, name, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	_, err = s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(area, name)),
+		Body:   f,
+	})
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+func (s *S3) Open(area Area, name string) (File, error) {
+	key := s.key(area, name)
+	head, err := s.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, notExist(err, "open", key)
+	}
+	info := objectInfo{name: path.Base(key), size: aws.Int64Value(head.ContentLength), modTime: aws.TimeValue(head.LastModified)}
+	return &s3File{s: s, key: key, info: info}, nil
+}
+
+func (s *S3) List(area Area, dir string) ([]os.FileInfo, error) {
+	objects, err := s.list(s.key(area, dir), false)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, len(objects))
+	for i, o := range objects {
+		files[i] = objectInfo{name: path.Base(aws.StringValue(o.Key)), size: aws.Int64Value(o.Size), modTime: aws.TimeValue(o.LastModified)}
+	}
+	return files, nil
+}
+
+// MoveDir copies each object to its new key and then deletes it.
+func (s *S3) MoveDir(from, to Area, dir string) error {
+	src, dest := s.key(from, dir), s.key(to, dir)
+	objects, err := s.list(src, false)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		if err = s.copy(key, dest+strings.TrimPrefix(key, src), aws.Int64Value(o.Size)); err != nil {
+			return errors.Wrapf(err, "could not copy S3 object %s", key)
+		}
+		if _, err = s.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: o.Key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies an object of the given size within the bucket, in parts if it is too large to copy at once.
+func (s *S3) copy(srcKey, destKey string, size int64) error {
+	source := aws.String(url.PathEscape(s.bucket) + "/" + (&url.URL{Path: srcKey}).EscapedPath())
+	if size <= maxCopySize {
+		_, err := s.client.CopyObject(&s3.CopyObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(destKey), CopySource: source})
+		return err
+	}
+
+	upload, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String(s.bucket), Key: aws.String(destKey)})
+	if err != nil {
+		return err
+	}
+	var parts []*s3.CompletedPart
+	for start := int64(0); start < size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := aws.Int64(int64(len(parts) + 1))
+		part, err := s.client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(destKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      partNumber,
+			CopySource:      source,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			// S3 keeps the parts copied so far until the upload is aborted
+			_, abortErr := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(s.bucket), Key: aws.String(destKey), UploadId: upload.UploadId})
+			if abortErr != nil {
+				return errors.Wrapf(err, "could not abort upload after it failed (%s)", abortErr)
+			}
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: partNumber})
+	}
+	_, err = s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(destKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (s *S3) RemoveAll(area Area, dir string) error {
+	objects, err := s.list(s.key(area, dir), true)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if _, err = s.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: o.Key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns the objects in a directory, and unless recursive is set, not those in its subdirectories.
+func (s *S3) list(dir string, recursive bool) ([]*s3.Object, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(dir + "/")}
+	if !recursive {
+		input.Delimiter = aws.String("/")
+	}
+
+	var objects []*s3.Object
+	err := s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list S3 objects in %s", dir)
+	}
+	return objects, nil
+}
+
+// s3File reads an object with GET requests for the rest of the object from the current offset, so that seeking,
+// e.g. to serve a range request, doesn't download the part of the object skipped over.
+type s3File struct {
+	s    *S3
+	key  string
+	info objectInfo
+	off  int64
+	body io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		object, err := f.s.client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(f.s.bucket),
+			Key:    aws.String(f.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", f.off)),
+		})
+		if err != nil {
+			return 0, notExist(err, "read", f.key)
+		}
+		f.body = object.Body
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	if err == io.EOF && f.off < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != f.off {
+		f.Close()
+		f.off = offset
+	}
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// objectInfo describes an object as a file.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (o objectInfo) Name() string       { return o.name }
+func (o objectInfo) Size() int64        { return o.size }
+func (o objectInfo) Mode() os.FileMode  { return 0444 }
+func (o objectInfo) ModTime() time.Time { return o.modTime }
+func (o objectInfo) IsDir() bool        { return false }
+func (o objectInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,66 @@
+// Package storage keeps the files written for export jobs, so that the API and workers can share them without a
+// shared filesystem.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// Area is one of the places job files are kept as a job moves through its life.
+type Area string
+
+const (
+	// Staging holds the files of a job's finished chunks until the whole job is done
+	Staging Area = "staging"
+	// Payload holds the files of completed jobs, which clients download
+	Payload Area = "payload"
+	// Archive holds the files of expired jobs until they are cleaned up
+	Archive Area = "archive"
+)
+
+// File is a stored file opened for reading.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// Storage keeps job files.  Names are slash-separated paths within an area, e.g. "42/<file UUID>.ndjson" for a file
+// of job 42.
+type Storage interface {
+	// PutFile moves a file on the local filesystem into storage, replacing any file already there.
+	PutFile(area Area, name, localPath string) error
+	// Open opens a file for reading.  A file that does not exist gives an error for which os.IsNotExist is true.
+	Open(area Area, name string) (File, error)
+	// List returns the files in a directory.  A directory that does not exist has none.
+	List(area Area, dir string) ([]os.FileInfo, error)
+	// MoveDir moves the files in a directory to the same directory in another area.  A directory that does not exist
+	// has none to move.
+	MoveDir(from, to Area, dir string) error
+	// RemoveAll removes a directory and every file in it.
+	RemoveAll(area Area, dir string) error
+}
+
+// Get returns the storage chosen by BCDA_STORAGE: local (the default), which keeps files in the FHIR_STAGING_DIR,
+// FHIR_PAYLOAD_DIR, and FHIR_ARCHIVE_DIR directories, or s3, which keeps them in an S3-compatible object store.
+func Get() (Storage, error) {
+	switch kind := utils.FromEnv("BCDA_STORAGE", "local"); kind {
+	case "local":
+		return NewLocal(), nil
+	case "s3":
+		return NewS3()
+	default:
+		return nil, fmt.Errorf("unknown storage %q", kind)
+	}
+}
+
+// cleanName keeps a name within its area.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,439 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for area, env := range localDirs {
+		orig := os.Getenv(env)
+		defer os.Setenv(env, orig)
+		os.Setenv(env, filepath.Join(dir, string(area)))
+	}
+
+	testStorage(t, NewLocal())
+}
+
+func TestLocal_MoveDirIntoExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for area, env := range localDirs {
+		orig := os.Getenv(env)
+		defer os.Setenv(env, orig)
+		os.Setenv(env, filepath.Join(dir, string(area)))
+	}
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "staging", "1"), os.ModePerm))
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "payload", "1"), os.ModePerm))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "staging", "1", "a.ndjson"), []byte("a"), 0600))
+
+	l := NewLocal()
+	assert.Nil(t, l.MoveDir(Staging, Payload, "1"))
+	assert.FileExists(t, filepath.Join(dir, "payload", "1", "a.ndjson"))
+	_, err = os.Stat(filepath.Join(dir, "staging", "1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a file already in place is left there
+	path := filepath.Join(dir, "payload", "1", "a.ndjson")
+	assert.Nil(t, l.PutFile(Payload, "1/a.ndjson", path))
+	assert.FileExists(t, path)
+}
+
+func TestS3(t *testing.T) {
+	server := newFakeS3("bucket")
+	defer server.Close()
+
+	for k, v := range map[string]string{
+		"BCDA_S3_BUCKET":        "bucket",
+		"BCDA_S3_ENDPOINT":      server.URL,
+		"BCDA_S3_PREFIX":        "/bcda/",
+		"AWS_ACCESS_KEY_ID":     "key",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+	} {
+		orig := os.Getenv(k)
+		defer os.Setenv(k, orig)
+		os.Setenv(k, v)
+	}
+
+	s, err := NewS3()
+	require.Nil(t, err)
+	testStorage(t, s)
+
+	assert.Empty(t, server.keys())
+
+	tmp, err := ioutil.TempFile("", "scratch")
+	require.Nil(t, err)
+	tmp.Close()
+	assert.Nil(t, s.PutFile(Payload, "/../3//d.ndjson", tmp.Name()))
+	assert.Equal(t, []string{"bcda/payload/3/d.ndjson"}, server.keys())
+
+	// requests are signed
+	assert.True(t, strings.HasPrefix(server.lastAuth, "AWS4-HMAC-SHA256 Credential=key/"), server.lastAuth)
+}
+
+func TestS3_LargeFiles(t *testing.T) {
+	server := newFakeS3("bucket")
+	defer server.Close()
+
+	for k, v := range map[string]string{
+		"BCDA_S3_BUCKET":        "bucket",
+		"BCDA_S3_ENDPOINT":      server.URL,
+		"BCDA_S3_PREFIX":        "",
+		"AWS_ACCESS_KEY_ID":     "key",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+	} {
+		orig := os.Getenv(k)
+		defer os.Setenv(k, orig)
+		os.Setenv(k, v)
+	}
+	origMaxCopySize, origCopyPartSize := maxCopySize, copyPartSize
+	defer func() { maxCopySize, copyPartSize = origMaxCopySize, origCopyPartSize }()
+
+	s, err := NewS3()
+	require.Nil(t, err)
+
+	// a file larger than a part is uploaded in parts
+	data := bytes.Repeat([]byte("0123456789"), 600000)
+	tmp, err := ioutil.TempFile("", "scratch")
+	require.Nil(t, err)
+	_, err = tmp.Write(data)
+	require.Nil(t, err)
+	tmp.Close()
+	require.Nil(t, s.PutFile(Staging, "1/a.ndjson", tmp.Name()))
+	assert.Empty(t, server.uploads)
+	assert.Equal(t, data, server.objects["staging/1/a.ndjson"].data)
+
+	// an object larger than can be copied at once is copied in parts
+	maxCopySize, copyPartSize = 1000000, 1500000
+	require.Nil(t, s.MoveDir(Staging, Payload, "1"))
+	assert.Equal(t, []string{"payload/1/a.ndjson"}, server.keys())
+	assert.Equal(t, data, server.objects["payload/1/a.ndjson"].data)
+	assert.Zero(t, server.copies)
+
+	f, err := s.Open(Payload, "1/a.ndjson")
+	require.Nil(t, err)
+	b, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	f.Close()
+
+	_, err = s.Open(Payload, "1/b.ndjson")
+	assert.True(t, os.IsNotExist(err))
+
+	// S3 reporting a failed copy with 200 is still an error
+	assert.NotNil(t, s.copy("payload/1/missing.ndjson", "archive/1/missing.ndjson", 10))
+}
+
+func TestS3_Missing(t *testing.T) {
+	orig := os.Getenv("BCDA_S3_BUCKET")
+	defer os.Setenv("BCDA_S3_BUCKET", orig)
+	os.Unsetenv("BCDA_S3_BUCKET")
+
+	_, err := NewS3()
+	assert.EqualError(t, err, "BCDA_S3_BUCKET must be set to use S3 storage")
+}
+
+func TestGet(t *testing.T) {
+	orig := os.Getenv("BCDA_STORAGE")
+	defer os.Setenv("BCDA_STORAGE", orig)
+
+	os.Setenv("BCDA_STORAGE", "")
+	s, err := Get()
+	assert.Nil(t, err)
+	assert.IsType(t, &Local{}, s)
+
+	os.Setenv("BCDA_STORAGE", "nfs")
+	_, err = Get()
+	assert.EqualError(t, err, `unknown storage "nfs"`)
+}
+
+// testStorage runs a job's files through their life in s, which must be empty.
+func testStorage(t *testing.T, s Storage) {
+	tmp, err := ioutil.TempDir("", "scratch")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmp)
+
+	put := func(area Area, name, content string) {
+		local := filepath.Join(tmp, filepath.Base(name))
+		require.Nil(t, ioutil.WriteFile(local, []byte(content), 0600))
+		require.Nil(t, s.PutFile(area, name, local))
+		_, err := os.Stat(local)
+		assert.True(t, os.IsNotExist(err), "local file should be moved")
+	}
+	names := func(area Area, dir string) []string {
+		files, err := s.List(area, dir)
+		require.Nil(t, err)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	files, err := s.List(Staging, "1")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+	_, err = s.Open(Payload, "1/a.ndjson")
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	put(Staging, "1/a.ndjson", "0123456789")
+	put(Staging, "1/b-error.ndjson", "error")
+	put(Staging, "2/c.ndjson", "other job")
+	assert.Equal(t, []string{"a.ndjson", "b-error.ndjson"}, names(Staging, "1"))
+
+	assert.Nil(t, s.MoveDir(Staging, Payload, "1"))
+	assert.Empty(t, names(Staging, "1"))
+	assert.Equal(t, []string{"a.ndjson", "b-error.ndjson"}, names(Payload, "1"))
+	assert.Equal(t, []string{"c.ndjson"}, names(Staging, "2"))
+
+	f, err := s.Open(Payload, "1/a.ndjson")
+	require.Nil(t, err)
+	fi, err := f.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, "a.ndjson", fi.Name())
+	assert.Equal(t, int64(10), fi.Size())
+	assert.WithinDuration(t, time.Now(), fi.ModTime(), time.Minute)
+
+	b, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(b))
+	_, err = f.Seek(4, io.SeekStart)
+	assert.Nil(t, err)
+	b = make([]byte, 3)
+	_, err = io.ReadFull(f, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "456", string(b))
+	_, err = f.Seek(-2, io.SeekEnd)
+	assert.Nil(t, err)
+	b, err = ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "89", string(b))
+	assert.Nil(t, f.Close())
+
+	// a file can be served with http.ServeContent
+	f, err = s.Open(Payload, "1/a.ndjson")
+	require.Nil(t, err)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/data/1/a.ndjson", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	http.ServeContent(rr, req, fi.Name(), fi.ModTime(), f)
+	f.Close()
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "2345", rr.Body.String())
+
+	assert.Nil(t, s.MoveDir(Payload, Archive, "1"))
+	assert.Equal(t, []string{"a.ndjson", "b-error.ndjson"}, names(Archive, "1"))
+	assert.Nil(t, s.RemoveAll(Archive, "1"))
+	assert.Empty(t, names(Archive, "1"))
+	assert.Nil(t, s.RemoveAll(Staging, "2"))
+	assert.Empty(t, names(Staging, "2"))
+	assert.Nil(t, s.MoveDir(Staging, Payload, "2"))
+	assert.Empty(t, names(Payload, "2"))
+}
+
+// fakeS3 is a stand-in for an S3-compatible object store, serving one bucket from memory.
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	uploads  map[string]map[int][]byte // parts of multipart uploads in progress, by upload ID
+	copies   int                       // objects copied in one request
+	lastAuth string
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	s := &fakeS3{bucket: bucket, objects: map[string]fakeObject{}, uploads: map[string]map[int][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeS3) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAuth = r.Header.Get("Authorization")
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.bucket {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		s.list(w, r)
+		return
+	}
+	key := parts[1]
+	q := r.URL.Query()
+	if _, ok := q["uploads"]; ok || q.Get("uploadId") != "" {
+		s.multipart(w, r, key)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			data, ok := s.source(r)
+			if !ok {
+				// S3 reports some failed copies with 200
+				w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+				return
+			}
+			s.objects[key] = fakeObject{data, time.Now()}
+			s.copies++
+			w.Write([]byte("<CopyObjectResult><ETag>\"etag\"</ETag></CopyObjectResult>"))
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = fakeObject{b, time.Now()}
+	case http.MethodGet, http.MethodHead:
+		o, ok := s.objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, o.modTime, bytes.NewReader(o.data))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// source returns the data of the object, or of the range of it, that a request copies.
+func (s *fakeS3) source(r *http.Request) ([]byte, bool) {
+	src, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		return nil, false
+	}
+	o, ok := s.objects[strings.TrimPrefix(src, s.bucket+"/")]
+	if !ok {
+		return nil, false
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err != nil {
+		return o.data, true
+	}
+	return o.data[start : end+1], true
+}
+
+// multipart answers the requests of a multipart upload: to create it, upload or copy a part, complete it, or abort it.
+func (s *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	id := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		id = fmt.Sprint(len(s.uploads) + 1)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", s.bucket, key, id)
+	case r.Method == http.MethodPut:
+		var n int
+		fmt.Sscan(q.Get("partNumber"), &n)
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			data, ok := s.source(r)
+			if !ok {
+				http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+				return
+			}
+			s.uploads[id][n] = data
+			fmt.Fprintf(w, "<CopyPartResult><ETag>\"%d\"</ETag></CopyPartResult>", n)
+			return
+		}
+		s.uploads[id][n], _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case r.Method == http.MethodPost:
+		var data []byte
+		for n := 1; n <= len(s.uploads[id]); n++ {
+			data = append(data, s.uploads[id][n]...)
+		}
+		delete(s.uploads, id)
+		s.objects[key] = fakeObject{data, time.Now()}
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list answers ListObjectsV2, a page of two objects at a time.
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && (delimiter == "" || !strings.Contains(k[len(prefix):], delimiter)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := q.Get("continuation-token"); token != "" {
+		start = sort.SearchStrings(keys, token)
+	}
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for i := start; i < len(keys); i++ {
+		if i-start == 2 {
+			result.IsTruncated, result.NextContinuationToken = true, keys[i]
+			break
+		}
+		o := s.objects[keys[i]]
+		result.Contents = append(result.Contents, content{keys[i], len(o.data), o.modTime.UTC().Format("2006-01-02T15:04:05.000Z")})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"github.com/CMSgov/bcda-app/bcda/constants"
 	"os"
 	"path/filepath"
@@ -49,7 +50,7 @@ func ImportSuppressionDirectory(filePath string) (success, failure, skipped int,
 	}
 
 	for _, metadata := range suppresslist {
-		err = validate(metadata)
+		err = validate(os.Stdout, metadata)
 		if err != nil {
 			fmt.Printf("Failed to validate suppression file: %s.\n", metadata)
 			log.Errorf("Failed to validate suppression file: %s", metadata)
@@ -79,14 +80,83 @@ func ImportSuppressionDirectory(filePath string) (success, failure, skipped int,
 	return success, failure, skipped, err
 }
 
+// ValidateSuppressionDirectory checks the suppression files in a directory as ImportSuppressionDirectory would before
+// importing them, and parses each of their records, without writing to the database or moving any files.  Progress
+// messages are written to w.  It returns the number of suppression files checked and every problem found.
+func ValidateSuppressionDirectory(w io.Writer, filePath string) (checked int, problems []utils.FileProblem, err error) {
+	var suppresslist []*suppressionFileMetadata
+	var skipped int
+	problems = []utils.FileProblem{}
+
+	err = filepath.Walk(filePath, walkSuppressionFiles(w, &suppresslist, &skipped, &problems))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, metadata := range suppresslist {
+		checked++
+		if err = validate(w, metadata); err != nil {
+			problems = append(problems, utils.FileProblem{File: metadata.filePath, Problem: err.Error()})
+			continue
+		}
+		recordProblems, err := parseSuppressionRecords(metadata)
+		if err != nil {
+			problems = append(problems, utils.FileProblem{File: metadata.filePath, Problem: err.Error()})
+		}
+		problems = append(problems, recordProblems...)
+	}
+
+	return checked, problems, nil
+}
+
+// parseSuppressionRecords parses each record of a suppression file, returning a problem for each that can't be.
+func parseSuppressionRecords(metadata *suppressionFileMetadata) ([]utils.FileProblem, error) {
+	f, err := os.Open(metadata.filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read file %s", metadata)
+	}
+	defer f.Close() // #nosec G307
+
+	var (
+		headTrailStart, headTrailEnd = 0, 15
+	)
+
+	var problems []utils.FileProblem
+	record := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		b := sc.Bytes()
+		if len(bytes.TrimSpace(b)) > 0 {
+			// a line too short to be a header or trailer is reported as a short record
+			if len(b) >= headTrailEnd {
+				metaInfo := string(bytes.TrimSpace(b[headTrailStart:headTrailEnd]))
+				if metaInfo == headerCode || metaInfo == trailerCode {
+					continue
+				}
+			}
+			record++
+			if _, err := parseSuppressionRecord(metadata, b); err != nil {
+				problems = append(problems, utils.FileProblem{File: metadata.filePath, Problem: fmt.Sprintf("record %d: %s", record, err)})
+			}
+		}
+	}
+	return problems, sc.Err()
+}
+
 func getSuppressionFileMetadata(suppresslist *[]*suppressionFileMetadata, skipped *int) filepath.WalkFunc {
+	return walkSuppressionFiles(os.Stdout, suppresslist, skipped, nil)
+}
+
+// walkSuppressionFiles lists the suppression files in a directory.  If problems is set, files that can't be imported
+// are added to it, and old ones are left in place rather than moved to the pending deletion directory.
+func walkSuppressionFiles(w io.Writer, suppresslist *[]*suppressionFileMetadata, skipped *int, problems *[]utils.FileProblem) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			var fileName = "nil"
 			if info != nil {
 				fileName = info.Name()
 			}
-			fmt.Printf("Error in checking suppression file %s: %s.\n", fileName, err)
+			fmt.Fprintf(w, "Error in checking suppression file %s: %s.\n", fileName, err)
 			err = errors.Wrapf(err, "error in checking suppression file: %s,", fileName)
 			log.Error(err)
 			return err
@@ -96,21 +166,25 @@ func getSuppressionFileMetadata(suppresslist *[]*suppressionFileMetadata, skippe
 			return nil
 		}
 
-		metadata, err := parseMetadata(info.Name())
+		metadata, err := parseMetadata(w, info.Name())
 		metadata.filePath = path
 		metadata.deliveryDate = info.ModTime()
 		if err != nil {
 			// skipping files with a bad name.  An unknown file in this dir isn't a blocker
-			fmt.Printf("Unknown file found: %s.\n", metadata)
+			fmt.Fprintf(w, "Unknown file found: %s.\n", metadata)
 			log.Errorf("Unknown file found: %s", metadata)
 			*skipped = *skipped + 1
+			if problems != nil {
+				*problems = append(*problems, utils.FileProblem{File: path, Problem: err.Error()})
+				return nil
+			}
 
 			deleteThreshold := time.Hour * time.Duration(utils.GetEnvInt("BCDA_ETL_FILE_ARCHIVE_THRESHOLD_HR", 72))
 			if metadata.deliveryDate.Add(deleteThreshold).Before(time.Now()) {
 				newpath := fmt.Sprintf("%s/%s", os.Getenv("PENDING_DELETION_DIR"), info.Name())
 				err = os.Rename(metadata.filePath, newpath)
 				if err != nil {
-					fmt.Printf("Error moving unknown file %s to pending deletion dir.\n", metadata)
+					fmt.Fprintf(w, "Error moving unknown file %s to pending deletion dir.\n", metadata)
 					err = fmt.Errorf("error moving unknown file %s to pending deletion dir", metadata)
 					log.Error(err)
 					return err
@@ -123,14 +197,14 @@ func getSuppressionFileMetadata(suppresslist *[]*suppressionFileMetadata, skippe
 	}
 }
 
-func parseMetadata(filename string) (suppressionFileMetadata, error) {
+func parseMetadata(w io.Writer, filename string) (suppressionFileMetadata, error) {
 	var metadata suppressionFileMetadata
 	// Beneficiary Data Sharing Preferences File sent by 1-800-Medicare: P#EFT.ON.ACO.NGD1800.DPRF.Dyymmdd.Thhmmsst
 	// Prefix: T = test, P = prod;
 	filenameRegexp := regexp.MustCompile(`((P|T)\#EFT)\.ON\.ACO\.NGD1800\.DPRF\.(D\d{6}\.T\d{6})\d`)
 	filenameMatches := filenameRegexp.FindStringSubmatch(filename)
 	if len(filenameMatches) < 4 {
-		fmt.Printf("Invalid filename for file: %s.\n", filename)
+		fmt.Fprintf(w, "Invalid filename for file: %s.\n", filename)
 		err := fmt.Errorf("invalid filename for file: %s", filename)
 		log.Error(err)
 		return metadata, err
@@ -139,7 +213,7 @@ func parseMetadata(filename string) (suppressionFileMetadata, error) {
 	filenameDate := filenameMatches[3]
 	t, err := time.Parse("D060102.T150405", filenameDate)
 	if err != nil || t.IsZero() {
-		fmt.Printf("Failed to parse date '%s' from file: %s.\n", filenameDate, filename)
+		fmt.Fprintf(w, "Failed to parse date '%s' from file: %s.\n", filenameDate, filename)
 		err = errors.Wrapf(err, "failed to parse date '%s' from file: %s", filenameDate, filename)
 		log.Error(err)
 		return metadata, err
@@ -151,13 +225,13 @@ func parseMetadata(filename string) (suppressionFileMetadata, error) {
 	return metadata, nil
 }
 
-func validate(metadata *suppressionFileMetadata) error {
-	fmt.Printf("Validating suppression file %s...\n", metadata)
+func validate(w io.Writer, metadata *suppressionFileMetadata) error {
+	fmt.Fprintf(w, "Validating suppression file %s...\n", metadata)
 	log.Infof("Validating suppression file %s...", metadata)
 
 	f, err := os.Open(metadata.filePath)
 	if err != nil {
-		fmt.Printf("Could not read file %s.\n", metadata)
+		fmt.Fprintf(w, "Could not read file %s.\n", metadata)
 		err = errors.Wrapf(err, "could not read file %s", metadata)
 		log.Error(err)
 		return err
@@ -177,7 +251,7 @@ func validate(metadata *suppressionFileMetadata) error {
 		if count == 0 {
 			if metaInfo != headerCode {
 				// invalid file header found
-				fmt.Printf("Invalid file header for file: %s.\n", metadata.filePath)
+				fmt.Fprintf(w, "Invalid file header for file: %s.\n", metadata.filePath)
 				err := fmt.Errorf("invalid file header for file: %s", metadata.filePath)
 				log.Error(err)
 				return err
@@ -192,7 +266,7 @@ func validate(metadata *suppressionFileMetadata) error {
 			// trailer info
 			expectedCount, err := strconv.Atoi(string(bytes.TrimSpace(b[recCountStart:recCountEnd])))
 			if err != nil {
-				fmt.Printf("Failed to parse record count from file: %s.\n", metadata.filePath)
+				fmt.Fprintf(w, "Failed to parse record count from file: %s.\n", metadata.filePath)
 				err = fmt.Errorf("failed to parse record count from file: %s", metadata.filePath)
 				log.Error(err)
 				return err
@@ -200,71 +274,25 @@ func validate(metadata *suppressionFileMetadata) error {
 			// subtract the single count from the header
 			count--
 			if count != expectedCount {
-				fmt.Printf("Incorrect number of records found from file: '%s'. Expected record count: %d, Actual record count: %d.\n", metadata.filePath, expectedCount, count)
+				fmt.Fprintf(w, "Incorrect number of records found from file: '%s'. Expected record count: %d, Actual record count: %d.\n", metadata.filePath, expectedCount, count)
 				err = fmt.Errorf("incorrect number of records found from file: '%s'. Expected record count: %d, Actual record count: %d", metadata.filePath, expectedCount, count)
 				log.Error(err)
 				return err
 			}
 		}
 	}
-	fmt.Printf("Successfully validated suppression file %s.\n", metadata)
+	fmt.Fprintf(w, "Successfully validated suppression file %s.\n", metadata)
 	log.Infof("Successfully validated suppression file %s.", metadata)
 	return nil
 }
 
 func importSuppressionData(metadata *suppressionFileMetadata) error {
 	err := importSuppressionMetadata(metadata, func(fileID uint, b []byte, db *gorm.DB) error {
-		var (
-			hicnStart, hicnEnd                           = 0, 11
-			lKeyStart, lKeyEnd                           = 11, 21
-			effectiveDtStart, effectiveDtEnd             = 354, 362
-			sourceCdeStart, sourceCdeEnd                 = 362, 367
-			prefIndtorStart, prefIndtorEnd               = 368, 369
-			samhsaEffectiveDtStart, samhsaEffectiveDtEnd = 369, 377
-			samhsaSourceCdeStart, samhsaSourceCdeEnd     = 377, 382
-			samhsaPrefIndtorStart, samhsaPrefIndtorEnd   = 383, 384
-			acoIdStart, acoIdEnd                         = 384, 389
-		)
-		ds := string(bytes.TrimSpace(b[effectiveDtStart:effectiveDtEnd]))
-		dt, err := convertDt(ds)
+		suppression, err := parseSuppressionRecord(metadata, b)
 		if err != nil {
-			fmt.Printf("Failed to parse the effective date '%s' from file: %s.\n", ds, metadata.filePath)
-			err = errors.Wrapf(err, "failed to parse the effective date '%s' from file: %s", ds, metadata.filePath)
-			log.Error(err)
-			return err
-		}
-		ds = string(bytes.TrimSpace(b[samhsaEffectiveDtStart:samhsaEffectiveDtEnd]))
-		samhsaDt, err := convertDt(ds)
-		if err != nil {
-			fmt.Printf("Failed to parse the samhsa effective date '%s' from file: %s.\n", ds, metadata.filePath)
-			err = errors.Wrapf(err, "failed to parse the samhsa effective date '%s' from file: %s", ds, metadata.filePath)
-			log.Error(err)
 			return err
 		}
-		keyval := string(bytes.TrimSpace(b[lKeyStart:lKeyEnd]))
-		if keyval == "" {
-			keyval = "0"
-		}
-		lk, err := strconv.Atoi(keyval)
-		if err != nil {
-			fmt.Printf("Failed to parse beneficiary link key from file: %s.\n", metadata.filePath)
-			err = errors.Wrapf(err, "failed to parse beneficiary link key from file: %s", metadata.filePath)
-			log.Error(err)
-			return err
-		}
-
-		suppression := &models.Suppression{
-			FileID:              fileID,
-			HICN:                string(bytes.TrimSpace(b[hicnStart:hicnEnd])),
-			SourceCode:          string(bytes.TrimSpace(b[sourceCdeStart:sourceCdeEnd])),
-			EffectiveDt:         dt,
-			PrefIndicator:       string(bytes.TrimSpace(b[prefIndtorStart:prefIndtorEnd])),
-			SAMHSASourceCode:    string(bytes.TrimSpace(b[samhsaSourceCdeStart:samhsaSourceCdeEnd])),
-			SAMHSAEffectiveDt:   samhsaDt,
-			SAMHSAPrefIndicator: string(bytes.TrimSpace(b[samhsaPrefIndtorStart:samhsaPrefIndtorEnd])),
-			BeneficiaryLinkKey:  lk,
-			ACOCMSID:            string(bytes.TrimSpace(b[acoIdStart:acoIdEnd])),
-		}
+		suppression.FileID = fileID
 		err = db.Create(suppression).Error
 		if err != nil {
 			fmt.Println("Could not create suppression record.")
@@ -282,6 +310,66 @@ func importSuppressionData(metadata *suppressionFileMetadata) error {
 	return nil
 }
 
+// parseSuppressionRecord parses a record of a suppression file, other than its header or trailer.
+func parseSuppressionRecord(metadata *suppressionFileMetadata, b []byte) (*models.Suppression, error) {
+	var (
+		hicnStart, hicnEnd                           = 0, 11
+		lKeyStart, lKeyEnd                           = 11, 21
+		effectiveDtStart, effectiveDtEnd             = 354, 362
+		sourceCdeStart, sourceCdeEnd                 = 362, 367
+		prefIndtorStart, prefIndtorEnd               = 368, 369
+		samhsaEffectiveDtStart, samhsaEffectiveDtEnd = 369, 377
+		samhsaSourceCdeStart, samhsaSourceCdeEnd     = 377, 382
+		samhsaPrefIndtorStart, samhsaPrefIndtorEnd   = 383, 384
+		acoIdStart, acoIdEnd                         = 384, 389
+	)
+	if len(b) < acoIdEnd {
+		fmt.Printf("Record too short in file: %s.\n", metadata.filePath)
+		err := fmt.Errorf("record too short in file: %s (expected at least: %d, actual: %d)", metadata.filePath, acoIdEnd, len(b))
+		log.Error(err)
+		return nil, err
+	}
+	ds := string(bytes.TrimSpace(b[effectiveDtStart:effectiveDtEnd]))
+	dt, err := convertDt(ds)
+	if err != nil {
+		fmt.Printf("Failed to parse the effective date '%s' from file: %s.\n", ds, metadata.filePath)
+		err = errors.Wrapf(err, "failed to parse the effective date '%s' from file: %s", ds, metadata.filePath)
+		log.Error(err)
+		return nil, err
+	}
+	ds = string(bytes.TrimSpace(b[samhsaEffectiveDtStart:samhsaEffectiveDtEnd]))
+	samhsaDt, err := convertDt(ds)
+	if err != nil {
+		fmt.Printf("Failed to parse the samhsa effective date '%s' from file: %s.\n", ds, metadata.filePath)
+		err = errors.Wrapf(err, "failed to parse the samhsa effective date '%s' from file: %s", ds, metadata.filePath)
+		log.Error(err)
+		return nil, err
+	}
+	keyval := string(bytes.TrimSpace(b[lKeyStart:lKeyEnd]))
+	if keyval == "" {
+		keyval = "0"
+	}
+	lk, err := strconv.Atoi(keyval)
+	if err != nil {
+		fmt.Printf("Failed to parse beneficiary link key from file: %s.\n", metadata.filePath)
+		err = errors.Wrapf(err, "failed to parse beneficiary link key from file: %s", metadata.filePath)
+		log.Error(err)
+		return nil, err
+	}
+
+	return &models.Suppression{
+		HICN:                string(bytes.TrimSpace(b[hicnStart:hicnEnd])),
+		SourceCode:          string(bytes.TrimSpace(b[sourceCdeStart:sourceCdeEnd])),
+		EffectiveDt:         dt,
+		PrefIndicator:       string(bytes.TrimSpace(b[prefIndtorStart:prefIndtorEnd])),
+		SAMHSASourceCode:    string(bytes.TrimSpace(b[samhsaSourceCdeStart:samhsaSourceCdeEnd])),
+		SAMHSAEffectiveDt:   samhsaDt,
+		SAMHSAPrefIndicator: string(bytes.TrimSpace(b[samhsaPrefIndtorStart:samhsaPrefIndtorEnd])),
+		BeneficiaryLinkKey:  lk,
+		ACOCMSID:            string(bytes.TrimSpace(b[acoIdStart:acoIdEnd])),
+	}, nil
+}
+
 func importSuppressionMetadata(metadata *suppressionFileMetadata, importFunc func(uint, []byte, *gorm.DB) error) error {
 	fmt.Printf("Importing suppression file %s...\n", metadata)
 	log.Infof("Importing suppression file %s...", metadata)
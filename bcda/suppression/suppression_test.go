@@ -1,6 +1,7 @@
 package suppression
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
+	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/jinzhu/gorm"
 
 	"github.com/stretchr/testify/assert"
@@ -184,28 +186,28 @@ func (s *SuppressionTestSuite) TestValidate() {
 	// positive
 	suppressionfilePath := BASE_FILE_PATH + "synthetic1800MedicareFiles/test/T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000009"
 	metadata := &suppressionFileMetadata{timestamp: time.Now(), filePath: suppressionfilePath}
-	err := validate(metadata)
+	err := validate(os.Stdout, metadata)
 	assert.Nil(err)
 
 	// bad file path
 	metadata.filePath = metadata.filePath + "/blah/"
-	err = validate(metadata)
+	err = validate(os.Stdout, metadata)
 	assert.NotNil(err)
 	assert.Contains(err.Error(), "could not read file "+metadata.filePath)
 
 	// invalid file header
 	metadata.filePath = BASE_FILE_PATH + "suppressionfile_BadHeader/T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000009"
-	err = validate(metadata)
+	err = validate(os.Stdout, metadata)
 	assert.EqualError(err, "invalid file header for file: "+metadata.filePath)
 
 	// missing record count
 	metadata.filePath = BASE_FILE_PATH + "suppressionfile_MissingData/T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000009"
-	err = validate(metadata)
+	err = validate(os.Stdout, metadata)
 	assert.EqualError(err, "failed to parse record count from file: "+metadata.filePath)
 
 	// incorrect record count
 	metadata.filePath = BASE_FILE_PATH + "suppressionfile_MissingData/T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000010"
-	err = validate(metadata)
+	err = validate(os.Stdout, metadata)
 	assert.EqualError(err, "incorrect number of records found from file: '"+metadata.filePath+"'. Expected record count: 5, Actual record count: 4")
 }
 
@@ -214,14 +216,14 @@ func (s *SuppressionTestSuite) TestParseMetadata() {
 
 	// positive
 	expTime, _ := time.Parse(time.RFC3339, "2018-11-20T20:13:01Z")
-	metadata, err := parseMetadata("blah/T#EFT.ON.ACO.NGD1800.DPRF.D181120.T2013010")
+	metadata, err := parseMetadata(os.Stdout, "blah/T#EFT.ON.ACO.NGD1800.DPRF.D181120.T2013010")
 	assert.Equal("T#EFT.ON.ACO.NGD1800.DPRF.D181120.T2013010", metadata.name)
 	assert.Equal(expTime.Format("010203040506"), metadata.timestamp.Format("010203040506"))
 	assert.Nil(err)
 
 	// change the name and timestamp
 	expTime, _ = time.Parse(time.RFC3339, "2019-12-20T21:09:42Z")
-	metadata, err = parseMetadata("blah/T#EFT.ON.ACO.NGD1800.DPRF.D191220.T2109420")
+	metadata, err = parseMetadata(os.Stdout, "blah/T#EFT.ON.ACO.NGD1800.DPRF.D191220.T2109420")
 	assert.Equal("T#EFT.ON.ACO.NGD1800.DPRF.D191220.T2109420", metadata.name)
 	assert.Equal(expTime.Format("010203040506"), metadata.timestamp.Format("010203040506"))
 	assert.Nil(err)
@@ -231,14 +233,14 @@ func (s *SuppressionTestSuite) TestParseMetadata_InvalidFilename() {
 	assert := assert.New(s.T())
 
 	// invalid file name
-	_, err := parseMetadata("/path/to/file")
+	_, err := parseMetadata(os.Stdout, "/path/to/file")
 	assert.EqualError(err, "invalid filename for file: /path/to/file")
 
-	_, err = parseMetadata("/path/T#EFT.ON.ACO.NGD1800.FRPD.D191220.T1000010")
+	_, err = parseMetadata(os.Stdout, "/path/T#EFT.ON.ACO.NGD1800.FRPD.D191220.T1000010")
 	assert.EqualError(err, "invalid filename for file: /path/T#EFT.ON.ACO.NGD1800.FRPD.D191220.T1000010")
 
 	// invalid date
-	_, err = parseMetadata("/path/T#EFT.ON.ACO.NGD1800.DPRF.D190117.T9909420")
+	_, err = parseMetadata(os.Stdout, "/path/T#EFT.ON.ACO.NGD1800.DPRF.D190117.T9909420")
 	assert.EqualError(err, "failed to parse date 'D190117.T990942' from file: /path/T#EFT.ON.ACO.NGD1800.DPRF.D190117.T9909420: parsing time \"D190117.T990942\": hour out of range")
 }
 
@@ -339,6 +341,49 @@ func (s *SuppressionTestSuite) TestGetSuppressionFileMetadata_TimeChange() {
 	testUtils.ResetFiles(s.Suite, folderPath)
 }
 
+func (s *SuppressionTestSuite) TestValidateSuppressionDirectory() {
+	assert := assert.New(s.T())
+	testUtils.SetPendingDeletionDir(s.Suite)
+	folderPath := BASE_FILE_PATH + "suppressionfile_BadFileNames/"
+	filePath := folderPath + "T#EFT.ON.ACO.NGD1800.FRPD.D191220.T1000009"
+
+	// old enough to be moved to the pending deletion dir by an import
+	timeChange := time.Now().Add(-(time.Hour * 73)).Truncate(time.Second)
+	err := os.Chtimes(filePath, timeChange, timeChange)
+	if err != nil {
+		s.FailNow("Failed to change modified time for file", err)
+	}
+
+	var progress bytes.Buffer
+	checked, problems, err := ValidateSuppressionDirectory(&progress, folderPath)
+	assert.Nil(err)
+	assert.Equal(0, checked)
+	assert.Contains(progress.String(), "Invalid filename for file: T#EFT.ON.ACO.NGD1800.FRPD.D191220.T1000009.")
+	assert.Len(problems, 2)
+	assert.Contains(problems, utils.FileProblem{File: filePath, Problem: "invalid filename for file: T#EFT.ON.ACO.NGD1800.FRPD.D191220.T1000009"})
+
+	// assert that this file is still here.
+	_, err = os.Open(filePath)
+	assert.Nil(err)
+	testUtils.ResetFiles(s.Suite, folderPath)
+
+	folderPath = BASE_FILE_PATH + "suppressionfile_MissingData/"
+	checked, problems, err = ValidateSuppressionDirectory(&progress, folderPath)
+	assert.Nil(err)
+	assert.Equal(5, checked)
+	assert.Len(problems, 5)
+	filePath = folderPath + "T#EFT.ON.ACO.NGD1800.DPRF.D181120.T1000013"
+	assert.Contains(problems, utils.FileProblem{
+		File:    filePath,
+		Problem: fmt.Sprintf("record 1: failed to parse beneficiary link key from file: %s: strconv.Atoi: parsing \"18e7800005\": invalid syntax", filePath),
+	})
+
+	checked, problems, err = ValidateSuppressionDirectory(&progress, BASE_FILE_PATH+"synthetic1800MedicareFiles/test/")
+	assert.Nil(err)
+	assert.Equal(2, checked)
+	assert.Empty(problems)
+}
+
 func (s *SuppressionTestSuite) TestCleanupSuppression() {
 	assert := assert.New(s.T())
 	var suppresslist []*suppressionFileMetadata
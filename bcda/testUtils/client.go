@@ -1,7 +1,9 @@
 package testUtils
 
 import (
+	"io"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"strings"
 	"time"
@@ -17,24 +19,36 @@ type BlueButtonClient struct {
 	MBI  *string
 }
 
-func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (string, error) {
-	args := bbc.Called(patientID)
-	return args.String(0), args.Error(1)
+func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (io.Reader, error) {
+	return mockedReader(bbc.Called(patientID))
 }
 
-func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier, patientIdMode string) (string, error) {
-	args := bbc.Called(hashedIdentifier, patientIdMode)
-	return args.String(0), args.Error(1)
+func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier, patientIdMode string) (io.Reader, error) {
+	return mockedReader(bbc.Called(hashedIdentifier, patientIdMode))
 }
 
-func (bbc *BlueButtonClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (string, error) {
-	args := bbc.Called(patientID, jobID, cmsID)
-	return args.String(0), args.Error(1)
+func (bbc *BlueButtonClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (io.Reader, error) {
+	return mockedReader(bbc.Called(patientID, jobID, cmsID))
 }
 
-func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (string, error) {
-	args := bbc.Called(beneficiaryID, jobID, cmsID)
-	return args.String(0), args.Error(1)
+func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (io.Reader, error) {
+	return mockedReader(bbc.Called(beneficiaryID, jobID, cmsID))
+}
+
+// mockedReader returns a reader of a mocked response, which may be given as a string or, for a search bundle with more
+// than one page, as a []string of pages.
+func mockedReader(args mock.Arguments) (io.Reader, error) {
+	if err := args.Error(1); err != nil {
+		return nil, err
+	}
+	if pages, ok := args.Get(0).([]string); ok {
+		readers := make([]io.Reader, len(pages))
+		for i, page := range pages {
+			readers[i] = strings.NewReader(page)
+		}
+		return io.MultiReader(readers...), nil
+	}
+	return strings.NewReader(args.String(0)), nil
 }
 
 // Returns copy of a static json file (From Blue Button Sandbox originally) after replacing the patient ID of 20000000000001 with the requested identifier
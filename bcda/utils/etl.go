@@ -8,6 +8,12 @@ import (
 	"path/filepath"
 )
 
+// FileProblem is something found wrong with a delivered file when its import is validated without being run.
+type FileProblem struct {
+	File    string `json:"file"`
+	Problem string `json:"problem"`
+}
+
 func DeleteDirectoryContents(dirToDelete string) (filesDeleted int, err error) {
 	fmt.Printf("Preparing to delete directory %v.\n", dirToDelete)
 	log.Infof("Preparing to delete directory %v", dirToDelete)
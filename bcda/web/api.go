@@ -1,11 +1,15 @@
 package web
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/CMSgov/bcda-app/bcda/constants"
+	"io"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 
 	"net/http"
@@ -19,6 +23,7 @@ import (
 	fhirmodels "github.com/eug48/fhir/models"
 	fhirutils "github.com/eug48/fhir/utils"
 	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 
@@ -29,12 +34,17 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 )
 
 var qc *que.Client
 
 const (
-	groupAll = "all"
+	groupAll             = models.GroupAll
+	groupNewlyAttributed = models.GroupNewlyAttributed
+
+	jobListDefaultCount = 50
+	jobListMaxCount     = 200
 )
 
 /*
@@ -63,7 +73,7 @@ func bulkPatientRequest(w http.ResponseWriter, r *http.Request) {
 		responseutils.WriteError(err, w, http.StatusBadRequest)
 		return
 	}
-	bulkRequest(resourceTypes, w, r)
+	bulkRequest(resourceTypes, "", w, r)
 }
 
 /*
@@ -71,7 +81,7 @@ func bulkPatientRequest(w http.ResponseWriter, r *http.Request) {
 
     Start data export (for the specified group identifier) for all supported resource types
 
-	Initiates a job to collect data from the Blue Button API for your ACO. At this time, the only Group identifier supported by the system is `all`, which returns the same data as the Patient endpoint. Supported resource types are Patient, Coverage, and ExplanationOfBenefit.
+	Initiates a job to collect data from the Blue Button API for your ACO. The Group identifier `all` returns the same data as the Patient endpoint, and `new` returns data only for the beneficiaries newly attributed to your ACO by its latest CCLF8 file, as listed by the attribution changes endpoint. Any other Group identifier must name a beneficiary group defined for your ACO; only group members attributed to your ACO in its latest CCLF8 file are exported. Supported resource types are Patient, Coverage, and ExplanationOfBenefit.
 
 	Produces:
 	- application/fhir+json
@@ -83,26 +93,21 @@ func bulkPatientRequest(w http.ResponseWriter, r *http.Request) {
 		202: BulkRequestResponse
 		400: badRequestResponse
 		401: invalidCredentials
+		404: notFoundResponse
 		429: tooManyRequestsResponse
 		500: errorResponse
 */
 func bulkGroupRequest(w http.ResponseWriter, r *http.Request) {
 	groupID := chi.URLParam(r, "groupId")
-	if groupID == groupAll {
-		resourceTypes, err := validateRequest(r)
-		if err != nil {
-			responseutils.WriteError(err, w, http.StatusBadRequest)
-			return
-		}
-		bulkRequest(resourceTypes, w, r)
-	} else {
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "Invalid groupID", responseutils.RequestErr)
-		responseutils.WriteError(oo, w, http.StatusBadRequest)
+	resourceTypes, err := validateRequest(r)
+	if err != nil {
+		responseutils.WriteError(err, w, http.StatusBadRequest)
 		return
 	}
+	bulkRequest(resourceTypes, groupID, w, r)
 }
 
-func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request) {
+func bulkRequest(resourceTypes []string, groupID string, w http.ResponseWriter, r *http.Request) {
 	var (
 		ad  auth.AuthData
 		err error
@@ -114,6 +119,20 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if groupID != "" && groupID != groupAll && groupID != groupNewlyAttributed {
+		if _, err = models.GetBeneficiaryGroup(ad.ACOID, groupID); gorm.IsRecordNotFoundError(err) {
+			log.Errorf("No group %s found for ACO ID %s", groupID, ad.ACOID)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Not_found, "Unknown groupID", responseutils.RequestErr)
+			responseutils.WriteError(oo, w, http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
 
@@ -141,9 +160,13 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request)
 	}
 
 	newJob := models.Job{
-		ACOID:      uuid.Parse(acoID),
-		RequestURL: fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL),
-		Status:     "Pending",
+		ACOID:        uuid.Parse(acoID),
+		RequestURL:   fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL),
+		Status:       "Pending",
+		GroupID:      groupID,
+		OutputFormat: outputFormatFromRequest(r),
+		TypeFilter:   typeFilterFromRequest(r),
+		Elements:     r.URL.Query().Get("_elements"),
 	}
 	if result := db.Save(&newJob); result.Error != nil {
 		log.Error(result.Error.Error())
@@ -160,15 +183,19 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// request a fake patient in order to acquire the bundle's lastUpdated metadata
-	jsonData, err := bb.GetPatient("FAKE_PATIENT", strconv.FormatUint(uint64(newJob.ID), 10), acoID, "", time.Now())
+	patientData, err := bb.GetPatient("FAKE_PATIENT", strconv.FormatUint(uint64(newJob.ID), 10), acoID, "", time.Now())
 	if err != nil {
 		log.Error(err)
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", "Failure to retrieve transactionTime metadata from FHIR Data Server.")
 		responseutils.WriteError(oo, w, http.StatusInternalServerError)
 		return
 	}
+	// the bundle streams from Blue Button, which keeps the connection until it is closed
+	if c, ok := patientData.(io.Closer); ok {
+		defer c.Close()
+	}
 	var patient models.Patient
-	err = json.Unmarshal([]byte(jsonData), &patient)
+	err = json.NewDecoder(patientData).Decode(&patient)
 	if err != nil {
 		log.Error(err)
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", "Failure to parse transactionTime metadata from FHIR Data Server.")
@@ -208,7 +235,15 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if db.Model(&newJob).Update("job_count", len(enqueueJobs)).Error != nil {
+	// the resource types, since, chunk sizes, and beneficiaries are kept so that lost chunks can be regenerated
+	updates := map[string]interface{}{"job_count": len(enqueueJobs), "resource_types": strings.Join(resourceTypes, ","), "since": decodedSince,
+		"chunk_sizes": newJob.ChunkSizes, "beneficiary_digest": newJob.BeneficiaryDigest}
+	// a group with no beneficiaries to export, such as Group/new when the latest CCLF8 file attributes none newly, is
+	// complete with no files
+	if len(enqueueJobs) == 0 {
+		updates["status"] = "Completed"
+	}
+	if db.Model(&newJob).Updates(updates).Error != nil {
 		log.Error(err)
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
 		responseutils.WriteError(oo, w, http.StatusInternalServerError)
@@ -274,7 +309,7 @@ func validateRequest(r *http.Request) ([]string, *fhirmodels.OperationOutcome) {
 		resourceMap := make(map[string]bool)
 		params = strings.Split(params[0], ",")
 		for _, p := range params {
-			if p != "ExplanationOfBenefit" && p != "Patient" && p != "Coverage" {
+			if !utils.ContainsString(constants.ExportResourceTypes, p) {
 				oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "Invalid resource type", responseutils.RequestErr)
 				return nil, oo
 			} else {
@@ -289,7 +324,7 @@ func validateRequest(r *http.Request) ([]string, *fhirmodels.OperationOutcome) {
 		}
 	} else {
 		// resource types not supplied in request; default to applying all resource types.
-		resourceTypes = append(resourceTypes, "Patient", "ExplanationOfBenefit", "Coverage")
+		resourceTypes = append(resourceTypes, constants.ExportResourceTypes...)
 	}
 
 	// validate optional "_since" parameter
@@ -302,15 +337,164 @@ func validateRequest(r *http.Request) ([]string, *fhirmodels.OperationOutcome) {
 		}
 	}
 
+	// validate optional "_outputFormat" parameter
+	params, ok = r.URL.Query()["_outputFormat"]
+	if ok {
+		if _, supported := parseOutputFormat(params[0]); !supported {
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", "Invalid _outputFormat parameter.  Supported formats are application/fhir+ndjson, application/ndjson, ndjson, and application/fhir+ndjson+gzip.")
+			return nil, oo
+		}
+	}
+
+	// validate optional "_typeFilter" parameter
+	params, ok = r.URL.Query()["_typeFilter"]
+	if ok {
+		if _, err := parseTypeFilter(params[0]); err != nil {
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", fmt.Sprintf("Invalid _typeFilter parameter.  %s", err.Error()))
+			return nil, oo
+		}
+	}
+
+	// validate optional "_elements" parameter
+	params, ok = r.URL.Query()["_elements"]
+	if ok {
+		if err := validateElements(params[0]); err != nil {
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", fmt.Sprintf("Invalid _elements parameter.  %s", err.Error()))
+			return nil, oo
+		}
+	}
+
 	return resourceTypes, nil
 }
 
+// elementNamePattern matches the name of a root element of a FHIR resource
+var elementNamePattern = regexp.MustCompile(`^[a-z][A-Za-z0-9]*$`)
+
+// validateElements checks an _elements value: a comma-separated list of root element names, each optionally prefixed
+// by the resource type it applies to, e.g. id,ExplanationOfBenefit.type
+func validateElements(elements string) error {
+	for _, e := range strings.Split(elements, ",") {
+		name := e
+		if parts := strings.SplitN(e, ".", 2); len(parts) == 2 {
+			if !utils.ContainsString(constants.ExportResourceTypes, parts[0]) {
+				return fmt.Errorf("Element %s names an unsupported resource type.", e)
+			}
+			name = parts[1]
+		}
+		if !elementNamePattern.MatchString(name) {
+			return fmt.Errorf("Element %s is not the name of a root element.", e)
+		}
+	}
+	return nil
+}
+
+// typeFilterParams lists the Blue Button search parameters that may appear in a _typeFilter query for each resource
+// type, with the values allowed for each.  Anything else is rejected rather than passed through, so that a filter
+// cannot replace the parameters the Blue Button client sets itself.
+var typeFilterParams = map[string]map[string][]string{
+	"ExplanationOfBenefit": {
+		"type": {"carrier", "dme", "hha", "hospice", "inpatient", "outpatient", "pde", "snf"},
+	},
+}
+
+// parseTypeFilter parses a _typeFilter value, a comma-separated list of queries such as
+// ExplanationOfBenefit?type=carrier,inpatient, into the search parameters to send to Blue Button for each resource type.
+// Commas separate both queries and parameter values, so a piece that does not start a new query continues the previous one.
+func parseTypeFilter(typeFilter string) (map[string]url.Values, error) {
+	var queries []string
+	for _, piece := range strings.Split(typeFilter, ",") {
+		if strings.Index(piece, "?") > 0 || len(queries) == 0 {
+			queries = append(queries, piece)
+		} else {
+			queries[len(queries)-1] += "," + piece
+		}
+	}
+
+	filters := make(map[string]url.Values)
+	for _, query := range queries {
+		parts := strings.SplitN(query, "?", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Query %s must be a resource type followed by ?search parameters.", query)
+		}
+
+		resourceType := parts[0]
+		allowed, ok := typeFilterParams[resourceType]
+		if !ok {
+			return nil, fmt.Errorf("Filtering %s resources is not supported.", resourceType)
+		}
+		if _, repeated := filters[resourceType]; repeated {
+			return nil, fmt.Errorf("Only one query per resource type is supported; %s is repeated.", resourceType)
+		}
+
+		values, err := url.ParseQuery(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Query %s could not be parsed.", query)
+		}
+		for name, vals := range values {
+			allowedValues, ok := allowed[name]
+			if !ok {
+				return nil, fmt.Errorf("Search parameter %s is not supported for %s.", name, resourceType)
+			}
+			for _, v := range vals {
+				for _, item := range strings.Split(v, ",") {
+					if !utils.ContainsString(allowedValues, item) {
+						return nil, fmt.Errorf("Value %s is not supported for %s search parameter %s.", item, resourceType, name)
+					}
+				}
+			}
+		}
+		filters[resourceType] = values
+	}
+
+	return filters, nil
+}
+
+// typeFilterFromRequest returns the _typeFilter queries of an export request that has already passed validateRequest,
+// encoded for storage on the job as resource type=Blue Button query string.
+func typeFilterFromRequest(r *http.Request) string {
+	params, ok := r.URL.Query()["_typeFilter"]
+	if !ok {
+		return ""
+	}
+	filters, err := parseTypeFilter(params[0])
+	if err != nil {
+		return ""
+	}
+	encoded := url.Values{}
+	for resourceType, values := range filters {
+		encoded.Set(resourceType, values.Encode())
+	}
+	return encoded.Encode()
+}
+
+// parseOutputFormat maps a requested _outputFormat value to the format stored on the job.  A '+' sent unencoded in
+// the query string arrives as a space, so both spellings are accepted.
+func parseOutputFormat(format string) (string, bool) {
+	switch strings.Replace(strings.TrimSpace(format), " ", "+", -1) {
+	case "application/fhir+ndjson", "application/ndjson", "ndjson":
+		return constants.FHIRNDJSON, true
+	case "application/fhir+ndjson+gzip":
+		return constants.GzipFHIRNDJSON, true
+	}
+	return "", false
+}
+
+// outputFormatFromRequest returns the output format for an export request that has already passed validateRequest.
+func outputFormatFromRequest(r *http.Request) string {
+	params, ok := r.URL.Query()["_outputFormat"]
+	if !ok {
+		return constants.FHIRNDJSON
+	}
+	format, _ := parseOutputFormat(params[0])
+	return format
+}
+
 /*
 	swagger:route GET /api/v1/jobs/{jobId} bulkData jobStatus
 
 	Get job status
 
-	Returns the current status of an export job.
+	Returns the current status of an export job. A failed job returns an OperationOutcome explaining why it failed, with its error counts by resource type and error code. A completed job lists each file with its resource count and size in bytes, and the number of beneficiaries requested, suppressed, and failed for each resource type.
 
 	Produces:
 	- application/fhir+json
@@ -346,7 +530,8 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 	switch job.Status {
 
 	case "Failed":
-		responseutils.WriteError(&fhirmodels.OperationOutcome{}, w, http.StatusInternalServerError)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", jobFailureMessage(db, job))
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
 	case "Pending":
 		fallthrough
 	case "In Progress":
@@ -372,6 +557,7 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 			TransactionTime:     job.TransactionTime,
 			RequestURL:          job.RequestURL,
 			RequiresAccessToken: true,
+			OutputFormat:        job.GetOutputFormat(),
 			Files:               []fileItem{},
 			Errors:              []fileItem{},
 			JobID:               job.ID,
@@ -380,25 +566,55 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 		var jobKeysObj []models.JobKey
 		db.Find(&jobKeysObj, "job_id = ?", job.ID)
 		for _, jobKey := range jobKeysObj {
-
-			// data files
 			fi := fileItem{
-				Type: jobKey.ResourceType,
-				URL:  fmt.Sprintf("%s://%s/data/%s/%s", scheme, r.Host, jobID, strings.TrimSpace(jobKey.FileName)),
+				Type:  jobKey.ResourceType,
+				URL:   fmt.Sprintf("%s://%s/data/%s/%s", scheme, r.Host, jobID, strings.TrimSpace(jobKey.FileName)),
+				Count: jobKey.RecordCount,
+			}
+			// files written before sizes were recorded have none
+			if jobKey.ByteSize > 0 {
+				fi.Extension = &fileItemExtension{ByteSize: jobKey.ByteSize}
 			}
 			rb.Files = append(rb.Files, fi)
+		}
+		if counts := beneficiaryCountsByType(jobKeysObj); len(counts) > 0 {
+			rb.Extension = &bulkResponseExtension{Beneficiaries: counts}
+		}
 
-			// error files
-			errFileName := strings.Split(jobKey.FileName, ".")[0]
-			errFilePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_PAYLOAD_DIR"), jobID, errFileName)
-			if _, err := os.Stat(errFilePath); !os.IsNotExist(err) {
-				errFI := fileItem{
-					Type: "OperationOutcome",
-					URL:  fmt.Sprintf("%s://%s/data/%s/%s-error.ndjson", scheme, r.Host, jobID, errFileName),
-				}
-				rb.Errors = append(rb.Errors, errFI)
+		// error files, as recorded by the worker
+		errFiles, err := models.GetJobErrorFiles(db, job.ID)
+		if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+		// jobs finished before the worker recorded its errors have only the error files alongside their data files
+		if len(errFiles) == 0 {
+			errFiles, err = findJobErrorFiles(jobID, jobKeysObj)
+			if err != nil {
+				log.Error(err)
+				oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.InternalErr)
+				responseutils.WriteError(oo, w, http.StatusInternalServerError)
+				return
 			}
 		}
+		for _, errFile := range errFiles {
+			errFI := fileItem{
+				Type:  "OperationOutcome",
+				URL:   fmt.Sprintf("%s://%s/data/%s/%s", scheme, r.Host, jobID, errFile.FileName),
+				Count: errFile.Count,
+			}
+			rb.Errors = append(rb.Errors, errFI)
+		}
+
+		rb.ErrorSummary, err = models.GetJobErrorSummary(db, job.ID)
+		if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
 
 		jsonData, err := json.Marshal(rb)
 		if err != nil {
@@ -417,6 +633,8 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	case "Archived":
 		fallthrough
+	case "Cancelled":
+		fallthrough
 	case "Expired":
 		w.Header().Set("Expires", job.UpdatedAt.Add(GetJobTimeout()).String())
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.Deleted)
@@ -424,15 +642,341 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// beneficiaryCountsByType totals the beneficiaries requested, suppressed, and failed by each resource type's files.
+// Files written before the counts were recorded are skipped.
+func beneficiaryCountsByType(jobKeys []models.JobKey) []beneficiaryCounts {
+	var counts []beneficiaryCounts
+	index := make(map[string]int)
+	for _, jobKey := range jobKeys {
+		if jobKey.BeneficiaryCount == 0 {
+			continue
+		}
+		i, ok := index[jobKey.ResourceType]
+		if !ok {
+			i = len(counts)
+			index[jobKey.ResourceType] = i
+			counts = append(counts, beneficiaryCounts{Type: jobKey.ResourceType})
+		}
+		counts[i].Requested += jobKey.BeneficiaryCount
+		counts[i].Suppressed += jobKey.SuppressedCount
+		counts[i].Failed += jobKey.FailedCount
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Type < counts[j].Type })
+	return counts
+}
+
+// findJobErrorFiles looks in the job's payload directory for the error file written alongside each of its data files.
+// The number of errors in each file is unknown.
+func findJobErrorFiles(jobID string, jobKeys []models.JobKey) ([]models.JobErrorFile, error) {
+	store, err := storage.Get()
+	if err != nil {
+		return nil, err
+	}
+	var errFiles []models.JobErrorFile
+	for _, jobKey := range jobKeys {
+		errFileName := strings.Split(jobKey.FileName, ".")[0] + "-error.ndjson"
+		f, err := store.Open(storage.Payload, jobID+"/"+errFileName)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		f.Close()
+		errFiles = append(errFiles, models.JobErrorFile{FileName: errFileName})
+	}
+	return errFiles, nil
+}
+
+// jobFailureMessage explains why a job failed, followed by the errors its chunks recorded.
+func jobFailureMessage(db *gorm.DB, job models.Job) string {
+	msg := "Export job failed."
+	if job.FailureReason != "" {
+		msg += " " + job.FailureReason
+	}
+
+	summary, err := models.GetJobErrorSummary(db, job.ID)
+	if err != nil {
+		log.Error(err)
+		return msg
+	}
+	var counts []string
+	for _, s := range summary {
+		counts = append(counts, fmt.Sprintf("%s %s: %d", s.ResourceType, s.Code, s.Count))
+	}
+	if len(counts) > 0 {
+		msg += " Errors by resource type and code: " + strings.Join(counts, ", ") + "."
+	}
+	return msg
+}
+
+/*
+	swagger:route GET /api/v1/jobs bulkData listJobs
+
+	List jobs
+
+	Returns the export jobs started by your ACO, newest first. Jobs can be filtered by status and by creation time, and are returned in pages.
+
+	Produces:
+	- application/json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		200: jobListResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		500: errorResponse
+*/
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	ad, err := readAuthData(r)
+	if err != nil {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.TokenErr)
+		responseutils.WriteError(oo, w, http.StatusUnauthorized)
+		return
+	}
+
+	statuses, createdSince, count, page, oo := validateJobListRequest(r)
+	if oo != nil {
+		responseutils.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	jobs, total, err := models.GetJobs(db, ad.ACOID, statuses, createdSince, count, (page-1)*count)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if servicemux.IsHTTPS(r) {
+		scheme = "https"
+	}
+
+	body := jobListBody{Total: total, Jobs: []jobListItem{}}
+	for _, job := range jobs {
+		body.Jobs = append(body.Jobs, jobListItem{
+			ID:         job.ID,
+			Status:     job.StatusMessage(),
+			RequestURL: job.RequestURL,
+			StatusURL:  fmt.Sprintf("%s://%s/api/v1/jobs/%d", scheme, r.Host, job.ID),
+			CreatedAt:  job.CreatedAt,
+		})
+	}
+
+	if page*count < total {
+		q := r.URL.Query()
+		q.Set("_page", strconv.Itoa(page+1))
+		body.Next = fmt.Sprintf("%s://%s%s?%s", scheme, r.Host, r.URL.Path, q.Encode())
+	}
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.Processing)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonData)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func validateJobListRequest(r *http.Request) (statuses []string, createdSince time.Time, count, page int, oo *fhirmodels.OperationOutcome) {
+	count, page = jobListDefaultCount, 1
+
+	// validate optional "status" parameter
+	if params, ok := r.URL.Query()["status"]; ok {
+		for _, p := range strings.Split(params[0], ",") {
+			if !utils.ContainsString(models.JobStatuses, p) {
+				oo = responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", fmt.Sprintf("Invalid status supplied in status parameter.  Status must be one of: %s.", strings.Join(models.JobStatuses, ", ")))
+				return
+			}
+			statuses = append(statuses, p)
+		}
+	}
+
+	// validate optional "_since" parameter
+	if params, ok := r.URL.Query()["_since"]; ok {
+		d, err := fhirutils.ParseDate(params[0])
+		if err != nil {
+			oo = responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", "Invalid date format supplied in _since parameter.  Date must be in FHIR DateTime format.")
+			return
+		}
+		createdSince = d.Value
+	}
+
+	// validate optional "_count" and "_page" parameters
+	if params, ok := r.URL.Query()["_count"]; ok {
+		c, err := strconv.Atoi(params[0])
+		if err != nil || c < 1 || c > jobListMaxCount {
+			oo = responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", fmt.Sprintf("Invalid _count parameter.  Count must be between 1 and %d.", jobListMaxCount))
+			return
+		}
+		count = c
+	}
+	if params, ok := r.URL.Query()["_page"]; ok {
+		p, err := strconv.Atoi(params[0])
+		if err != nil || p < 1 {
+			oo = responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", "Invalid _page parameter.  Page must be a positive integer.")
+			return
+		}
+		page = p
+	}
+
+	return
+}
+
+/*
+	swagger:route DELETE /api/v1/jobs/{jobId} bulkData deleteJob
+
+	Cancel job
+
+	Cancels a pending or in-progress export job. Queued work for the job is discarded and any data files it had generated are deleted.
+
+	Produces:
+	- application/fhir+json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		202: deleteJobResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		410: goneResponse
+		500: errorResponse
+*/
+func deleteJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var job models.Job
+	err := db.Find(&job, "id = ?", jobID).Error
+	if err != nil {
+		log.Print(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+		return
+	}
+
+	cancelled, err := job.Cancel(db)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	if !cancelled {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", fmt.Sprintf("Job %s is not pending or in progress and cannot be cancelled.", jobID))
+		responseutils.WriteError(oo, w, http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/*
+	swagger:route GET /api/v1/attribution/changes bulkData attributionChanges
+
+	List attribution changes
+
+	Returns the beneficiaries, identified by MBI, added to and dropped from your ACO by its latest CCLF8 file, compared with its CCLF8 file before that for the same performance year. Data for the added beneficiaries can be exported with Group/new/$export.
+
+	Produces:
+	- application/json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		200: attributionChangesResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		500: errorResponse
+*/
+func attributionChanges(w http.ResponseWriter, r *http.Request) {
+	ad, err := readAuthData(r)
+	if err != nil {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.TokenErr)
+		responseutils.WriteError(oo, w, http.StatusUnauthorized)
+		return
+	}
+
+	aco, err := auth.GetACOByUUID(ad.ACOID)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := aco.GetAttributionChanges()
+	if err == models.ErrNoCCLF8File {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Not_found, "", responseutils.RequestErr)
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.DbErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	body := attributionChangesBody{
+		File:            changes.File.Name,
+		FileTimestamp:   changes.File.Timestamp,
+		PerformanceYear: changes.File.PerformanceYear,
+		Added:           []string{},
+		Dropped:         []string{},
+	}
+	if changes.PreviousFile != nil {
+		body.PreviousFile = changes.PreviousFile.Name
+	}
+	body.Added = append(body.Added, changes.Added...)
+	body.Dropped = append(body.Dropped, changes.Dropped...)
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.Processing)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonData)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
 /*
 	swagger:route GET /data/{jobId}/{filename} bulkData serveData
 
 	Get data file
 
-	Returns the NDJSON file of data generated by an export job.  Will be in the format <UUID>.ndjson.  Get the full value from the job status response
+	Returns the NDJSON file of data generated by an export job.  Will be in the format <UUID>.ndjson.  Get the full value from the job status response.  Send `Accept-Encoding: gzip` to receive the file gzip-compressed.  Interrupted downloads of the uncompressed file can be resumed with a `Range` header; use the `ETag` from the first response in `If-Range` to make sure the file has not changed.
 
 	Produces:
-	- application/fhir+json
+	- application/fhir+ndjson
 
 	Schemes: http, https
 
@@ -441,16 +985,129 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 
 	Responses:
 		200: FileNDJSON
+		206: FileNDJSON
+		304: notModifiedResponse
 		400: badRequestResponse
 		401: invalidCredentials
         404: notFoundResponse
+		416: rangeNotSatisfiableResponse
 		500: errorResponse
 */
 func serveData(w http.ResponseWriter, r *http.Request) {
-	dataDir := os.Getenv("FHIR_PAYLOAD_DIR")
 	fileName := chi.URLParam(r, "fileName")
 	jobID := chi.URLParam(r, "jobID")
-	http.ServeFile(w, r, fmt.Sprintf("%s/%s/%s", dataDir, jobID, fileName))
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	// Only serve files the job produced: its data files and the error files that go with them
+	dataFileNames := []string{fileName}
+	if strings.HasSuffix(fileName, "-error.ndjson") {
+		fileUUID := strings.TrimSuffix(fileName, "-error.ndjson")
+		dataFileNames = []string{fileUUID + ".ndjson", fileUUID + ".ndjson.gz"}
+	}
+	var count int
+	err := db.Model(&models.JobKey{}).Where("job_id = ? and file_name in (?)", jobID, dataFileNames).Count(&count).Error
+	if err != nil || count == 0 {
+		log.Errorf("File %s not found for job %s: %v", fileName, jobID, err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.Not_found)
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+		return
+	}
+
+	store, err := storage.Get()
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.InternalErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+	f, err := store.Open(storage.Payload, jobID+"/"+fileName)
+	if os.IsNotExist(err) {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.Not_found)
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.InternalErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.InternalErr)
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Files written with the gzip output format are already compressed and are served as they are
+	if strings.HasSuffix(fileName, ".gz") {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("ETag", dataFileETag(fi, ""))
+		http.ServeContent(w, r, fileName, fi.ModTime(), f)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/fhir+ndjson")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Range requests are for resuming a download, so they are always served from the uncompressed file
+	if !acceptsGzip(r) || r.Header.Get("Range") != "" {
+		w.Header().Set("ETag", dataFileETag(fi, ""))
+		http.ServeContent(w, r, fileName, fi.ModTime(), f)
+		return
+	}
+
+	etag := dataFileETag(fi, "gzip")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+
+	gw := gzip.NewWriter(w)
+	if _, err = io.Copy(gw, f); err != nil {
+		// The status line has been sent, so the client sees a truncated stream
+		log.Error(err)
+	}
+	if err = gw.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		// "gzip;q=0" means the client refuses gzip
+		for _, param := range parts[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// dataFileETag identifies the content of a data file by its size and modification time. Data files are not modified
+// once a job completes, so a changed ETag means the file was replaced.
+func dataFileETag(fi os.FileInfo, encoding string) string {
+	if encoding != "" {
+		return fmt.Sprintf(`"%x-%x-%s"`, fi.ModTime().UnixNano(), fi.Size(), encoding)
+	}
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
 }
 
 /*
@@ -458,7 +1115,7 @@ func serveData(w http.ResponseWriter, r *http.Request) {
 
 	Get metadata
 
-	Returns metadata about the API.
+	Returns the FHIR CapabilityStatement for the API: the resource types that can be exported, the export operations, and how to authorize.
 
 	Produces:
 	- application/fhir+json
@@ -480,6 +1137,38 @@ func metadata(w http.ResponseWriter, r *http.Request) {
 	responseutils.WriteCapabilityStatement(statement, w)
 }
 
+/*
+	swagger:route GET /api/v1/OperationDefinition/{operationId} metadata operationDefinition
+
+	Get operation definition
+
+	Returns the FHIR OperationDefinition for an export operation: patient-export or group-export.
+
+	Produces:
+	- application/fhir+json
+
+	Schemes: http, https
+
+	Responses:
+		200: OperationDefinitionResponse
+		404: notFoundResponse
+*/
+func operationDefinition(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if servicemux.IsHTTPS(r) {
+		scheme = "https"
+	}
+	host := fmt.Sprintf("%s://%s", scheme, r.Host)
+
+	definition := responseutils.CreateOperationDefinition(chi.URLParam(r, "operationID"), time.Now(), constants.Version, host)
+	if definition == nil {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, "", responseutils.Not_found)
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+		return
+	}
+	responseutils.WriteOperationDefinition(definition, w)
+}
+
 /*
 	swagger:route GET /_version metadata getVersion
 
@@ -575,6 +1264,92 @@ type fileItem struct {
 	Type string `json:"type"`
 	// URL of the file
 	URL string `json:"url"`
+	// Number of resources in the file
+	Count int `json:"count,omitempty"`
+	// BCDA-specific information about the file
+	Extension *fileItemExtension `json:"extension,omitempty"`
+}
+
+// swagger:model fileItemExtension
+type fileItemExtension struct {
+	// Size of the file in bytes, as served (compressed for gzip output)
+	ByteSize int64 `json:"byteSize"`
+}
+
+// swagger:model beneficiaryCounts
+type beneficiaryCounts struct {
+	// FHIR resource type exported
+	Type string `json:"type"`
+	// Number of beneficiaries whose data was requested
+	Requested int `json:"requested"`
+	// Number of beneficiaries skipped because they opted out of data sharing
+	Suppressed int `json:"suppressed"`
+	// Number of beneficiaries whose data could not be retrieved
+	Failed int `json:"failed"`
+}
+
+// swagger:model bulkResponseExtension
+type bulkResponseExtension struct {
+	// Beneficiary counts by resource type
+	Beneficiaries []beneficiaryCounts `json:"beneficiaries"`
+}
+
+// swagger:model jobListItem
+type jobListItem struct {
+	// ID of the export job
+	ID uint `json:"id"`
+	// Status of the job, including percent complete for jobs in progress
+	Status string `json:"status"`
+	// URL of the bulk data export request
+	RequestURL string `json:"request"`
+	// URL of the job status endpoint for the job
+	StatusURL string `json:"statusUrl"`
+	// Server time when the job was created
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type jobListBody struct {
+	// Number of jobs matching the filters, across all pages
+	Total int `json:"total"`
+	// Jobs on this page
+	Jobs []jobListItem `json:"jobs"`
+	// URL of the next page of jobs; omitted on the last page
+	Next string `json:"next,omitempty"`
+}
+
+/*
+The ACO's export jobs.
+swagger:response jobListResponse
+*/
+// nolint
+type JobListResponse struct {
+	// in: body
+	Body jobListBody
+}
+
+type attributionChangesBody struct {
+	// Name of the ACO's latest CCLF8 file
+	File string `json:"file"`
+	// Time the latest CCLF8 file was created
+	FileTimestamp time.Time `json:"fileTimestamp"`
+	// Performance year of the latest CCLF8 file
+	PerformanceYear int `json:"performanceYear"`
+	// Name of the CCLF8 file the changes are from; omitted if the latest file is the first of its performance year, in which case there are no changes
+	PreviousFile string `json:"previousFile,omitempty"`
+	// MBIs of the beneficiaries added to the ACO
+	Added []string `json:"added"`
+	// MBIs of the beneficiaries dropped from the ACO
+	Dropped []string `json:"dropped"`
+}
+
+/*
+The changes to the ACO's attribution made by its latest CCLF8 file.
+swagger:response attributionChangesResponse
+*/
+// nolint
+type AttributionChangesResponse struct {
+	// in: body
+	Body attributionChangesBody
 }
 
 /*
@@ -594,10 +1369,16 @@ type bulkResponseBody struct {
 	RequestURL string `json:"request"`
 	// Indicates whether an access token is required to download generated data files
 	RequiresAccessToken bool `json:"requiresAccessToken"`
+	// Format of the generated data files
+	OutputFormat string `json:"outputFormat"`
 	// Information about generated data files, including URLs for downloading
 	Files []fileItem `json:"output"`
 	// Information about error files, including URLs for downloading
 	Errors []fileItem `json:"error"`
+	// Number of errors by resource type and error code
+	ErrorSummary []models.JobErrorSummary `json:"errorSummary,omitempty"`
+	// BCDA-specific information about the export
+	Extension *bulkResponseExtension `json:"extension,omitempty"`
 	JobID  uint
 }
 
@@ -1,10 +1,12 @@
 package web
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -183,6 +185,71 @@ func (s *APITestSuite) TestValidateRequest() {
 	validateRequestHelper("Group", s)
 }
 
+func (s *APITestSuite) TestValidateRequestOutputFormat() {
+	for _, format := range []string{"application%2Ffhir%2Bndjson", "application/fhir+ndjson", "application/ndjson", "ndjson", "application/fhir%2Bndjson%2Bgzip"} {
+		req := httptest.NewRequest("GET", "/api/v1/Patient/$export?_outputFormat="+format, nil)
+		_, oo := validateRequest(req)
+		assert.Nil(s.T(), oo, format)
+	}
+	req := httptest.NewRequest("GET", "/api/v1/Patient/$export?_outputFormat=application/fhir%2Bndjson%2Bgzip", nil)
+	assert.Equal(s.T(), constants.GzipFHIRNDJSON, outputFormatFromRequest(req))
+	req = httptest.NewRequest("GET", "/api/v1/Patient/$export?_outputFormat=ndjson", nil)
+	assert.Equal(s.T(), constants.FHIRNDJSON, outputFormatFromRequest(req))
+	req = httptest.NewRequest("GET", "/api/v1/Patient/$export", nil)
+	assert.Equal(s.T(), constants.FHIRNDJSON, outputFormatFromRequest(req))
+
+	req = httptest.NewRequest("GET", "/api/v1/Patient/$export?_outputFormat=application/fhir%2Bjson", nil)
+	resourceTypes, oo := validateRequest(req)
+	assert.Nil(s.T(), resourceTypes)
+	assert.NotNil(s.T(), oo)
+	assert.Equal(s.T(), responseutils.Error, oo.Issue[0].Severity)
+	assert.Contains(s.T(), oo.Issue[0].Details.Coding[0].Display, "_outputFormat")
+}
+
+func (s *APITestSuite) TestValidateRequestTypeFilter() {
+	req := httptest.NewRequest("GET", "/api/v1/Patient/$export?_typeFilter=ExplanationOfBenefit%3Ftype%3Dcarrier,inpatient", nil)
+	_, oo := validateRequest(req)
+	assert.Nil(s.T(), oo)
+	filters, err := parseTypeFilter(req.URL.Query().Get("_typeFilter"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "carrier,inpatient", filters["ExplanationOfBenefit"].Get("type"))
+	assert.Equal(s.T(), "ExplanationOfBenefit=type%3Dcarrier%252Cinpatient", typeFilterFromRequest(req))
+
+	req = httptest.NewRequest("GET", "/api/v1/Patient/$export", nil)
+	assert.Equal(s.T(), "", typeFilterFromRequest(req))
+
+	for _, typeFilter := range []string{
+		"ExplanationOfBenefit",
+		"Patient%3Fgender%3Dfemale",
+		"Coverage%3Fstatus%3Dactive",
+		"ExplanationOfBenefit%3Fpatient%3D12345",
+		"ExplanationOfBenefit%3Ftype%3Dprofessional",
+		"ExplanationOfBenefit%3Ftype%3Dcarrier,ExplanationOfBenefit%3Ftype%3Dpde",
+	} {
+		req = httptest.NewRequest("GET", "/api/v1/Patient/$export?_typeFilter="+typeFilter, nil)
+		resourceTypes, oo := validateRequest(req)
+		assert.Nil(s.T(), resourceTypes, typeFilter)
+		if assert.NotNil(s.T(), oo, typeFilter) {
+			assert.Contains(s.T(), oo.Issue[0].Details.Coding[0].Display, "Invalid _typeFilter parameter.")
+		}
+	}
+}
+
+func (s *APITestSuite) TestValidateRequestElements() {
+	req := httptest.NewRequest("GET", "/api/v1/Patient/$export?_elements=id,ExplanationOfBenefit.type,Patient.name", nil)
+	_, oo := validateRequest(req)
+	assert.Nil(s.T(), oo)
+
+	for _, elements := range []string{"", "Practitioner.name", "Patient.name.given", "ExplanationOfBenefit.", "value[x]", "id,"} {
+		req = httptest.NewRequest("GET", "/api/v1/Patient/$export?_elements="+url.QueryEscape(elements), nil)
+		resourceTypes, oo := validateRequest(req)
+		assert.Nil(s.T(), resourceTypes, elements)
+		if assert.NotNil(s.T(), oo, elements) {
+			assert.Contains(s.T(), oo.Issue[0].Details.Coding[0].Display, "Invalid _elements parameter.")
+		}
+	}
+}
+
 func (s *APITestSuite) TestBulkPatientRequestBBClientFailure() {
 	bulkPatientRequestBBClientFailureHelper("Patient", s)
 	s.TearDownTest()
@@ -780,6 +847,55 @@ func bulkRequestHelper(endpoint, resourceType, since string) (string, func(http.
 	return requestUrl.Path, handlerFunc, req
 }
 
+func (s *APITestSuite) TestBulkGroupRequestGroupNotFound() {
+	req := httptest.NewRequest("GET", "/api/v1/Group/no-such-group/$export", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupId", "no-such-group")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues(constants.DevACOUUID)
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	handler := http.HandlerFunc(bulkGroupRequest)
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusNotFound, s.rr.Code)
+
+	var respOO fhirmodels.OperationOutcome
+	err := json.Unmarshal(s.rr.Body.Bytes(), &respOO)
+	if err != nil {
+		s.T().Error(err)
+	}
+
+	assert.Equal(s.T(), responseutils.Error, respOO.Issue[0].Severity)
+	assert.Equal(s.T(), responseutils.Not_found, respOO.Issue[0].Code)
+	assert.Equal(s.T(), responseutils.RequestErr, respOO.Issue[0].Details.Coding[0].Display)
+}
+
+func (s *APITestSuite) TestBulkGroupRequestGroupDbErr() {
+	req := httptest.NewRequest("GET", "/api/v1/Group/some-group/$export", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupId", "some-group")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	// an ACO ID that isn't a UUID makes the group query fail
+	ad := makeContextValues("not-a-uuid")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	handler := http.HandlerFunc(bulkGroupRequest)
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusInternalServerError, s.rr.Code)
+
+	var respOO fhirmodels.OperationOutcome
+	err := json.Unmarshal(s.rr.Body.Bytes(), &respOO)
+	if err != nil {
+		s.T().Error(err)
+	}
+
+	assert.Equal(s.T(), responseutils.Error, respOO.Issue[0].Severity)
+	assert.Equal(s.T(), responseutils.Exception, respOO.Issue[0].Code)
+	assert.Equal(s.T(), responseutils.DbErr, respOO.Issue[0].Details.Coding[0].Display)
+}
+
 func (s *APITestSuite) TestJobStatusInvalidJobID() {
 	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%s", "test"), nil)
 
@@ -887,12 +1003,16 @@ func (s *APITestSuite) TestJobStatusInProgress() {
 
 func (s *APITestSuite) TestJobStatusFailed() {
 	j := models.Job{
-		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
-		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
-		Status:     "Failed",
+		ACOID:         uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL:    "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:        "Failed",
+		FailureReason: "2 of 3 ExplanationOfBenefit requests to Blue Button failed (66.7%), exceeding the failure threshold of 60%.",
 	}
 
 	s.db.Save(&j)
+	jobError := models.JobError{JobID: j.ID, ResourceType: "ExplanationOfBenefit", Code: responseutils.BbErr, Count: 2, FileName: "a-error.ndjson"}
+	s.db.Save(&jobError)
+	defer s.db.Unscoped().Delete(&jobError)
 
 	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
 
@@ -907,6 +1027,10 @@ func (s *APITestSuite) TestJobStatusFailed() {
 	handler.ServeHTTP(s.rr, req)
 
 	assert.Equal(s.T(), http.StatusInternalServerError, s.rr.Code)
+	var oo fhirmodels.OperationOutcome
+	err := json.Unmarshal(s.rr.Body.Bytes(), &oo)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "Export job failed. 2 of 3 ExplanationOfBenefit requests to Blue Button failed (66.7%), exceeding the failure threshold of 60%. Errors by resource type and code: ExplanationOfBenefit Blue Button Error: 2.", oo.Issue[0].Details.Coding[0].Display)
 
 	s.db.Unscoped().Delete(&j)
 }
@@ -959,6 +1083,7 @@ func (s *APITestSuite) TestJobStatusCompleted() {
 
 	assert.Equal(s.T(), j.RequestURL, rb.RequestURL)
 	assert.Equal(s.T(), true, rb.RequiresAccessToken)
+	assert.Equal(s.T(), constants.FHIRNDJSON, rb.OutputFormat)
 	assert.Equal(s.T(), "ExplanationOfBenefit", rb.Files[0].Type)
 	assert.Equal(s.T(), len(expectedUrls), len(rb.Files))
 	// Order of these values is impossible to know so this is the only way
@@ -1037,11 +1162,110 @@ func (s *APITestSuite) TestJobStatusCompletedErrorFileExists() {
 	assert.Equal(s.T(), dataurl, rb.Files[0].URL)
 	assert.Equal(s.T(), "OperationOutcome", rb.Errors[0].Type)
 	assert.Equal(s.T(), errorurl, rb.Errors[0].URL)
+	// the job has no recorded errors, so the error file is found on disk and its count is unknown
+	assert.Zero(s.T(), rb.Errors[0].Count)
+	assert.Empty(s.T(), rb.ErrorSummary)
+	// the job key has no counts, so none are reported
+	assert.Zero(s.T(), rb.Files[0].Count)
+	assert.Nil(s.T(), rb.Files[0].Extension)
+	assert.Nil(s.T(), rb.Extension)
 
 	s.db.Unscoped().Delete(&j)
 	os.Remove(errFilePath)
 }
 
+func (s *APITestSuite) TestJobStatusCompletedJobErrors() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Completed",
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+	jobKey := models.JobKey{JobID: j.ID, FileName: "eob.ndjson", ResourceType: "ExplanationOfBenefit"}
+	s.db.Save(&jobKey)
+	jobErrors := []models.JobError{
+		{JobID: j.ID, ResourceType: "ExplanationOfBenefit", Code: responseutils.BbErr, Count: 3, FileName: "eob-error.ndjson"},
+		{JobID: j.ID, ResourceType: "ExplanationOfBenefit", Code: responseutils.InternalErr, Count: 1, FileName: "eob-error.ndjson"},
+	}
+	for i := range jobErrors {
+		s.db.Save(&jobErrors[i])
+		defer s.db.Unscoped().Delete(&jobErrors[i])
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	http.HandlerFunc(jobStatus).ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	var rb bulkResponseBody
+	assert.Nil(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &rb))
+	// the recorded error file is listed without looking for it on disk
+	assert.Len(s.T(), rb.Errors, 1)
+	assert.Equal(s.T(), "OperationOutcome", rb.Errors[0].Type)
+	assert.Equal(s.T(), fmt.Sprintf("http://example.com/data/%d/eob-error.ndjson", j.ID), rb.Errors[0].URL)
+	assert.Equal(s.T(), 4, rb.Errors[0].Count)
+	assert.Equal(s.T(), []models.JobErrorSummary{
+		{ResourceType: "ExplanationOfBenefit", Code: responseutils.BbErr, Count: 3},
+		{ResourceType: "ExplanationOfBenefit", Code: responseutils.InternalErr, Count: 1},
+	}, rb.ErrorSummary)
+}
+
+func (s *APITestSuite) TestJobStatusCompletedCounts() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "Completed",
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	jobKeys := []models.JobKey{
+		{JobID: j.ID, FileName: "eob1.ndjson", ResourceType: "ExplanationOfBenefit", RecordCount: 66, ByteSize: 12345, BeneficiaryCount: 50, SuppressedCount: 2, FailedCount: 1},
+		{JobID: j.ID, FileName: "eob2.ndjson", ResourceType: "ExplanationOfBenefit", RecordCount: 33, ByteSize: 6789, BeneficiaryCount: 25, SuppressedCount: 1},
+		{JobID: j.ID, FileName: "patient.ndjson", ResourceType: "Patient", RecordCount: 75, ByteSize: 4321, BeneficiaryCount: 75, SuppressedCount: 3},
+	}
+	for i := range jobKeys {
+		assert.Nil(s.T(), s.db.Save(&jobKeys[i]).Error)
+	}
+	defer s.db.Unscoped().Where("job_id = ?", j.ID).Delete(&models.JobKey{})
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	http.HandlerFunc(jobStatus).ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+
+	var rb bulkResponseBody
+	err := json.Unmarshal(s.rr.Body.Bytes(), &rb)
+	assert.Nil(s.T(), err)
+
+	assert.Len(s.T(), rb.Files, 3)
+	for _, file := range rb.Files {
+		for _, jobKey := range jobKeys {
+			if strings.HasSuffix(file.URL, "/"+jobKey.FileName) {
+				assert.Equal(s.T(), jobKey.RecordCount, file.Count)
+				assert.Equal(s.T(), &fileItemExtension{ByteSize: jobKey.ByteSize}, file.Extension)
+			}
+		}
+	}
+
+	assert.NotNil(s.T(), rb.Extension)
+	assert.Equal(s.T(), []beneficiaryCounts{
+		{Type: "ExplanationOfBenefit", Requested: 75, Suppressed: 3, Failed: 1},
+		{Type: "Patient", Requested: 75, Suppressed: 3, Failed: 0},
+	}, rb.Extension.Beneficiaries)
+}
+
 func (s *APITestSuite) TestJobStatusExpired() {
 	j := models.Job{
 		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
@@ -1126,21 +1350,317 @@ func (s *APITestSuite) TestJobStatusArchived() {
 	s.db.Unscoped().Delete(&j)
 }
 
-func (s *APITestSuite) TestServeData() {
-	os.Setenv("FHIR_PAYLOAD_DIR", "../../bcdaworker/data/test")
-	req := httptest.NewRequest("GET", "/data/test.ndjson", nil)
+func (s *APITestSuite) TestListJobs() {
+	acoID, err := models.CreateACO("List Jobs ACO", nil)
+	assert.Nil(s.T(), err)
+	defer s.db.Unscoped().Delete(&models.ACO{}, "uuid = ?", acoID)
+
+	for _, status := range []string{"Pending", "Completed", "Failed"} {
+		j := models.Job{ACOID: acoID, RequestURL: "/api/v1/Patient/$export", Status: status}
+		s.db.Save(&j)
+		defer s.db.Unscoped().Delete(&j)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/jobs?status=Completed,Failed&_count=1", nil)
+	ad := makeContextValues(acoID.String())
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	http.HandlerFunc(listJobs).ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	assert.Equal(s.T(), "application/json", s.rr.Header().Get("Content-Type"))
+
+	var body jobListBody
+	err = json.Unmarshal(s.rr.Body.Bytes(), &body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, body.Total)
+	assert.Len(s.T(), body.Jobs, 1)
+	assert.Equal(s.T(), "Failed", body.Jobs[0].Status)
+	assert.Equal(s.T(), fmt.Sprintf("http://example.com/api/v1/jobs/%d", body.Jobs[0].ID), body.Jobs[0].StatusURL)
+	assert.Contains(s.T(), body.Next, "_page=2")
+}
+
+func (s *APITestSuite) TestAttributionChanges() {
+	cmsID := "T0008"
+	acoID, err := models.CreateACO("Attribution Changes ACO", &cmsID)
+	assert.Nil(s.T(), err)
+	defer s.db.Unscoped().Delete(&models.ACO{}, "uuid = ?", acoID)
+
+	serve := func() {
+		s.rr = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/v1/attribution/changes", nil)
+		ad := makeContextValues(acoID.String())
+		req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+		http.HandlerFunc(attributionChanges).ServeHTTP(s.rr, req)
+	}
+
+	// no CCLF8 file yet
+	serve()
+	assert.Equal(s.T(), http.StatusNotFound, s.rr.Code)
+
+	var files []*models.CCLFFile
+	for i, mbis := range [][]string{{"1A00A00AA01", "1A00A00AA02"}, {"1A00A00AA02", "1A00A00AA03"}} {
+		f := &models.CCLFFile{CCLFNum: 8, Name: fmt.Sprintf("T.BCD.%s.ZC8Y19.D19010%d.T0000000", cmsID, i+1), ACOCMSID: cmsID,
+			Timestamp: time.Now().Add(time.Duration(i-2) * time.Hour), PerformanceYear: 19, ImportStatus: constants.ImportComplete}
+		s.db.Save(f)
+		defer f.Delete()
+		for _, mbi := range mbis {
+			s.db.Save(&models.CCLFBeneficiary{FileID: f.ID, MBI: mbi, HICN: mbi})
+		}
+		assert.Nil(s.T(), f.RecordAttributionChanges(s.db))
+		files = append(files, f)
+	}
+
+	serve()
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	assert.Equal(s.T(), "application/json", s.rr.Header().Get("Content-Type"))
+
+	var body attributionChangesBody
+	err = json.Unmarshal(s.rr.Body.Bytes(), &body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), files[1].Name, body.File)
+	assert.Equal(s.T(), files[0].Name, body.PreviousFile)
+	assert.Equal(s.T(), 19, body.PerformanceYear)
+	assert.Equal(s.T(), []string{"1A00A00AA03"}, body.Added)
+	assert.Equal(s.T(), []string{"1A00A00AA01"}, body.Dropped)
+}
+
+func (s *APITestSuite) TestBulkGroupNewRequest_NoneNewlyAttributed() {
+	cmsID := "T0010"
+	acoID, err := models.CreateACO("Group New ACO", &cmsID)
+	assert.Nil(s.T(), err)
+	defer s.db.Unscoped().Delete(&models.ACO{}, "uuid = ?", acoID)
+	defer s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{})
+
+	// the latest file has the same beneficiaries as the one before it
+	for i := 0; i < 2; i++ {
+		f := &models.CCLFFile{CCLFNum: 8, Name: fmt.Sprintf("T.BCD.%s.ZC8Y19.D19010%d.T0000000", cmsID, i+1), ACOCMSID: cmsID,
+			Timestamp: time.Now().Add(time.Duration(i-2) * time.Hour), PerformanceYear: 19, ImportStatus: constants.ImportComplete}
+		s.db.Save(f)
+		defer f.Delete()
+		s.db.Save(&models.CCLFBeneficiary{FileID: f.ID, MBI: "1A00A00AA01", HICN: "1A00A00AA01"})
+		assert.Nil(s.T(), f.RecordAttributionChanges(s.db))
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/Group/new/$export?_type=Patient", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupId", groupNewlyAttributed)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues(acoID.String())
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	assert.Nil(s.T(), err)
+	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: pgxcfg, AfterConnect: que.PrepareStatements})
+	assert.Nil(s.T(), err)
+	defer pgxpool.Close()
+	qc = que.NewClient(pgxpool)
+
+	http.HandlerFunc(bulkGroupRequest).ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
+
+	// there is nothing to export, so the job is complete without any chunks
+	var job models.Job
+	assert.Nil(s.T(), s.db.First(&job, "aco_id = ?", acoID).Error)
+	assert.Equal(s.T(), "Completed", job.Status)
+	assert.Zero(s.T(), job.JobCount)
+}
+
+func (s *APITestSuite) TestListJobsInvalidParams() {
+	for _, query := range []string{"status=Done", "_since=invalidDate", "_count=0", "_page=abc"} {
+		s.rr = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/v1/jobs?"+query, nil)
+		ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+		req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+		http.HandlerFunc(listJobs).ServeHTTP(s.rr, req)
+
+		assert.Equal(s.T(), http.StatusBadRequest, s.rr.Code, query)
+	}
+}
+
+func (s *APITestSuite) TestDeleteJobPending() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Pending",
+		JobCount:   1,
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+
+	handler := http.HandlerFunc(deleteJob)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
+
+	var cancelledJob models.Job
+	s.db.First(&cancelledJob, j.ID)
+	assert.Equal(s.T(), "Cancelled", cancelledJob.Status)
+
+	// Status requests for a cancelled job respond as if the job's data is gone
+	s.rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	http.HandlerFunc(jobStatus).ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusGone, s.rr.Code)
+}
+
+func (s *APITestSuite) TestDeleteJobCompleted() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Completed",
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+
+	handler := http.HandlerFunc(deleteJob)
 
 	rctx := chi.NewRouteContext()
-	rctx.URLParams.Add("fileName", "test.ndjson")
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
 	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusGone, s.rr.Code)
+
+	var completedJob models.Job
+	s.db.First(&completedJob, j.ID)
+	assert.Equal(s.T(), "Completed", completedJob.Status)
+}
+
+func (s *APITestSuite) TestServeData() {
+	jobID, cleanup := setupServeDataJob(s)
+	defer cleanup()
+
+	req := serveDataRequest(jobID, "test.ndjson")
 
 	handler := http.HandlerFunc(serveData)
 	handler.ServeHTTP(s.rr, req)
 
 	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	assert.Equal(s.T(), "application/fhir+ndjson", s.rr.Header().Get("Content-Type"))
+	assert.NotEmpty(s.T(), s.rr.Header().Get("ETag"))
+	assert.NotEmpty(s.T(), s.rr.Header().Get("Last-Modified"))
 	assert.Contains(s.T(), s.rr.Body.String(), `{"resourceType": "Bundle", "total": 33, "entry": [{"resource": {"status": "active", "diagnosis": [{"diagnosisCodeableConcept": {"coding": [{"system": "http://hl7.org/fhir/sid/icd-9-cm", "code": "2113"}]},`)
 }
 
+func (s *APITestSuite) TestServeDataGzip() {
+	jobID, cleanup := setupServeDataJob(s)
+	defer cleanup()
+
+	req := serveDataRequest(jobID, "test.ndjson")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	handler := http.HandlerFunc(serveData)
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	assert.Equal(s.T(), "gzip", s.rr.Header().Get("Content-Encoding"))
+
+	gr, err := gzip.NewReader(s.rr.Body)
+	assert.Nil(s.T(), err)
+	b, err := ioutil.ReadAll(gr)
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), string(b), `{"resourceType": "Bundle", "total": 33`)
+
+	// A client that already has this version is told it has not changed
+	etag := s.rr.Header().Get("ETag")
+	s.rr = httptest.NewRecorder()
+	req = serveDataRequest(jobID, "test.ndjson")
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	handler.ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusNotModified, s.rr.Code)
+}
+
+func (s *APITestSuite) TestServeDataRange() {
+	jobID, cleanup := setupServeDataJob(s)
+	defer cleanup()
+
+	req := serveDataRequest(jobID, "test.ndjson")
+	req.Header.Set("Range", "bytes=1-15")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler := http.HandlerFunc(serveData)
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusPartialContent, s.rr.Code)
+	assert.Empty(s.T(), s.rr.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), `"resourceType":`, s.rr.Body.String())
+
+	// Resuming against a file that has changed returns the whole file
+	s.rr = httptest.NewRecorder()
+	req = serveDataRequest(jobID, "test.ndjson")
+	req.Header.Set("Range", "bytes=1-15")
+	req.Header.Set("If-Range", `"stale-etag"`)
+	handler.ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+}
+
+func (s *APITestSuite) TestServeDataUnknownFile() {
+	jobID, cleanup := setupServeDataJob(s)
+	defer cleanup()
+
+	req := serveDataRequest(jobID, "other.ndjson")
+
+	handler := http.HandlerFunc(serveData)
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusNotFound, s.rr.Code)
+}
+
+// setupServeDataJob creates a completed job whose only data file is a copy of the worker's test.ndjson
+func setupServeDataJob(s *APITestSuite) (string, func()) {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Completed",
+	}
+	s.db.Save(&j)
+	s.db.Save(&models.JobKey{JobID: j.ID, FileName: "test.ndjson", ResourceType: "ExplanationOfBenefit"})
+	jobID := fmt.Sprint(j.ID)
+
+	payloadDir, err := ioutil.TempDir("", "bcda_payload")
+	assert.Nil(s.T(), err)
+	err = os.MkdirAll(fmt.Sprintf("%s/%s", payloadDir, jobID), os.ModePerm)
+	assert.Nil(s.T(), err)
+	data, err := ioutil.ReadFile("../../bcdaworker/data/test/test.ndjson")
+	assert.Nil(s.T(), err)
+	err = ioutil.WriteFile(fmt.Sprintf("%s/%s/test.ndjson", payloadDir, jobID), data, 0600)
+	assert.Nil(s.T(), err)
+
+	reset := testUtils.SetAndRestoreEnvKey("FHIR_PAYLOAD_DIR", payloadDir)
+	return jobID, func() {
+		reset()
+		os.RemoveAll(payloadDir)
+		s.db.Unscoped().Where("job_id = ?", j.ID).Delete(&models.JobKey{})
+		s.db.Unscoped().Delete(&j)
+	}
+}
+
+func serveDataRequest(jobID, fileName string) *http.Request {
+	req := httptest.NewRequest("GET", fmt.Sprintf("/data/%s/%s", jobID, fileName), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	rctx.URLParams.Add("fileName", fileName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
 func (s *APITestSuite) TestAuthTokenMissingAuthHeader() {
 
 	req := httptest.NewRequest("POST", "/auth/token", nil)
@@ -1199,6 +1719,89 @@ func (s *APITestSuite) TestMetadata() {
 	handler.ServeHTTP(s.rr, req)
 
 	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+
+	var statement struct {
+		Rest []struct {
+			Security struct {
+				Extension []struct {
+					Url       string
+					Extension []struct {
+						Url      string
+						ValueUri string
+					}
+				}
+			}
+			Resource []struct {
+				Type string
+			}
+			Operation []struct {
+				Name       string
+				Definition struct {
+					Reference string
+				}
+			}
+		}
+	}
+	err := json.Unmarshal(s.rr.Body.Bytes(), &statement)
+	assert.Nil(s.T(), err)
+	rest := statement.Rest[0]
+	assert.Equal(s.T(), "http://fhir-registry.smarthealthit.org/StructureDefinition/oauth-uris", rest.Security.Extension[0].Url)
+	assert.Equal(s.T(), "token", rest.Security.Extension[0].Extension[0].Url)
+	assert.Equal(s.T(), "https://example.com/auth/token", rest.Security.Extension[0].Extension[0].ValueUri)
+	var resourceTypes []string
+	for _, r := range rest.Resource {
+		resourceTypes = append(resourceTypes, r.Type)
+	}
+	assert.Equal(s.T(), []string{"Patient", "ExplanationOfBenefit", "Coverage"}, resourceTypes)
+	assert.Equal(s.T(), "export", rest.Operation[0].Name)
+	assert.Equal(s.T(), "https://example.com/api/v1/OperationDefinition/patient-export", rest.Operation[0].Definition.Reference)
+	assert.Equal(s.T(), "https://example.com/api/v1/OperationDefinition/group-export", rest.Operation[1].Definition.Reference)
+	var operations []string
+	for _, o := range rest.Operation[2:] {
+		operations = append(operations, o.Name+" "+o.Definition.Reference)
+	}
+	assert.Equal(s.T(), []string{
+		"jobs https://example.com/api/v1/jobs",
+		"jobs https://example.com/api/v1/jobs/[jobId]",
+		"cancel https://example.com/api/v1/jobs/[jobId]",
+		"attribution-changes https://example.com/api/v1/attribution/changes",
+		"metadata https://example.com/api/v1/metadata",
+		"version https://example.com/_version",
+		"data https://example.com/data/[jobID]/[random_UUID].ndjson",
+	}, operations)
+}
+
+func (s *APITestSuite) TestOperationDefinition() {
+	for _, id := range []string{"patient-export", "group-export"} {
+		s.rr = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/v1/OperationDefinition/"+id, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("operationID", id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		http.HandlerFunc(operationDefinition).ServeHTTP(s.rr, req)
+		assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+
+		var definition fhirmodels.OperationDefinition
+		err := json.Unmarshal(s.rr.Body.Bytes(), &definition)
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), id, definition.Id)
+		assert.Equal(s.T(), "export", definition.Code)
+		assert.Equal(s.T(), "http://example.com/api/v1/OperationDefinition/"+id, definition.Url)
+		var params []string
+		for _, p := range definition.Parameter {
+			params = append(params, p.Name)
+		}
+		assert.Equal(s.T(), []string{"_outputFormat", "_since", "_type", "_typeFilter", "_elements"}, params)
+	}
+
+	s.rr = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/OperationDefinition/everything", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("operationID", "everything")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	http.HandlerFunc(operationDefinition).ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusNotFound, s.rr.Code)
 }
 
 func (s *APITestSuite) TestGetVersion() {
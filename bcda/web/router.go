@@ -31,8 +31,12 @@ func NewAPIRouter() http.Handler {
 	r.Route("/api/v1", func(r chi.Router) {
 		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Patient/$export", bulkPatientRequest))
 		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Group/{groupId}/$export", bulkGroupRequest))
+		r.With(auth.RequireTokenAuth).Get(m.WrapHandler("/jobs", listJobs))
+		r.With(auth.RequireTokenAuth).Get(m.WrapHandler("/attribution/changes", attributionChanges))
 		r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Get(m.WrapHandler("/jobs/{jobID}", jobStatus))
+		r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Delete(m.WrapHandler("/jobs/{jobID}", deleteJob))
 		r.Get(m.WrapHandler("/metadata", metadata))
+		r.Get(m.WrapHandler("/OperationDefinition/{operationID}", operationDefinition))
 	})
 	r.Get(m.WrapHandler("/_version", getVersion))
 	r.Get(m.WrapHandler("/_health", healthCheck))
@@ -94,6 +94,19 @@ func (s *RouterTestSuite) TestMetadataRoute() {
 	assert.Contains(s.T(), string(bytes), `"resourceType":"CapabilityStatement"`)
 }
 
+func (s *RouterTestSuite) TestOperationDefinitionRoute() {
+	res := s.getAPIRoute("/api/v1/OperationDefinition/patient-export")
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+
+	bytes, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), string(bytes), `"resourceType":"OperationDefinition"`)
+
+	res = s.getAPIRoute("/api/v1/OperationDefinition/everything")
+	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
+}
+
 func (s *RouterTestSuite) TestHealthRoute() {
 	res := s.getAPIRoute("/_health")
 	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
@@ -152,6 +165,11 @@ func (s *RouterTestSuite) TestCoverageExportRoute() {
 
 }
 
+func (s *RouterTestSuite) TestAttributionChangesRoute() {
+	res := s.getAPIRoute("/api/v1/attribution/changes")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+}
+
 func (s *RouterTestSuite) TestJobStatusRoute() {
 	res := s.getAPIRoute("/api/v1/jobs/1")
 	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,17 +25,25 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/metrics"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/monitoring"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 )
 
 var (
 	qc  *que.Client
 	txn newrelic.Transaction
+
+	errJobCancelled  = errors.New("job was cancelled")
+	errWorkerStopped = errors.New("worker is shutting down")
+
+	// stopJobs is closed when the worker is shutting down and jobs still in progress should checkpoint and stop
+	stopJobs = make(chan struct{})
 )
 
 type jobEnqueueArgs struct {
@@ -40,6 +53,11 @@ type jobEnqueueArgs struct {
 	ResourceType    string
 	Since           string
 	TransactionTime time.Time
+	OutputFormat    string
+	TypeFilter      string   // encoded Blue Button search parameters from the _typeFilter query for ResourceType
+	Elements        []string // root elements to keep in each resource; empty to write whole resources
+	Chunk           int      // number of the chunk among the job's chunks, starting at 1; 0 for chunks enqueued before they were numbered
+	QueJobID        int64    `json:"-"` // ID of the que job processing the chunk, which identifies its checkpoint; 0 to skip checkpointing
 }
 
 func init() {
@@ -83,6 +101,7 @@ func processJob(j *que.Job) error {
 	if err != nil {
 		return err
 	}
+	jobArgs.QueJobID = j.ID
 
 	var exportJob models.Job
 	err = db.First(&exportJob, "ID = ?", jobArgs.ID).Error
@@ -90,6 +109,22 @@ func processJob(j *que.Job) error {
 		return errors.Wrap(err, "could not retrieve job from database")
 	}
 
+	if exportJob.Status == "Cancelled" {
+		log.Infof("Skipping job %d; export job %d was cancelled", j.ID, exportJob.ID)
+		deleteCheckpoint(db, j.ID)
+		return nil
+	}
+
+	deferred, err := deferIfACOBusy(j, db, jobArgs.ACOID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if deferred {
+		log.Infof("Deferred job %d; ACO %s already has %d chunks in progress", j.ID, jobArgs.ACOID, getMaxACOChunks())
+		return nil
+	}
+
 	var aco models.ACO
 	err = db.First(&aco, "uuid = ?", exportJob.ACOID).Error
 	if err != nil {
@@ -110,34 +145,49 @@ func processJob(j *que.Job) error {
 
 	jobID := strconv.Itoa(jobArgs.ID)
 	stagingPath := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
-	payloadPath := fmt.Sprintf("%s/%s", os.Getenv("FHIR_PAYLOAD_DIR"), jobID)
 
 	if err = createDir(stagingPath); err != nil {
 		log.Error(err)
 		return err
 	}
 
-	if err = createDir(payloadPath); err != nil {
-		log.Error(err)
-		return err
+	jobKey, err := writeBBDataToFile(bb, db, *aco.CMSID, jobArgs)
+
+	// The job may have been cancelled after this chunk last checked, and the chunk may have written files after Cancel
+	// removed the job's.  Now that it has stopped writing, nothing it wrote is left behind.
+	if err == errJobCancelled || isJobCancelled(db, jobID) {
+		log.Infof("Worker stopped processing job %d; export job %d was cancelled", j.ID, exportJob.ID)
+		if err = exportJob.RemoveFiles(); err != nil {
+			log.Error(err)
+		}
+		deleteCheckpoint(db, j.ID)
+		return nil
 	}
 
-	fileUUID, err := writeBBDataToFile(bb, db, jobArgs.ACOID, *aco.CMSID, jobArgs.BeneficiaryIDs, jobID, jobArgs.ResourceType, jobArgs.Since, jobArgs.TransactionTime)
-	fileName := fileUUID + ".ndjson"
+	// Returning the error has que release the job to be retried from its checkpoint
+	if err == errWorkerStopped {
+		log.Infof("Worker stopped processing job %d before it finished; it will be retried from its checkpoint", j.ID)
+		return err
+	}
 
 	// This is only run AFTER completion of all the collection
 	if err != nil {
-		err = db.Model(&exportJob).Update("status", "Failed").Error
+		updates := map[string]interface{}{"status": "Failed"}
+		if te, ok := err.(thresholdError); ok {
+			updates["failure_reason"] = te.reason()
+		}
+		err = db.Model(&exportJob).Where("status <> ?", "Cancelled").Updates(updates).Error
 		if err != nil {
 			return err
 		}
 	} else {
-		err = addJobFileName(fileName, jobArgs.ResourceType, exportJob, db)
+		err = addJobKey(jobKey, exportJob, db)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
 	}
+	deleteCheckpoint(db, j.ID)
 
 	_, err = exportJob.CheckCompletedAndCleanup(db)
 	if err != nil {
@@ -161,43 +211,74 @@ func createDir(path string) error {
 	return nil
 }
 
-func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID string, cclfBeneficiaryIDs []string, jobID, t, since string, transactionTime time.Time) (fileUUID string, error error) {
+// writeBBDataToFile writes the chunk's resources from Blue Button to a data file, and returns the file's JobKey with the
+// counts of what was written.
+func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoCMSID string, jobArgs jobEnqueueArgs) (jobKey models.JobKey, err error) {
 	segment := newrelic.StartSegment(txn, "writeBBDataToFile")
 
+	acoID, cclfBeneficiaryIDs, t := jobArgs.ACOID, jobArgs.BeneficiaryIDs, jobArgs.ResourceType
+	jobID := strconv.Itoa(jobArgs.ID)
+
 	if bb == nil {
 		err := errors.New("Blue Button client is required")
 		log.Error(err)
-		return "", err
+		return jobKey, err
 	}
 
 	bbFunc := bbFuncByType(bb, t)
 	if bbFunc == nil {
 		err := fmt.Errorf("Invalid resource type requested: %s", t)
 		log.Error(err)
-		return "", err
+		return jobKey, err
 	}
 
 	if !utils.IsUUID(acoID) {
 		err := errors.New("Invalid ACO ID")
 		log.Error(err)
-		return "", err
+		return jobKey, err
 	}
 
-	dataDir := os.Getenv("FHIR_STAGING_DIR")
-	fileUUID = uuid.NewRandom().String()
-	f, err := os.Create(fmt.Sprintf("%s/%s/%s.ndjson", dataDir, jobID, fileUUID))
+	typeFilter, err := url.ParseQuery(jobArgs.TypeFilter)
 	if err != nil {
 		log.Error(err)
-		return "", err
+		return jobKey, err
+	}
+
+	// A retried chunk picks up from its last checkpoint, appending to the same file.
+	cp, err := getCheckpoint(db, jobArgs)
+	if err != nil {
+		log.Error(err)
+		return jobKey, err
+	}
+	if err = restartLostCheckpoint(db, cp, jobID, jobArgs.OutputFormat); err != nil {
+		log.Error(err)
+		return jobKey, err
+	}
+	fileUUID := cp.FileUUID
+	fileName := dataFileName(fileUUID, jobArgs.OutputFormat)
+	f, err := openCheckpointedFiles(jobID, fileName, cp)
+	if err != nil {
+		log.Error(err)
+		return jobKey, err
 	}
 
 	defer f.Close() // #nosec G307
 
 	w := bufio.NewWriter(f)
-	errorCount := 0
+	var gw *gzip.Writer
+	if jobArgs.OutputFormat == constants.GzipFHIRNDJSON {
+		gw = gzip.NewWriter(f)
+		w = bufio.NewWriter(gw)
+	}
+	errorCounts := map[string]int{responseutils.BbErr: cp.BbErrCount, responseutils.InternalErr: cp.InternalErrCount}
+	recordCount, suppressedCount := cp.RecordCount, cp.SuppressedCount
+	checkpointInterval := getCheckpointInterval()
+	// a resumed chunk's time covers only part of it, so it isn't recorded
+	start, resumed := time.Now(), cp.Completed > 0
 	totalBeneIDs := float64(len(cclfBeneficiaryIDs))
 	failThreshold := getFailureThreshold()
 	failed := false
+	cancelled := false
 	suppressedList := models.GetSuppressedBlueButtonIDs(db)
 	suppressedMap := make(map[string]string)
 
@@ -206,34 +287,119 @@ func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID
 		suppressedMap[val] = ""
 	}
 
-	for _, cclfBeneficiaryID := range cclfBeneficiaryIDs {
-		blueButtonID, err := beneBBID(cclfBeneficiaryID, bb, db)
+	cancellation := &cancellationCheck{db: db, jobID: jobID, interval: cancelCheckInterval}
+
+	// Blue Button requests are made concurrently, but the results are written here one at a time in the order of
+	// cclfBeneficiaryIDs, so the files and error counts are the same as if each beneficiary were fetched in turn.
+	fetch := func(cclfBeneficiaryID string) (bd beneficiaryData) {
+		bd.cclfBeneficiaryID = cclfBeneficiaryID
+		if isWorkerStopping() {
+			bd.stopped = true
+			return
+		}
+		if cancellation.isCancelled() {
+			bd.cancelled = true
+			return
+		}
+
+		bd.blueButtonID, bd.bbIDErr = beneBBID(cclfBeneficiaryID, bb, db)
 
 		// skip over this cclf beneficiary if their blue button id is suppressed
-		if _, found := suppressedMap[blueButtonID]; found {
-			continue
+		if _, found := suppressedMap[bd.blueButtonID]; found {
+			bd.suppressed = true
+			return
 		}
 
-		if err != nil {
-			handleBBError(err, &errorCount, fileUUID, fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", cclfBeneficiaryID), jobID)
-		} else {
-			pData, err := bbFunc(blueButtonID, jobID, acoCMSID, since, transactionTime)
-			if err != nil {
-				handleBBError(err, &errorCount, fileUUID, fmt.Sprintf("Error retrieving %s for beneficiary %s in ACO %s", t, blueButtonID, acoID), jobID)
+		if bd.bbIDErr == nil {
+			bd.data, bd.err = bbFunc(bd.blueButtonID, jobID, acoCMSID, jobArgs.Since, jobArgs.TransactionTime, typeFilter)
+		}
+		bd.unavailable = errors.Cause(bd.bbIDErr) == client.ErrCircuitOpen || errors.Cause(bd.err) == client.ErrCircuitOpen
+		return
+	}
+	completed, stopped := cp.Completed, false
+	checkpoint := func() error {
+		cp.Completed, cp.RecordCount, cp.SuppressedCount = completed, recordCount, suppressedCount
+		cp.BbErrCount, cp.InternalErrCount = errorCounts[responseutils.BbErr], errorCounts[responseutils.InternalErr]
+		return saveCheckpoint(db, cp, f, w, gw, jobID)
+	}
+
+	// Fetching pauses while Blue Button's circuit breaker is open, and picks up where it left off.
+	for {
+		stop := make(chan struct{})
+		results, next := fetchInOrder(cclfBeneficiaryIDs[completed:], getRequestConcurrency(), stop, fetch)
+		paused := false
+		for result := range results {
+			bd := <-result
+			if bd.cancelled {
+				cancelled = true
+				break
+			}
+			if bd.stopped {
+				stopped = true
+				break
+			}
+			// the beneficiary is fetched again once Blue Button is back, rather than counted as failed
+			if bd.unavailable {
+				paused = true
+				break
+			}
+
+			if bd.suppressed {
+				suppressedCount++
+			} else if bd.bbIDErr != nil {
+				handleBBError(bd.bbIDErr, errorCounts, fileUUID, fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", bd.cclfBeneficiaryID), jobID)
+			} else if bd.err != nil {
+				handleBBError(bd.err, errorCounts, fileUUID, fmt.Sprintf("Error retrieving %s for beneficiary %s in ACO %s", t, bd.blueButtonID, acoID), jobID)
 			} else {
-				fhirBundleToResourceNDJSON(w, pData, t, cclfBeneficiaryID, acoCMSID, jobID, fileUUID)
+				records, errs := fhirBundleToResourceNDJSON(w, bd.data, t, bd.cclfBeneficiaryID, acoCMSID, jobID, fileUUID, jobArgs.Elements)
+				recordCount += records
+				errorCounts[responseutils.InternalErr] += errs
+				closeBundle(bd.data)
+			}
+			failPct := (float64(errorCounts[responseutils.BbErr]) / totalBeneIDs) * 100
+			if failPct >= failThreshold {
+				failed = true
+				break
+			}
+			next()
+
+			completed++
+			if completed%checkpointInterval == 0 && completed < len(cclfBeneficiaryIDs) {
+				if err = checkpoint(); err != nil {
+					// the chunk can still finish; a retry would just redo more of it
+					log.Error(err)
+				}
 			}
 		}
-		failPct := (float64(errorCount) / totalBeneIDs) * 100
-		if failPct >= failThreshold {
-			failed = true
+		close(stop)
+		// bundles fetched ahead but not written are still streaming from Blue Button
+		for result := range results {
+			closeBundle((<-result).data)
+		}
+
+		if !paused {
 			break
 		}
+
+		log.Warnf("Blue Button is unavailable; pausing job %s at beneficiary %d of %d", jobID, completed+1, len(cclfBeneficiaryIDs))
+		if err = checkpoint(); err != nil {
+			log.Error(err)
+		}
+		if stopped, cancelled = waitForBlueButton(db, jobID); stopped || cancelled {
+			break
+		}
+		log.Infof("Resuming job %s at beneficiary %d of %d", jobID, completed+1, len(cclfBeneficiaryIDs))
 	}
 
 	err = w.Flush()
 	if err != nil {
-		return "", err
+		return jobKey, err
+	}
+
+	if gw != nil {
+		if err = gw.Close(); err != nil {
+			return jobKey, err
+		}
 	}
 
 	err = segment.End()
@@ -241,18 +407,396 @@ func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID
 		log.Error(err)
 	}
 
+	if cancelled {
+		removeJobFiles(jobID, fileUUID)
+		return jobKey, errJobCancelled
+	}
+
+	if stopped {
+		if err = checkpoint(); err != nil {
+			log.Error(err)
+			return jobKey, err
+		}
+		return jobKey, errWorkerStopped
+	}
+
+	if err = saveJobErrors(db, jobArgs, fileUUID, errorCounts); err != nil {
+		log.Error(err)
+		return jobKey, err
+	}
+
 	if failed {
-		return "", errors.New("number of failed requests has exceeded threshold")
+		return jobKey, thresholdError{resourceType: t, failed: errorCounts[responseutils.BbErr], total: len(cclfBeneficiaryIDs), threshold: failThreshold}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Error(err)
+		return jobKey, err
+	}
+	if err = f.Close(); err != nil {
+		log.Error(err)
+		return jobKey, err
+	}
+	if err = storeChunkFiles(jobID, fileUUID, fileName); err != nil {
+		log.Error(err)
+		return jobKey, err
+	}
+
+	var durationMS int64
+	if !resumed {
+		durationMS = int64(time.Since(start) / time.Millisecond)
+	}
+
+	return models.JobKey{
+		FileName:         fileName,
+		ResourceType:     t,
+		Chunk:            jobArgs.Chunk,
+		RecordCount:      recordCount,
+		ByteSize:         fi.Size(),
+		BeneficiaryCount: len(cclfBeneficiaryIDs),
+		SuppressedCount:  suppressedCount,
+		FailedCount:      errorCounts[responseutils.BbErr],
+		DurationMS:       durationMS,
+	}, nil
+}
+
+// thresholdError reports that a chunk stopped because the share of its beneficiaries whose Blue Button requests
+// failed reached the failure threshold.
+type thresholdError struct {
+	resourceType  string
+	failed, total int
+	threshold     float64
+}
+
+func (e thresholdError) Error() string {
+	return "number of failed requests has exceeded threshold"
+}
+
+// reason explains the failure to the client.
+func (e thresholdError) reason() string {
+	return fmt.Sprintf("%d of %d %s requests to Blue Button failed (%.1f%%), exceeding the failure threshold of %.0f%%.",
+		e.failed, e.total, e.resourceType, float64(e.failed)/float64(e.total)*100, e.threshold)
+}
+
+// saveJobErrors records the chunk's error counts, so a job's errors can be summarized without reading its error files.
+func saveJobErrors(db *gorm.DB, jobArgs jobEnqueueArgs, fileUUID string, errorCounts map[string]int) error {
+	// a retried chunk may have saved its errors before the worker stopped
+	err := db.Unscoped().Where("job_id = ? and file_name = ?", jobArgs.ID, fileUUID+"-error.ndjson").Delete(models.JobError{}).Error
+	if err != nil {
+		return err
+	}
+	for code, count := range errorCounts {
+		if count == 0 {
+			continue
+		}
+		jobError := models.JobError{
+			JobID:        uint(jobArgs.ID),
+			ResourceType: jobArgs.ResourceType,
+			Code:         code,
+			Count:        count,
+			FileName:     fileUUID + "-error.ndjson",
+		}
+		if err := db.Create(&jobError).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferIfACOBusy puts the chunk back in the queue to run a little later, keeping its place, if the ACO already has the
+// maximum number of chunks in progress, so that one ACO's export can't take every worker.  The cap is soft: workers
+// that check at the same moment can each go ahead.  Chunks resuming from a checkpoint are never deferred.
+func deferIfACOBusy(j *que.Job, db *gorm.DB, acoID string) (bool, error) {
+	maxChunks := getMaxACOChunks()
+	if maxChunks == 0 || j.Conn() == nil {
+		return false, nil
+	}
+
+	var checkpoints int
+	if err := db.Model(&models.JobCheckpoint{}).Where("que_job_id = ?", j.ID).Count(&checkpoints).Error; err != nil {
+		return false, err
+	}
+	if checkpoints > 0 {
+		return false, nil
+	}
+
+	// chunks in progress hold an advisory lock on their que job
+	var inProgress int
+	err := j.Conn().QueryRow(`select count(*) from que_jobs
+		join (select (classid::bigint << 32) + objid::bigint as job_id from pg_locks where locktype = 'advisory') locks using (job_id)
+		where args->>'ACOID' = $1 and job_id <> $2`, acoID, j.ID).Scan(&inProgress)
+	if err != nil {
+		return false, err
+	}
+	if inProgress < maxChunks {
+		return false, nil
+	}
+
+	// The chunk stays the same que job in the same round, and only waits a little.  j.RunAt keeps the time it was
+	// locked with, so que's delete of the job when processJob returns matches nothing and leaves it queued.
+	_, err = j.Conn().Exec(`update que_jobs set run_at = now() + $1::bigint * '1 millisecond'::interval
+		where queue = $2 and priority = $3 and run_at = $4 and job_id = $5`,
+		int64(getACODeferInterval()/time.Millisecond), j.Queue, j.Priority, j.RunAt, j.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getMaxACOChunks returns the number of one ACO's chunks that may be in progress at once across all workers, or 0 for
+// no limit.
+func getMaxACOChunks() int {
+	maxChunks := utils.GetEnvInt("WORKER_MAX_ACO_CHUNKS", 0)
+	if maxChunks < 0 {
+		maxChunks = 0
+	}
+	return maxChunks
+}
+
+// getACODeferInterval returns how long a chunk deferred by deferIfACOBusy waits before it can run.
+func getACODeferInterval() time.Duration {
+	return time.Duration(utils.GetEnvInt("WORKER_ACO_DEFER_SEC", 15)) * time.Second
+}
+
+// getCheckpoint returns the checkpoint of the chunk's que job, creating one for a new data file if the chunk has none.
+// Chunks run without a que job get a checkpoint that is never saved.
+func getCheckpoint(db *gorm.DB, jobArgs jobEnqueueArgs) (*models.JobCheckpoint, error) {
+	cp := models.JobCheckpoint{QueJobID: jobArgs.QueJobID, JobID: uint(jobArgs.ID), FileUUID: uuid.NewRandom().String()}
+	if jobArgs.QueJobID == 0 {
+		return &cp, nil
+	}
+
+	err := db.Where(models.JobCheckpoint{QueJobID: jobArgs.QueJobID}).Attrs(cp).FirstOrCreate(&cp).Error
+	if err != nil {
+		return nil, err
+	}
+	if cp.Completed > 0 {
+		log.Infof("Resuming job %d at beneficiary %d of %d", jobArgs.QueJobID, cp.Completed+1, len(jobArgs.BeneficiaryIDs))
+	}
+	return &cp, nil
+}
+
+// openCheckpointedFiles opens the chunk's data file for appending, discarding anything written to it or to the error
+// file since the checkpoint was saved.
+func openCheckpointedFiles(jobID, fileName string, cp *models.JobCheckpoint) (*os.File, error) {
+	dataDir := os.Getenv("FHIR_STAGING_DIR")
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s/%s", dataDir, jobID, fileName), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(cp.DataFileSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.Seek(cp.DataFileSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	err = os.Truncate(fmt.Sprintf("%s/%s/%s-error.ndjson", dataDir, jobID, cp.FileUUID), cp.ErrorFileSize)
+	if err != nil && !os.IsNotExist(err) {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// restartLostCheckpoint starts the chunk over with a new data file if the files written up to its checkpoint are gone,
+// as they are when the chunk is retried by a worker on another host.
+func restartLostCheckpoint(db *gorm.DB, cp *models.JobCheckpoint, jobID, outputFormat string) error {
+	if cp.DataFileSize == 0 && cp.ErrorFileSize == 0 {
+		return nil
+	}
+	dataDir := os.Getenv("FHIR_STAGING_DIR")
+	if fileHasSize(fmt.Sprintf("%s/%s/%s", dataDir, jobID, dataFileName(cp.FileUUID, outputFormat)), cp.DataFileSize) &&
+		fileHasSize(fmt.Sprintf("%s/%s/%s-error.ndjson", dataDir, jobID, cp.FileUUID), cp.ErrorFileSize) {
+		return nil
+	}
+
+	log.Warnf("Files of job %d checkpointed at beneficiary %d are missing; starting over", cp.QueJobID, cp.Completed)
+	*cp = models.JobCheckpoint{Model: cp.Model, QueJobID: cp.QueJobID, JobID: cp.JobID, FileUUID: uuid.NewRandom().String()}
+	return db.Save(cp).Error
+}
+
+// fileHasSize reports whether a file is at least size bytes.  A file that doesn't exist is 0 bytes.
+func fileHasSize(path string, size int64) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return size == 0 && os.IsNotExist(err)
+	}
+	return fi.Size() >= size
+}
+
+// storeChunkFiles moves a finished chunk's data file and error file, if it has one, into staging storage.
+func storeChunkFiles(jobID, fileUUID, fileName string) error {
+	store, err := storage.Get()
+	if err != nil {
+		return err
+	}
+	dataDir := os.Getenv("FHIR_STAGING_DIR")
+	for _, name := range []string{fileName, fileUUID + "-error.ndjson"} {
+		localPath := fmt.Sprintf("%s/%s/%s", dataDir, jobID, name)
+		if _, err = os.Stat(localPath); os.IsNotExist(err) {
+			continue
+		}
+		if err = store.PutFile(storage.Staging, jobID+"/"+name, localPath); err != nil {
+			return errors.Wrapf(err, "could not store %s", name)
+		}
+	}
+	return nil
+}
+
+// saveCheckpoint flushes everything written to the data file and records the progress in cp.  Gzip output is ended
+// and restarted as a new gzip member, so the file can be cut back to this point and appended to by a retry.
+func saveCheckpoint(db *gorm.DB, cp *models.JobCheckpoint, f *os.File, w *bufio.Writer, gw *gzip.Writer, jobID string) error {
+	if cp.QueJobID == 0 {
+		return nil
 	}
 
-	return fileUUID, nil
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		gw.Reset(f)
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	cp.DataFileSize = size
+
+	cp.ErrorFileSize = 0
+	fi, err := os.Stat(fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_STAGING_DIR"), jobID, cp.FileUUID))
+	if err == nil {
+		cp.ErrorFileSize = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return db.Save(cp).Error
+}
+
+// deleteCheckpoint removes the checkpoint of a que job that no longer needs to be retried.
+func deleteCheckpoint(db *gorm.DB, queJobID int64) {
+	err := db.Unscoped().Where("que_job_id = ?", queJobID).Delete(models.JobCheckpoint{}).Error
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// getCheckpointInterval returns the number of beneficiaries a job handles between checkpoints.
+func getCheckpointInterval() int {
+	interval := utils.GetEnvInt("CHECKPOINT_INTERVAL", 25)
+	if interval < 1 {
+		interval = 1
+	}
+	return interval
+}
+
+// waitForBlueButton waits while the Blue Button circuit breaker is open.  It returns early if the worker begins
+// shutting down or the job is cancelled.
+func waitForBlueButton(db *gorm.DB, jobID string) (stopped, cancelled bool) {
+	for {
+		wait := client.CircuitBreakerWait()
+		if wait <= 0 {
+			return false, false
+		}
+		// check for cancellation now and then during a long outage
+		if wait > blueButtonPollInterval {
+			wait = blueButtonPollInterval
+		}
+		select {
+		case <-stopJobs:
+			return true, false
+		case <-time.After(wait):
+		}
+		if isJobCancelled(db, jobID) {
+			return false, true
+		}
+	}
+}
+
+// blueButtonPollInterval is how often a job paused by waitForBlueButton checks whether it has been cancelled.
+const blueButtonPollInterval = 15 * time.Second
+
+// isWorkerStopping reports whether jobs in progress have been told to stop because the worker is shutting down.
+func isWorkerStopping() bool {
+	select {
+	case <-stopJobs:
+		return true
+	default:
+		return false
+	}
+}
+
+// isJobCancelled reports whether the export job has been cancelled through the API since this chunk started.
+func isJobCancelled(db *gorm.DB, jobID string) bool {
+	var count int
+	db.Model(&models.Job{}).Where("id = ? and status = ?", jobID, "Cancelled").Count(&count)
+	return count > 0
+}
+
+// cancelCheckInterval is how often a job writing its files checks whether it has been cancelled.
+const cancelCheckInterval = 5 * time.Second
+
+// cancellationCheck reports whether an export job has been cancelled, asking the database at most once an interval
+// however many beneficiaries ask in the meantime.  It is safe for concurrent use.
+type cancellationCheck struct {
+	db       *gorm.DB
+	jobID    string
+	interval time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	cancelled bool
+}
+
+func (c *cancellationCheck) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.cancelled && time.Since(c.checkedAt) >= c.interval {
+		c.cancelled = isJobCancelled(c.db, c.jobID)
+		c.checkedAt = time.Now()
+	}
+	return c.cancelled
+}
+
+// dataFileName returns the name of the data file for a chunk written in the given output format.  Jobs queued before
+// _outputFormat was supported have no format and are written as NDJSON.
+func dataFileName(fileUUID, outputFormat string) string {
+	if outputFormat == constants.GzipFHIRNDJSON {
+		return fileUUID + ".ndjson.gz"
+	}
+	return fileUUID + ".ndjson"
+}
+
+// removeJobFiles deletes the data and error files written for a chunk of a cancelled job.
+func removeJobFiles(jobID, fileUUID string) {
+	dataDir := os.Getenv("FHIR_STAGING_DIR")
+	for _, name := range []string{fileUUID + ".ndjson", fileUUID + ".ndjson.gz", fileUUID + "-error.ndjson"} {
+		err := os.Remove(fmt.Sprintf("%s/%s/%s", dataDir, jobID, name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
+	}
 }
 
+// bbFuncByType returns the function that gets a beneficiary's resources of type t.  Only ExplanationOfBenefit resources
+// can be filtered with _typeFilter, so the other types' functions ignore the filter, which is always empty for them.
 func bbFuncByType(bb client.APIClient, t string) client.BeneDataFunc {
 	return map[string]client.BeneDataFunc{
 		"ExplanationOfBenefit": bb.GetExplanationOfBenefit,
-		"Patient":              bb.GetPatient,
-		"Coverage":             bb.GetCoverage,
+		"Patient": func(patientID, jobID, cmsID, since string, transactionTime time.Time, _ url.Values) (io.Reader, error) {
+			return bb.GetPatient(patientID, jobID, cmsID, since, transactionTime)
+		},
+		"Coverage": func(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, _ url.Values) (io.Reader, error) {
+			return bb.GetCoverage(beneficiaryID, jobID, cmsID, since, transactionTime)
+		},
 	}[t]
 }
 
@@ -274,12 +818,76 @@ func beneBBID(cclfBeneID string, bb client.APIClient, db *gorm.DB) (string, erro
 	return bbID, nil
 }
 
-func handleBBError(err error, errorCount *int, fileUUID, msg, jobID string) {
+func handleBBError(err error, errorCounts map[string]int, fileUUID, msg, jobID string) {
 	log.Error(err)
-	(*errorCount)++
+	errorCounts[responseutils.BbErr]++
 	appendErrorToFile(fileUUID, responseutils.Exception, responseutils.BbErr, msg, jobID)
 }
 
+// beneficiaryData is the result of fetching one beneficiary's resources from Blue Button.
+type beneficiaryData struct {
+	cclfBeneficiaryID string
+	blueButtonID      string
+	bbIDErr           error     // error looking up the Blue Button ID
+	data              io.Reader // the pages of the beneficiary's search bundle, streamed from Blue Button as they are read
+	err               error     // error retrieving the resources
+	suppressed        bool
+	cancelled         bool // the job was cancelled before the beneficiary was fetched
+	stopped           bool // the worker began shutting down before the beneficiary was fetched
+	unavailable       bool // Blue Button's circuit breaker was open, so the beneficiary was not fetched
+}
+
+// closeBundle releases the Blue Button responses behind a beneficiary's bundle, if it has any.
+func closeBundle(bundle io.Reader) {
+	if c, ok := bundle.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// fetchInOrder calls fetch for each of the cclfBeneficiaryIDs concurrently, and sends a channel for each result on
+// results in the order of the IDs.  At most concurrency results are being fetched or waiting to be read at once; the
+// reader calls next once it has handled a result to make room for another.  Closing stop ends fetching early, though
+// fetches already started run to completion.
+func fetchInOrder(cclfBeneficiaryIDs []string, concurrency int, stop <-chan struct{}, fetch func(string) beneficiaryData) (results <-chan chan beneficiaryData, next func()) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	pending := make(chan chan beneficiaryData, concurrency)
+
+	go func() {
+		defer close(pending)
+		for _, cclfBeneficiaryID := range cclfBeneficiaryIDs {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			result := make(chan beneficiaryData, 1)
+			go func(cclfBeneficiaryID string) {
+				result <- fetch(cclfBeneficiaryID)
+			}(cclfBeneficiaryID)
+
+			// pending has room for every fetch the semaphore allows, so this never blocks
+			pending <- result
+		}
+	}()
+
+	return pending, func() { <-sem }
+}
+
+// getRequestConcurrency returns the number of beneficiaries a job fetches from Blue Button at once.
+func getRequestConcurrency() int {
+	concurrency := utils.GetEnvInt("BB_REQUEST_CONCURRENCY", 5)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return concurrency
+}
+
 func getFailureThreshold() float64 {
 	exportFailPctStr := os.Getenv("EXPORT_FAIL_PCT")
 	exportFailPct, err := strconv.Atoi(exportFailPctStr)
@@ -323,79 +931,288 @@ func appendErrorToFile(fileUUID, code, detailsCode, detailsDisplay string, jobID
 	}
 }
 
-func fhirBundleToResourceNDJSON(w *bufio.Writer, jsonData, jsonType, beneficiaryID, acoID, jobID, fileUUID string) {
+// fhirBundleToResourceNDJSON copies the resources in a bundle, or in each page of a bundle read one after another, to
+// w, one per line, and returns the number of resources written and the number of errors written to the chunk's error
+// file.  Resources are copied as Blue Button sent them, keys in the same order, without decoding the bundle into maps;
+// only one resource is held in memory at a time.  If elements are given, each resource is trimmed to them first.
+func fhirBundleToResourceNDJSON(w *bufio.Writer, bundle io.Reader, jsonType, beneficiaryID, acoID, jobID, fileUUID string, elements []string) (recordCount, errorCount int) {
 	segment := newrelic.StartSegment(txn, "fhirBundleToResourceNDJSON")
 
-	var jsonOBJ map[string]interface{}
-	err := json.Unmarshal([]byte(jsonData), &jsonOBJ)
+	var line bytes.Buffer
+	err := forEachBundleResource(json.NewDecoder(bundle), func(resource json.RawMessage) {
+		var err error
+		if len(elements) > 0 {
+			resource, err = subsetResource(resource, elements)
+		}
+		line.Reset()
+		if err == nil {
+			// NDJSON needs each resource on one line, however Blue Button formatted it
+			err = json.Compact(&line, resource)
+		}
+		if err != nil {
+			log.Error(err)
+			appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error marshaling %s to JSON for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
+			errorCount++
+			return
+		}
+		line.WriteByte('\n')
+		if _, err = w.Write(line.Bytes()); err != nil {
+			log.Error(err)
+			appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error writing %s to file for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
+			errorCount++
+			return
+		}
+		recordCount++
+	})
 	if err != nil {
 		log.Error(err)
 		appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error unmarshaling %s resources from data for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
-		return
+		errorCount++
 	}
-	entries := jsonOBJ["entry"]
 
-	// There might be no entries.  If this happens we can't iterate over them.
-	if entries != nil {
-		for _, entry := range entries.([]interface{}) {
-			entrymap := entry.(map[string]interface{})
-			if len(entrymap) != 0 {
-				entryJSON, err := json.Marshal(entrymap["resource"])
-				// This is unlikely to happen because we just unmarshalled this data a few lines above.
-				if err != nil {
-					log.Error(err)
-					appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error marshaling %s to JSON for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
-					continue
-				}
-				_, err = w.WriteString(string(entryJSON) + "\n")
-				if err != nil {
-					log.Error(err)
-					appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error writing %s to file for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
-				}
+	err = segment.End()
+	if err != nil {
+		log.Error(err)
+	}
+
+	return recordCount, errorCount
+}
+
+// forEachBundleResource reads a stream of bundles a token at a time, calling fn with the raw JSON of each entry's
+// resource.  Everything else in the bundles is skipped.  Resources before a malformed part of the stream are still
+// passed to fn.
+func forEachBundleResource(dec *json.Decoder, fn func(json.RawMessage)) error {
+	for dec.More() {
+		err := forEachMember(dec, func(name string) error {
+			if name != "entry" {
+				return skipValue(dec)
 			}
+			return forEachElement(dec, func() error {
+				return forEachMember(dec, func(name string) error {
+					var value json.RawMessage
+					if err := dec.Decode(&value); err != nil {
+						return err
+					}
+					if name == "resource" && string(value) != "null" {
+						fn(value)
+					}
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	err = segment.End()
+// forEachMember reads a JSON object, calling fn with the name of each member; fn must read the member's value.  A
+// null is read as an empty object.
+func forEachMember(dec *json.Decoder, fn func(name string) error) error {
+	return forEachIn(dec, '{', func() error {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("expected an object member name, found %v", t)
+		}
+		return fn(name)
+	})
+}
+
+// forEachElement reads a JSON array, calling fn to read each element.  A null is read as an empty array.
+func forEachElement(dec *json.Decoder, fn func() error) error {
+	return forEachIn(dec, '[', fn)
+}
+
+func forEachIn(dec *json.Decoder, open json.Delim, fn func() error) error {
+	t, err := dec.Token()
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if t != open {
+		return fmt.Errorf("expected %v, found %v", open, t)
+	}
+	for dec.More() {
+		if err = fn(); err != nil {
+			return err
+		}
+	}
+	// the closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+func skipValue(dec *json.Decoder) error {
+	var value json.RawMessage
+	return dec.Decode(&value)
+}
+
+// mandatoryElements are kept in every resource trimmed with _elements
+var mandatoryElements = []string{"resourceType", "id", "meta"}
+
+// subsettedTag marks a resource trimmed with _elements
+var subsettedTag = json.RawMessage(`{"system":"http://hl7.org/fhir/v3/ObservationValue","code":"SUBSETTED","display":"subsetted"}`)
+
+// subsetResource removes the root elements of a resource that are neither requested nor mandatory, and tags the
+// resource SUBSETTED so clients know it is incomplete.  The elements kept stay in the same order.
+func subsetResource(resource json.RawMessage, elements []string) (json.RawMessage, error) {
+	members, err := decodeMembers(resource)
+	if err != nil {
+		return nil, err
 	}
+
+	kept := members[:0]
+	tagged := false
+	for _, m := range members {
+		if !utils.ContainsString(elements, m.name) && !utils.ContainsString(mandatoryElements, m.name) {
+			continue
+		}
+		if m.name == "meta" {
+			if m.value, err = addSubsettedTag(m.value); err != nil {
+				return nil, err
+			}
+			tagged = true
+		}
+		kept = append(kept, m)
+	}
+	if !tagged {
+		meta, _ := addSubsettedTag(nil)
+		kept = append(kept, member{name: "meta", value: meta})
+	}
+	return encodeMembers(kept), nil
 }
 
-func waitForSig() {
+// addSubsettedTag adds the SUBSETTED tag to a resource's meta, which may be nil if the resource has none.
+func addSubsettedTag(meta json.RawMessage) (json.RawMessage, error) {
+	var members []member
+	if meta != nil {
+		var err error
+		if members, err = decodeMembers(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, m := range members {
+		if m.name != "tag" {
+			continue
+		}
+		var tags []json.RawMessage
+		if err := json.Unmarshal(m.value, &tags); err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(append(tags, subsettedTag))
+		if err != nil {
+			return nil, err
+		}
+		members[i].value = value
+		return encodeMembers(members), nil
+	}
+	return encodeMembers(append(members, member{name: "tag", value: json.RawMessage("[" + string(subsettedTag) + "]")})), nil
+}
+
+// member is a member of a JSON object, kept as raw JSON so that objects can be changed without reordering them.
+type member struct {
+	name  string
+	value json.RawMessage
+}
+
+func decodeMembers(object json.RawMessage) ([]member, error) {
+	var members []member
+	dec := json.NewDecoder(bytes.NewReader(object))
+	err := forEachMember(dec, func(name string) error {
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		members = append(members, member{name: name, value: value})
+		return nil
+	})
+	return members, err
+}
+
+func encodeMembers(members []member) json.RawMessage {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		// names came from decoding JSON, so they always encode
+		name, _ := json.Marshal(m.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// waitForSig blocks until the worker is told to stop, and returns the signal.  A second signal exits immediately,
+// without waiting for jobs in progress.
+func waitForSig() os.Signal {
 	signalChan := make(chan os.Signal, 1)
-	defer close(signalChan)
 
 	signal.Notify(signalChan,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	exitChan := make(chan int)
-	defer close(exitChan)
+	s := <-signalChan
+	switch s {
+	case syscall.SIGINT:
+		fmt.Println("interrupt")
+	case syscall.SIGTERM:
+		fmt.Println("force stop")
+	case syscall.SIGQUIT:
+		fmt.Println("stop and core dump")
+	}
 
 	go func() {
-		for {
-			s := <-signalChan
-			switch s {
-			case syscall.SIGINT:
-				fmt.Println("interrupt")
-				exitChan <- 0
-			case syscall.SIGTERM:
-				fmt.Println("force stop")
-				exitChan <- 0
-			case syscall.SIGQUIT:
-				fmt.Println("stop and core dump")
-				exitChan <- 0
-			}
-		}
+		<-signalChan
+		fmt.Println("exiting without waiting for jobs in progress")
+		os.Exit(1)
 	}()
 
-	code := <-exitChan
-	os.Exit(code)
+	return s
+}
+
+// shutdown stops the worker pool from taking new jobs and gives the jobs in progress until the timeout to finish.
+// Jobs still running then are told to checkpoint and stop, and shutdown waits for them so that que releases their
+// locks and they can be retried by another worker.
+func shutdown(workers *workerPool, timeout time.Duration) {
+	log.Infof("Worker shutting down; waiting up to %s for jobs in progress", timeout)
+	workers.Stop()
+
+	select {
+	case <-workers.Done():
+		log.Info("Worker finished all jobs in progress")
+		return
+	case <-time.After(timeout):
+	}
+
+	log.Warn("Jobs still in progress at the shutdown deadline; stopping them at their next checkpoint")
+	close(stopJobs)
+	<-workers.Done()
+	log.Info("Worker stopped all jobs in progress")
+}
+
+// getShutdownTimeout returns how long the worker waits for jobs in progress to finish when shutting down.
+func getShutdownTimeout() time.Duration {
+	timeout := utils.GetEnvInt("WORKER_SHUTDOWN_TIMEOUT_SEC", 20)
+	if timeout < 0 {
+		timeout = 0
+	}
+	return time.Duration(timeout) * time.Second
 }
 
-func setupQueue() *pgx.ConnPool {
+func setupQueue() (*workerPool, *pgx.ConnPool) {
 	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
 	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
 	if err != nil {
@@ -416,10 +1233,11 @@ func setupQueue() *pgx.ConnPool {
 	}
 
 	workerPoolSize := utils.GetEnvInt("WORKER_POOL_SIZE", 2)
-	workers := que.NewWorkerPool(qc, wm, workerPoolSize)
-	go workers.Start()
+	worker := que.NewWorker(qc, wm)
+	workers := newWorkerPool(workerPoolSize, worker.Interval, worker.WorkOne)
+	workers.Start()
 
-	return pgxpool
+	return workers, pgxpool
 }
 
 func getQueueJobCount() float64 {
@@ -454,8 +1272,10 @@ func updateJobStats(jID uint, db *gorm.DB) {
 	}
 }
 
-func addJobFileName(fileName, resourceType string, exportJob models.Job, db *gorm.DB) error {
-	err := db.Create(&models.JobKey{JobID: exportJob.ID, FileName: fileName, ResourceType: resourceType}).Error
+func addJobKey(jobKey models.JobKey, exportJob models.Job, db *gorm.DB) error {
+	jobKey.JobID = exportJob.ID
+	// a retried chunk may have recorded its file before the worker stopped
+	err := db.Where("job_id = ? and file_name = ?", jobKey.JobID, jobKey.FileName).FirstOrCreate(&jobKey).Error
 	if err != nil {
 		log.Error(err)
 		return err
@@ -485,8 +1305,8 @@ func updateJobQueueCountCloudwatchMetric() {
 func main() {
 	fmt.Println("Starting bcdaworker...")
 
-	workerPool := setupQueue()
-	defer workerPool.Close()
+	workers, pgxpool := setupQueue()
+	defer pgxpool.Close()
 
 	if hInt, err := strconv.Atoi(os.Getenv("WORKER_HEALTH_INT_SEC")); err == nil {
 		healthLogger := NewHealthLogger()
@@ -506,4 +1326,5 @@ func main() {
 	}
 
 	waitForSig()
+	shutdown(workers, getShutdownTimeout())
 }
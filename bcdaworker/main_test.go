@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,19 +11,24 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/mock"
 
 	"github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
 )
 
@@ -84,7 +91,7 @@ func TestWriteEOBDataToFile(t *testing.T) {
 		bbc.On("GetExplanationOfBenefit", beneficiaryIDs[i]).Return(bbc.GetData("ExplanationOfBenefit", beneficiaryID))
 	}
 
-	_, err := writeBBDataToFile(&bbc, db, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
 	if err != nil {
 		t.Fail()
 	}
@@ -93,6 +100,14 @@ func TestWriteEOBDataToFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Len(t, files, 1)
 
+	assert.Equal(t, files[0].Name(), jobKey.FileName)
+	assert.Equal(t, "ExplanationOfBenefit", jobKey.ResourceType)
+	assert.Equal(t, 66, jobKey.RecordCount)
+	assert.Equal(t, files[0].Size(), jobKey.ByteSize)
+	assert.Equal(t, 2, jobKey.BeneficiaryCount)
+	assert.Equal(t, 0, jobKey.SuppressedCount)
+	assert.Equal(t, 0, jobKey.FailedCount)
+
 	for _, f := range files {
 		filePath := fmt.Sprintf("%s/%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID, f.Name())
 		file, err := os.Open(filePath)
@@ -120,8 +135,222 @@ func TestWriteEOBDataToFile(t *testing.T) {
 	}
 }
 
+func TestWriteEOBDataToFile_Gzip(t *testing.T) {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID := "9c05c1f8-349d-400f-9b69-7963f2262b07"
+	cmsID := "A00234"
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012309"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+
+	beneficiaryID := "a1000003701"
+	bbc.MBI = &beneficiaryID
+	cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+	db.Create(&cclfBeneficiary)
+	defer db.Delete(&cclfBeneficiary)
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI), "MBI_MODE").Return(bbc.GetData("Patient", beneficiaryID))
+	bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetData("ExplanationOfBenefit", beneficiaryID))
+
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: []string{strconv.FormatUint(uint64(cclfBeneficiary.ID), 10)}, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now(), OutputFormat: constants.GzipFHIRNDJSON})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(jobKey.FileName, ".ndjson.gz"))
+	assert.Equal(t, 33, jobKey.RecordCount)
+
+	filePath := fmt.Sprintf("%s/%s", stagingDir, jobKey.FileName)
+	fi, err := os.Stat(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), jobKey.ByteSize)
+	file, err := os.Open(filePath)
+	assert.Nil(t, err)
+	defer os.Remove(filePath)
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	assert.Nil(t, err)
+	scanner := bufio.NewScanner(gr)
+	// 33 entries in test EOB data returned by bbc.getData
+	for i := 0; i < 33; i++ {
+		assert.True(t, scanner.Scan())
+		var jsonOBJ map[string]interface{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &jsonOBJ))
+		assert.Equal(t, "ExplanationOfBenefit", jsonOBJ["resourceType"])
+	}
+	assert.False(t, scanner.Scan(), "There should be only 33 entries in the file.")
+	bbc.AssertExpectations(t)
+}
+
+func TestWriteEOBDataToFile_ResumeFromCheckpoint(t *testing.T) {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID := "9c05c1f8-349d-400f-9b69-7963f2262b07"
+	cmsID := "A00234"
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012309"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	var cclfBeneficiaryIDs []string
+	for _, beneficiaryID := range beneficiaryIDs {
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+	}
+	// only the second beneficiary is fetched; the first was written before the worker stopped
+	bbc.MBI = &beneficiaryIDs[1]
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[1]), "MBI_MODE").Return(bbc.GetData("Patient", beneficiaryIDs[1]))
+	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[1]).Return(bbc.GetData("ExplanationOfBenefit", beneficiaryIDs[1]))
+
+	written := `{"resourceType":"ExplanationOfBenefit","id":"written-before-checkpoint"}` + "\n"
+	cp := models.JobCheckpoint{QueJobID: 9001, JobID: 1, FileUUID: uuid.NewRandom().String(), Completed: 1, RecordCount: 1, DataFileSize: int64(len(written))}
+	assert.Nil(t, db.Create(&cp).Error)
+	defer deleteCheckpoint(db, cp.QueJobID)
+	// anything written after the checkpoint is discarded
+	filePath := fmt.Sprintf("%s/%s.ndjson", stagingDir, cp.FileUUID)
+	assert.Nil(t, ioutil.WriteFile(filePath, []byte(written+`{"resourceType":"ExplanationOfBen`), 0644))
+
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now(), QueJobID: cp.QueJobID})
+	assert.Nil(t, err)
+	assert.Equal(t, cp.FileUUID+".ndjson", jobKey.FileName)
+	assert.Equal(t, 34, jobKey.RecordCount)
+	assert.Equal(t, 2, jobKey.BeneficiaryCount)
+	// a resumed chunk's time isn't recorded
+	assert.Zero(t, jobKey.DurationMS)
+	bbc.AssertExpectations(t)
+
+	file, err := os.Open(filePath)
+	assert.Nil(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, strings.TrimSpace(written), scanner.Text())
+	// 33 entries in test EOB data returned by bbc.getData
+	for i := 0; i < 33; i++ {
+		assert.True(t, scanner.Scan())
+		var jsonOBJ map[string]interface{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &jsonOBJ))
+		assert.Equal(t, "ExplanationOfBenefit", jsonOBJ["resourceType"])
+	}
+	assert.False(t, scanner.Scan(), "There should be only 34 entries in the file.")
+}
+
+func TestWriteEOBDataToFile_CheckpointFilesLost(t *testing.T) {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID := "9c05c1f8-349d-400f-9b69-7963f2262b07"
+	cmsID := "A00234"
+	jobID := "1"
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012310"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	testUtils.CreateStaging(jobID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	defer os.RemoveAll(stagingDir)
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	var cclfBeneficiaryIDs []string
+	for i := 0; i < len(beneficiaryIDs); i++ {
+		beneficiaryID := beneficiaryIDs[i]
+		bbc.MBI = &beneficiaryID
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI), "MBI_MODE").Return(bbc.GetData("Patient", beneficiaryID))
+		bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetData("ExplanationOfBenefit", beneficiaryID))
+	}
+
+	// the checkpoint was saved by a worker on another host, so its data file isn't here
+	cp := models.JobCheckpoint{QueJobID: 9002, JobID: 1, FileUUID: uuid.NewRandom().String(), Completed: 1, RecordCount: 1, DataFileSize: 70}
+	assert.Nil(t, db.Create(&cp).Error)
+	defer deleteCheckpoint(db, cp.QueJobID)
+
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now(), QueJobID: cp.QueJobID})
+	assert.Nil(t, err)
+	// the chunk starts over with a new file
+	assert.NotEqual(t, cp.FileUUID+".ndjson", jobKey.FileName)
+	assert.Equal(t, 66, jobKey.RecordCount)
+	bbc.AssertExpectations(t)
+
+	var saved models.JobCheckpoint
+	assert.Nil(t, db.First(&saved, "que_job_id = ?", cp.QueJobID).Error)
+	assert.Equal(t, cp.ID, saved.ID)
+	assert.Equal(t, jobKey.FileName, saved.FileUUID+".ndjson")
+}
+
+func TestWriteEOBDataToFile_SavesCheckpoints(t *testing.T) {
+	origInterval := os.Getenv("CHECKPOINT_INTERVAL")
+	defer os.Setenv("CHECKPOINT_INTERVAL", origInterval)
+	os.Setenv("CHECKPOINT_INTERVAL", "1")
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID := "9c05c1f8-349d-400f-9b69-7963f2262b07"
+	cmsID := "A00234"
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012309"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	var cclfBeneficiaryIDs []string
+	for i := range beneficiaryIDs {
+		beneficiaryID := beneficiaryIDs[i]
+		bbc.MBI = &beneficiaryID
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI), "MBI_MODE").Return(bbc.GetData("Patient", beneficiaryID))
+		bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetData("ExplanationOfBenefit", beneficiaryID))
+	}
+
+	var queJobID int64 = 9002
+	defer deleteCheckpoint(db, queJobID)
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now(), OutputFormat: constants.GzipFHIRNDJSON, QueJobID: queJobID})
+	assert.Nil(t, err)
+
+	// the checkpoint after the first beneficiary is kept until processJob finishes with the chunk
+	var cp models.JobCheckpoint
+	assert.Nil(t, db.First(&cp, "que_job_id = ?", queJobID).Error)
+	assert.Equal(t, 1, cp.Completed)
+	assert.Equal(t, 33, cp.RecordCount)
+	assert.True(t, cp.DataFileSize > 0 && cp.DataFileSize < jobKey.ByteSize)
+	assert.Equal(t, cp.FileUUID+".ndjson.gz", jobKey.FileName)
+
+	// the file is made of one gzip member per checkpoint, which read back as one stream
+	file, err := os.Open(fmt.Sprintf("%s/%s", stagingDir, jobKey.FileName))
+	assert.Nil(t, err)
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	assert.Nil(t, err)
+	scanner := bufio.NewScanner(gr)
+	for i := 0; i < 66; i++ {
+		assert.True(t, scanner.Scan())
+	}
+	assert.False(t, scanner.Scan(), "There should be only 66 entries in the file.")
+}
+
 func TestWriteEOBDataToFileNoClient(t *testing.T) {
-	_, err := writeBBDataToFile(nil, nil, "9c05c1f8-349d-400f-9b69-7963f2262b08", "A00234", []string{"20000", "21000"}, "1", "ExplanationOfBenefit", "", time.Now())
+	_, err := writeBBDataToFile(nil, nil, "A00234", jobEnqueueArgs{ID: 1, ACOID: "9c05c1f8-349d-400f-9b69-7963f2262b08", BeneficiaryIDs: []string{"20000", "21000"}, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
 	assert.NotNil(t, err)
 }
 
@@ -133,7 +362,7 @@ func TestWriteEOBDataToFileInvalidACO(t *testing.T) {
 
 	db := database.GetGORMDbConnection()
 	defer db.Close()
-	_, err := writeBBDataToFile(&bbc, db, acoID, cmsID, beneficiaryIDs, "1", "ExplanationOfBenefit", "", time.Now())
+	_, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: beneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
 	assert.NotNil(t, err)
 }
 
@@ -173,10 +402,14 @@ func TestWriteEOBDataToFileWithErrorsBelowFailureThreshold(t *testing.T) {
 	os.RemoveAll(stagingDir)
 	testUtils.CreateStaging(jobID)
 
-	fileUUID, err := writeBBDataToFile(&bbc, db, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
 	if err != nil {
 		t.Fail()
 	}
+	assert.Equal(t, 33, jobKey.RecordCount)
+	assert.Equal(t, 3, jobKey.BeneficiaryCount)
+	assert.Equal(t, 2, jobKey.FailedCount)
+	fileUUID := strings.TrimSuffix(jobKey.FileName, ".ndjson")
 
 	errorFilePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_STAGING_DIR"), jobID, fileUUID)
 	fData, err := ioutil.ReadFile(errorFilePath)
@@ -197,6 +430,10 @@ func TestWriteEOBDataToFileWithErrorsAboveFailureThreshold(t *testing.T) {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
 	os.Setenv("EXPORT_FAIL_PCT", "60")
+	// fetch one beneficiary at a time, so the third is never requested
+	origConcurrency := os.Getenv("BB_REQUEST_CONCURRENCY")
+	defer os.Setenv("BB_REQUEST_CONCURRENCY", origConcurrency)
+	os.Setenv("BB_REQUEST_CONCURRENCY", "1")
 
 	bbc := testUtils.BlueButtonClient{}
 	// Set up the mock function to return the expected values
@@ -227,7 +464,7 @@ func TestWriteEOBDataToFileWithErrorsAboveFailureThreshold(t *testing.T) {
 	jobID := "1"
 	testUtils.CreateStaging(jobID)
 
-	_, err := writeBBDataToFile(&bbc, db, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	_, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
 	assert.Equal(t, "number of failed requests has exceeded threshold", err.Error())
 
 	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
@@ -252,6 +489,48 @@ func TestWriteEOBDataToFileWithErrorsAboveFailureThreshold(t *testing.T) {
 	os.Remove(errorFilePath)
 }
 
+func TestWriteEOBDataToFile_BlueButtonUnavailable(t *testing.T) {
+	bbc := testUtils.BlueButtonClient{}
+	// the first request finds the circuit breaker open; it is fetched again rather than counted as failed
+	bbc.On("GetExplanationOfBenefit", "abcdef10000").Return("", client.ErrCircuitOpen).Once()
+	bbc.On("GetExplanationOfBenefit", "abcdef10000").Return(bbc.GetData("ExplanationOfBenefit", "abcdef10000")).Once()
+	bbc.On("GetExplanationOfBenefit", "abcdef11000").Return(bbc.GetData("ExplanationOfBenefit", "abcdef11000"))
+	acoID := "387c3a62-96fa-4d93-a5d0-fd8725509dd9"
+	cmsID := "A00234"
+	beneficiaryIDs := []string{"abcdef10000", "abcdef11000"}
+	var cclfBeneficiaryIDs []string
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012309"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+
+	for i := 0; i < len(beneficiaryIDs); i++ {
+		beneficiaryID := beneficiaryIDs[i]
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI), "MBI_MODE").Return(bbc.GetData("Patient", beneficiaryID))
+	}
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+
+	jobKey, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
+	assert.Nil(t, err)
+	assert.Equal(t, 66, jobKey.RecordCount)
+	assert.Equal(t, 0, jobKey.FailedCount)
+	bbc.AssertExpectations(t)
+
+	fileUUID := strings.TrimSuffix(jobKey.FileName, ".ndjson")
+	_, err = os.Stat(fmt.Sprintf("%s/%s-error.ndjson", stagingDir, fileUUID))
+	assert.True(t, os.IsNotExist(err))
+	os.Remove(fmt.Sprintf("%s/%s", stagingDir, jobKey.FileName))
+}
+
 func TestWriteEOBDataToFile_BlueButtonIDNotFound(t *testing.T) {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
@@ -283,8 +562,18 @@ func TestWriteEOBDataToFile_BlueButtonIDNotFound(t *testing.T) {
 		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
 	}
 
-	_, err := writeBBDataToFile(&bbc, db, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	db.Unscoped().Where("job_id = ?", 1).Delete(models.JobError{})
+	defer db.Unscoped().Where("job_id = ?", 1).Delete(models.JobError{})
+
+	_, err := writeBBDataToFile(&bbc, db, cmsID, jobEnqueueArgs{ID: 1, ACOID: acoID, BeneficiaryIDs: cclfBeneficiaryIDs, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
 	assert.EqualError(t, err, "number of failed requests has exceeded threshold")
+	te, ok := err.(thresholdError)
+	assert.True(t, ok)
+	assert.Equal(t, "2 of 2 ExplanationOfBenefit requests to Blue Button failed (100.0%), exceeding the failure threshold of 51%.", te.reason())
+
+	summary, err := models.GetJobErrorSummary(db, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []models.JobErrorSummary{{ResourceType: "ExplanationOfBenefit", Code: responseutils.BbErr, Count: 2}}, summary)
 
 	files, err := ioutil.ReadDir(stagingDir)
 	assert.Nil(t, err)
@@ -328,6 +617,143 @@ func TestWriteEOBDataToFile_BlueButtonIDNotFound(t *testing.T) {
 	os.Remove(errorFilePath)
 }
 
+func TestWriteEOBDataToFile_JobCancelled(t *testing.T) {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Cancelled",
+		JobCount:   1,
+	}
+	db.Save(&j)
+	defer db.Unscoped().Delete(&j)
+
+	bbc := testUtils.BlueButtonClient{}
+	jobID := strconv.Itoa(int(j.ID))
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	_, err := writeBBDataToFile(&bbc, db, "A00234", jobEnqueueArgs{ID: int(j.ID), ACOID: "9c05c1f8-349d-400f-9b69-7963f2262b07", BeneficiaryIDs: []string{"10000", "11000"}, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now()})
+	assert.Equal(t, errJobCancelled, err)
+
+	// No Blue Button requests are made and the chunk's file is removed
+	bbc.AssertNotCalled(t, "GetPatientByIdentifierHash", mock.Anything, mock.Anything)
+	files, err := ioutil.ReadDir(stagingDir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestCancellationCheck(t *testing.T) {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "In Progress",
+		JobCount:   1,
+	}
+	db.Save(&j)
+	defer db.Unscoped().Delete(&j)
+
+	c := &cancellationCheck{db: db, jobID: strconv.Itoa(int(j.ID)), interval: time.Hour}
+	assert.False(t, c.isCancelled())
+
+	// the database isn't asked again until the interval has passed
+	assert.Nil(t, db.Model(&j).Update("status", "Cancelled").Error)
+	assert.False(t, c.isCancelled())
+	c.checkedAt = time.Now().Add(-time.Hour)
+	assert.True(t, c.isCancelled())
+}
+
+func TestWriteEOBDataToFile_WorkerStopping(t *testing.T) {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	close(stopJobs)
+	defer func() { stopJobs = make(chan struct{}) }()
+
+	bbc := testUtils.BlueButtonClient{}
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	var queJobID int64 = 9003
+	defer deleteCheckpoint(db, queJobID)
+	_, err := writeBBDataToFile(&bbc, db, "A00234", jobEnqueueArgs{ID: 1, ACOID: "9c05c1f8-349d-400f-9b69-7963f2262b07", BeneficiaryIDs: []string{"10000", "11000"}, ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now(), QueJobID: queJobID})
+	assert.Equal(t, errWorkerStopped, err)
+
+	// No Blue Button requests are made, and the checkpoint is kept for the retry
+	bbc.AssertNotCalled(t, "GetPatientByIdentifierHash", mock.Anything, mock.Anything)
+	var cp models.JobCheckpoint
+	assert.Nil(t, db.First(&cp, "que_job_id = ?", queJobID).Error)
+	assert.Equal(t, 0, cp.Completed)
+}
+
+func TestSubsetResource(t *testing.T) {
+	resource, err := subsetResource(json.RawMessage(`{"resourceType":"ExplanationOfBenefit","id":"carrier-1","meta":{"lastUpdated":"2020-02-13"},"status":"active","type":{"text":"carrier"},"patient":{"reference":"Patient/1"}}`), []string{"status", "type"})
+	assert.Nil(t, err)
+	// the elements kept stay in order
+	assert.Equal(t, `{"resourceType":"ExplanationOfBenefit","id":"carrier-1","meta":{"lastUpdated":"2020-02-13","tag":[`+string(subsettedTag)+`]},"status":"active","type":{"text":"carrier"}}`, string(resource))
+
+	resource, err = subsetResource(json.RawMessage(`{"resourceType":"Patient","id":"1","meta":{"tag":[{"code":"other"}]},"gender":"female"}`), []string{"name"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"resourceType":"Patient","id":"1","meta":{"tag":[{"code":"other"},`+string(subsettedTag)+`]}}`, string(resource))
+
+	resource, err = subsetResource(json.RawMessage(`{"resourceType":"Patient","id":"1","gender":"female"}`), []string{"name"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"resourceType":"Patient","id":"1","meta":{"tag":[`+string(subsettedTag)+`]}}`, string(resource))
+
+	_, err = subsetResource(json.RawMessage(`["Patient"]`), []string{"name"})
+	assert.NotNil(t, err)
+}
+
+func TestFhirBundleToResourceNDJSON(t *testing.T) {
+	jobID, fileUUID := "1", uuid.NewRandom().String()
+	testUtils.CreateStaging(jobID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	errorFilePath := fmt.Sprintf("%s/%s-error.ndjson", stagingDir, fileUUID)
+	defer os.Remove(errorFilePath)
+
+	// two pages, formatted across lines, with entries that have no resource
+	bundle := strings.NewReader(`{
+  "resourceType": "Bundle",
+  "link": [{"relation": "next", "url": "https://bfd.example/v1/fhir/Coverage?startIndex=2"}],
+  "entry": [
+    {"fullUrl": "https://bfd.example/v1/fhir/Coverage/part-a-1", "resource": {"resourceType": "Coverage", "id": "part-a-1", "status": "active"}},
+    {}
+  ],
+  "total": 3
+}
+{"resourceType":"Bundle","total":3,"entry":[{"resource":{"status":"active","resourceType":"Coverage","id":"part-b-1","text":"<div>&</div>"}},{"resource":null}]}
+{"resourceType":"Bundle","entry":null}`)
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	records, errs := fhirBundleToResourceNDJSON(w, bundle, "Coverage", "1", "A00234", jobID, fileUUID, nil)
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, 2, records)
+	assert.Equal(t, 0, errs)
+	// resources are copied as they were, in the same key order
+	assert.Equal(t, `{"resourceType":"Coverage","id":"part-a-1","status":"active"}
+{"status":"active","resourceType":"Coverage","id":"part-b-1","text":"<div>&</div>"}
+`, buf.String())
+
+	// resources before malformed data are still written
+	buf.Reset()
+	records, errs = fhirBundleToResourceNDJSON(w, strings.NewReader(`{"entry":[{"resource":{"id":"1"}},{"resource":{"id":`), "Coverage", "1", "A00234", jobID, fileUUID, []string{"status"})
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, 1, records)
+	assert.Equal(t, 1, errs)
+	assert.Equal(t, `{"id":"1","meta":{"tag":[`+string(subsettedTag)+`]}}`+"\n", buf.String())
+	fData, err := ioutil.ReadFile(errorFilePath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(fData), "Error unmarshaling Coverage resources from data for beneficiary 1 in ACO A00234")
+}
+
 func TestGetFailureThreshold(t *testing.T) {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
@@ -345,6 +771,138 @@ func TestGetFailureThreshold(t *testing.T) {
 	assert.Equal(t, 50.0, getFailureThreshold())
 }
 
+func TestGetRequestConcurrency(t *testing.T) {
+	origConcurrency := os.Getenv("BB_REQUEST_CONCURRENCY")
+	defer os.Setenv("BB_REQUEST_CONCURRENCY", origConcurrency)
+
+	os.Setenv("BB_REQUEST_CONCURRENCY", "10")
+	assert.Equal(t, 10, getRequestConcurrency())
+
+	os.Setenv("BB_REQUEST_CONCURRENCY", "0")
+	assert.Equal(t, 1, getRequestConcurrency())
+
+	os.Setenv("BB_REQUEST_CONCURRENCY", "many")
+	assert.Equal(t, 5, getRequestConcurrency())
+}
+
+func TestFetchInOrder(t *testing.T) {
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	fetch := func(id string) beneficiaryData {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		// later IDs finish first
+		n, _ := strconv.Atoi(id)
+		time.Sleep(time.Duration(20-n) * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return beneficiaryData{cclfBeneficiaryID: id}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	results, next := fetchInOrder(ids, 4, stop, fetch)
+	var got []string
+	for result := range results {
+		got = append(got, (<-result).cclfBeneficiaryID)
+		next()
+	}
+
+	assert.Equal(t, ids, got)
+	assert.True(t, maxRunning <= 4, "at most 4 fetches should run at once")
+}
+
+func TestFetchInOrder_Stop(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	fetch := func(id string) beneficiaryData {
+		mu.Lock()
+		fetched = append(fetched, id)
+		mu.Unlock()
+		return beneficiaryData{cclfBeneficiaryID: id}
+	}
+
+	stop := make(chan struct{})
+	results, next := fetchInOrder([]string{"1", "2", "3", "4", "5"}, 2, stop, fetch)
+	assert.Equal(t, "1", (<-<-results).cclfBeneficiaryID)
+	next()
+	assert.Equal(t, "2", (<-<-results).cclfBeneficiaryID)
+	close(stop)
+
+	// drain the fetches already started
+	for range results {
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, len(fetched) <= 3, "no fetches should start after stop")
+}
+
+func TestShutdown_JobsFinish(t *testing.T) {
+	release := make(chan struct{})
+	p := newWorkerPool(1, time.Hour, func() bool {
+		<-release
+		return true
+	})
+	p.Start()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	shutdown(p, time.Second)
+
+	assert.False(t, isWorkerStopping(), "jobs that finish in time should not be told to stop")
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	defer func() { stopJobs = make(chan struct{}) }()
+
+	inProgress := make(chan struct{})
+	p := newWorkerPool(1, time.Hour, func() bool {
+		close(inProgress)
+		// a job stops at its next checkpoint once told to
+		<-stopJobs
+		return true
+	})
+	p.Start()
+	<-inProgress
+
+	shutdown(p, 10*time.Millisecond)
+
+	assert.True(t, isWorkerStopping())
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("shutdown should return only after jobs in progress have stopped")
+	}
+}
+
+func TestGetShutdownTimeout(t *testing.T) {
+	origTimeout := os.Getenv("WORKER_SHUTDOWN_TIMEOUT_SEC")
+	defer os.Setenv("WORKER_SHUTDOWN_TIMEOUT_SEC", origTimeout)
+
+	os.Setenv("WORKER_SHUTDOWN_TIMEOUT_SEC", "45")
+	assert.Equal(t, 45*time.Second, getShutdownTimeout())
+
+	os.Setenv("WORKER_SHUTDOWN_TIMEOUT_SEC", "-1")
+	assert.Equal(t, time.Duration(0), getShutdownTimeout())
+
+	os.Setenv("WORKER_SHUTDOWN_TIMEOUT_SEC", "soon")
+	assert.Equal(t, 20*time.Second, getShutdownTimeout())
+}
+
 func TestAppendErrorToFile(t *testing.T) {
 
 	acoID := "328e83c3-bc46-4827-836c-0ba0c713dc7d"
@@ -405,6 +963,69 @@ func (s *MainTestSuite) TestProcessJobEOB() {
 	assert.Contains(s.T(), []string{"Failed", "Completed"}, completedJob.Status)
 }
 
+func (s *MainTestSuite) TestDeferIfACOBusy() {
+	origMax := os.Getenv("WORKER_MAX_ACO_CHUNKS")
+	defer os.Setenv("WORKER_MAX_ACO_CHUNKS", origMax)
+	os.Setenv("WORKER_MAX_ACO_CHUNKS", "1")
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	assert.Nil(s.T(), err)
+	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: pgxcfg, AfterConnect: que.PrepareStatements})
+	assert.Nil(s.T(), err)
+	defer pgxpool.Close()
+	c := que.NewClient(pgxpool)
+
+	// a queue of its own keeps running workers from taking the chunks
+	queue := "aco-chunk-cap-test"
+	acoID := "DBBD1CE1-AE24-435C-807D-ED45953077D3"
+	defer func() {
+		_, err := pgxpool.Exec(`delete from que_jobs where queue = $1`, queue)
+		assert.Nil(s.T(), err)
+	}()
+	args, _ := json.Marshal(jobEnqueueArgs{ID: 1, ACOID: acoID, ResourceType: "Patient"})
+	for i := 0; i < 2; i++ {
+		assert.Nil(s.T(), c.Enqueue(&que.Job{Type: "ProcessJob", Args: args, Queue: queue, Priority: 1}))
+	}
+
+	first, err := c.LockJob(queue)
+	assert.Nil(s.T(), err)
+	defer first.Done()
+	deferred, err := deferIfACOBusy(first, db, acoID)
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), deferred)
+
+	second, err := c.LockJob(queue)
+	assert.Nil(s.T(), err)
+	defer second.Done()
+	deferred, err = deferIfACOBusy(second, db, acoID)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), deferred)
+
+	// the second chunk runs later as the same que job, in the same round, and que deleting it as worked leaves it queued
+	assert.Nil(s.T(), second.Delete())
+	var later int
+	err = pgxpool.QueryRow(`select count(*) from que_jobs where job_id = $1 and priority = $2 and run_at > now()`, second.ID, second.Priority).Scan(&later)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, later)
+}
+
+func TestGetMaxACOChunks(t *testing.T) {
+	origMax := os.Getenv("WORKER_MAX_ACO_CHUNKS")
+	defer os.Setenv("WORKER_MAX_ACO_CHUNKS", origMax)
+
+	os.Setenv("WORKER_MAX_ACO_CHUNKS", "3")
+	assert.Equal(t, 3, getMaxACOChunks())
+
+	os.Setenv("WORKER_MAX_ACO_CHUNKS", "-3")
+	assert.Equal(t, 0, getMaxACOChunks())
+
+	os.Setenv("WORKER_MAX_ACO_CHUNKS", "")
+	assert.Equal(t, 0, getMaxACOChunks())
+}
+
 func (s *MainTestSuite) TestProcessJob_InvalidArgs() {
 	j := que.Job{Args: []byte("{ this is not valid JSON }")}
 	assert.EqualError(s.T(), processJob(&j), "invalid character 't' looking for beginning of object key string")
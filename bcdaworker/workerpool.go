@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// workerPool runs workOne in a number of goroutines, like que.WorkerPool, but stops taking new jobs as soon as it is
+// stopped.  A que.Worker only checks whether it has been shut down once the queue is empty, so while jobs are waiting
+// que.WorkerPool.Shutdown keeps working them.
+type workerPool struct {
+	size     int
+	interval time.Duration
+	workOne  func() bool // works one job, reporting whether there was one to work
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	done     chan struct{}
+}
+
+func newWorkerPool(size int, interval time.Duration, workOne func() bool) *workerPool {
+	return &workerPool{
+		size:     size,
+		interval: interval,
+		workOne:  workOne,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts the pool's workers.  It returns immediately.
+func (p *workerPool) Start() {
+	p.wg.Add(p.size)
+	for i := 0; i < p.size; i++ {
+		go p.work()
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.done)
+	}()
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		if p.workOne() {
+			continue
+		}
+
+		// no job was available
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+// Stop tells the workers not to take any more jobs.  Jobs in progress are left to finish; Done reports when they have.
+func (p *workerPool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// Done is closed once every worker has returned after Stop.
+func (p *workerPool) Done() <-chan struct{} {
+	return p.done
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool_StopWaitsForJobsInProgress(t *testing.T) {
+	var started int32
+	release := make(chan struct{})
+	inProgress := make(chan struct{}, 2)
+	p := newWorkerPool(2, time.Hour, func() bool {
+		atomic.AddInt32(&started, 1)
+		inProgress <- struct{}{}
+		<-release
+		return true
+	})
+	p.Start()
+
+	<-inProgress
+	<-inProgress
+	p.Stop()
+
+	select {
+	case <-p.Done():
+		t.Fatal("pool should wait for jobs in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("pool should stop once jobs in progress finish")
+	}
+	// there was always another job waiting, but none were started after Stop
+	assert.Equal(t, int32(2), atomic.LoadInt32(&started))
+}
+
+func TestWorkerPool_StopIdle(t *testing.T) {
+	p := newWorkerPool(3, time.Hour, func() bool { return false })
+	p.Start()
+	p.Stop()
+	p.Stop()
+
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle pool should stop without waiting for its interval")
+	}
+}